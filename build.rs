@@ -0,0 +1,65 @@
+// Embed the Git revision and date of the build for `--version`, so that problem reports can say
+// exactly which build they're about. Either can be given with the `BUILD_REVISION` and
+// `SOURCE_DATE_EPOCH` environment variables instead, such as when building from a source archive
+// or reproducibly.
+
+use std::{
+    env,
+    process::Command,
+    time::{SystemTime, UNIX_EPOCH},
+};
+
+fn main() {
+    println!("cargo:rerun-if-env-changed=BUILD_REVISION");
+    println!("cargo:rerun-if-env-changed=SOURCE_DATE_EPOCH");
+    println!("cargo:rerun-if-changed=.git/HEAD");
+    println!("cargo:rerun-if-changed=.git/refs/heads");
+
+    let revision = env::var("BUILD_REVISION")
+        .ok()
+        .or_else(git_revision)
+        .unwrap_or_else(|| "unknown revision".to_owned());
+    println!("cargo:rustc-env=BUILD_REVISION={revision}");
+
+    let epoch_secs = env::var("SOURCE_DATE_EPOCH")
+        .ok()
+        .and_then(|secs| secs.parse().ok())
+        .or_else(|| {
+            SystemTime::now()
+                .duration_since(UNIX_EPOCH)
+                .ok()
+                .map(|since| since.as_secs())
+        })
+        .unwrap_or_default();
+    println!("cargo:rustc-env=BUILD_DATE={}", format_date(epoch_secs));
+}
+
+fn git_revision() -> Option<String> {
+    let output = Command::new("git")
+        .args(["rev-parse", "--short=12", "HEAD"])
+        .output()
+        .ok()?;
+    let revision = String::from_utf8(output.stdout).ok()?;
+    let revision = revision.trim();
+    (output.status.success() && !revision.is_empty()).then(|| revision.to_owned())
+}
+
+/// Format seconds since the Unix epoch as a UTC date, using Howard Hinnant's `civil_from_days`
+/// algorithm, as build scripts can't use the crate's dependencies.
+fn format_date(epoch_secs: u64) -> String {
+    let days = (epoch_secs / (24 * 60 * 60)) as i64 + 719_468;
+    let era = days.div_euclid(146_097);
+    let day_of_era = days.rem_euclid(146_097);
+    let year_of_era =
+        (day_of_era - day_of_era / 1460 + day_of_era / 36_524 - day_of_era / 146_096) / 365;
+    let day_of_year = day_of_era - (365 * year_of_era + year_of_era / 4 - year_of_era / 100);
+    let month_index = (5 * day_of_year + 2) / 153;
+    let day = day_of_year - (153 * month_index + 2) / 5 + 1;
+    let month = if month_index < 10 {
+        month_index + 3
+    } else {
+        month_index - 9
+    };
+    let year = year_of_era + era * 400 + i64::from(month <= 2);
+    format!("{year:04}-{month:02}-{day:02}")
+}
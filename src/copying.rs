@@ -0,0 +1,462 @@
+use {
+    crate::{
+        has_passed, metadata::validate_book, observe, path_str, write_book_message, write_record,
+        Statistic, Style, Verbosity,
+    },
+    anyhow::{anyhow, Error, Result},
+    serde_json::json,
+    std::{
+        error::Error as StdError,
+        fmt::{self, Display, Formatter},
+        future::Future,
+        path::{Path, PathBuf},
+        sync::{
+            atomic::{AtomicBool, Ordering},
+            Arc, Mutex, PoisonError,
+        },
+        time::Duration,
+    },
+    tokio::{
+        fs::{self, File},
+        io::{self, AsyncReadExt, AsyncWriteExt},
+        sync::{mpsc::Sender, Semaphore, SemaphorePermit},
+        task::{spawn, spawn_blocking, JoinHandle},
+        time::{sleep, timeout, Instant},
+    },
+};
+
+const COPYING_CONCURRENCY: usize = 4;
+
+// How long to wait before retrying a failed copy the first time, doubling for each retry after.
+const FIRST_RETRY_DELAY: Duration = Duration::from_millis(500);
+
+/// How copies are attempted.
+#[derive(Clone, Copy, Debug)]
+pub struct CopyPolicy {
+    /// How many more times to attempt copies failing with errors that might not recur.
+    pub retries: u32,
+    /// How long a copy can take before it's abandoned as having stalled.
+    pub file_timeout: Option<Duration>,
+    /// How much of a book to read before writing it out.
+    pub buffer_size: usize,
+    /// How many bytes per second all copies can read in total.
+    pub bandwidth_limit: Option<u64>,
+    /// Whether copies are given the modification times of their books.
+    pub preserve_times: bool,
+    /// Whether books are checked to be well-formed before being copied.
+    pub validate: bool,
+    /// When copies stop being started, under `--timeout`.
+    pub deadline: Option<Instant>,
+}
+
+/// How a book is written to the destination.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum CopyKind {
+    /// Copied to where nothing exists yet, refusing to overwrite anything in case the destination
+    /// changed since it was listed.
+    New,
+    /// Copied alongside the existing copy under a hidden name first and then renamed over it, so
+    /// that an interrupted update doesn't leave a truncated book.
+    Replacement,
+}
+
+struct TokenBucket {
+    available: f64,
+    refilled_at: Option<Instant>,
+}
+
+/// Copies books for a run, holding what its copies share: the buffers they copy with, the bytes
+/// they can read before `--bwlimit` holds them back, and whether they've been stopped. Each run has
+/// its own, so that runs don't interfere with one another.
+pub struct Copier {
+    policy: CopyPolicy,
+    // Buffers are kept for later copies rather than allocated for each one. Copies wait for one of
+    // the permits before taking a buffer, so that the memory held stays bounded.
+    buffers: Mutex<Vec<Vec<u8>>>,
+    buffer_permits: Semaphore,
+    bandwidth: Mutex<TokenBucket>,
+    // Set to stop copies waiting their turn from starting, and those under way at their next
+    // write, such as under `--fail-fast` or once the destination is disconnected. Copies stopped
+    // remove what they wrote, as those failing do.
+    stopped: AtomicBool,
+}
+
+impl Copier {
+    pub fn new(policy: CopyPolicy) -> Arc<Self> {
+        Arc::new(Self {
+            policy,
+            buffers: Mutex::new(vec![]),
+            buffer_permits: Semaphore::new(COPYING_CONCURRENCY),
+            bandwidth: Mutex::new(TokenBucket {
+                available: 0.0,
+                refilled_at: None,
+            }),
+            stopped: AtomicBool::new(false),
+        })
+    }
+
+    /// Stop copies from starting, and abandon those under way.
+    pub fn stop(&self) {
+        self.stopped.store(true, Ordering::Relaxed);
+    }
+
+    fn is_stopped(&self) -> bool {
+        self.stopped.load(Ordering::Relaxed)
+    }
+
+    /// Copy a book in a task of its own once a copy buffer is free, retrying failures that might
+    /// not recur. Nothing is opened until then, so that a large library doesn't hold files open
+    /// for all of its books at once.
+    pub fn spawn_copy(
+        self: &Arc<Self>,
+        src_path: &Path,
+        dest_path: &Path,
+        kind: CopyKind,
+        stats: &Sender<Statistic>,
+    ) -> Result<JoinHandle<Result<()>>> {
+        let src_path = src_path.to_path_buf();
+        let dest_path = dest_path.to_path_buf();
+        let src_str = path_str(&src_path)?.to_owned();
+        let dest_str = path_str(&dest_path)?.to_owned();
+        let stats = stats.clone();
+        let copier = self.clone();
+
+        Ok(spawn(async move {
+            let mut buffer = copier.take_buffer(copier.policy.buffer_size).await?;
+            let buf = &mut buffer.buf;
+            copier.may_start_copy()?;
+            let started = Instant::now();
+            validate_before_copying(&src_path, copier.policy).await?;
+            observe(|observer| observer.copy_started(&src_path, &dest_path)).await?;
+            let mut copying = copier
+                .copy_once(&src_path, &dest_path, &src_str, kind, buf)
+                .await;
+            let mut retried = 0;
+            while let Err(err) = &copying {
+                if !copier.should_retry(err, retried) {
+                    break;
+                }
+                retried += 1;
+                wait_to_retry(&src_str, err, retried).await?;
+                observe(|observer| observer.copy_started(&src_path, &dest_path)).await?;
+                copying = copier
+                    .copy_once(&src_path, &dest_path, &src_str, kind, buf)
+                    .await;
+            }
+            observe(|observer| observer.copy_finished(&src_path, copying.as_ref().copied()))
+                .await?;
+            let bytes = copying?;
+            stats.send(Statistic::Transferred(bytes)).await?;
+
+            if 0 < retried {
+                stats.send(Statistic::RetriedCopy).await?;
+            }
+            let msg = match kind {
+                CopyKind::New => format!("Copied {src_str} to {dest_str}"),
+                CopyKind::Replacement => format!("Updated {dest_str} from {src_str}"),
+            };
+            let attrs = vec![
+                ("dest", json!(dest_str)),
+                ("bytes", json!(bytes)),
+                ("duration", json!(started.elapsed().as_secs_f64())),
+            ];
+            write_book_message(&src_path, Verbosity::Normal, Style::Success, msg, attrs).await?;
+            Ok(())
+        }))
+    }
+
+    /// Take a buffer to copy a book with, once one of the permits is free.
+    pub async fn take_buffer(&self, size: usize) -> Result<CopyBuffer<'_>> {
+        let permit = self.buffer_permits.acquire().await?;
+        let pooled = self
+            .buffers
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .pop();
+        let buf = pooled
+            .filter(|buf| buf.len() == size)
+            .unwrap_or_else(|| vec![0; size]);
+        Ok(CopyBuffer {
+            buf,
+            copier: self,
+            _permit: permit,
+        })
+    }
+
+    /// Check that a copy should still start, just before it does rather than when it's queued, as
+    /// it might wait a while for its turn.
+    fn may_start_copy(&self) -> Result<()> {
+        if self.is_stopped() {
+            Err(CopyingStopped::Stopped.into())
+        } else if has_passed(self.policy.deadline) {
+            Err(CopyingStopped::TimedOut.into())
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Open a book and create the file to copy it into, and copy it. Whatever was written is
+    /// removed if the copy fails, as a partial copy would otherwise be taken for the book by later
+    /// runs.
+    async fn copy_once(
+        &self,
+        src_path: &Path,
+        dest_path: &Path,
+        src_str: &str,
+        kind: CopyKind,
+        buf: &mut [u8],
+    ) -> Result<u64> {
+        let mut src = open_source(src_path).await?;
+        let (written_path, mut dest) = match kind {
+            CopyKind::New => (dest_path.to_path_buf(), create_new(dest_path).await?),
+            CopyKind::Replacement => {
+                let partial_path = partial_path(dest_path);
+                let partial = File::create(&partial_path).await?;
+                (partial_path, partial)
+            }
+        };
+
+        let copying = async {
+            let copied = self
+                .copy_reporting_progress(&mut src, &mut dest, src_str, buf)
+                .await?;
+            finish_copy(&src, dest, self.policy).await?;
+            if kind == CopyKind::Replacement {
+                fs::rename(&written_path, dest_path).await?;
+            }
+            Ok(copied)
+        };
+        let copied = within_file_timeout(self.policy.file_timeout, copying).await;
+        if copied.is_err() {
+            let _ = fs::remove_file(&written_path).await;
+        }
+        copied
+    }
+
+    /// Copy a book, telling observers how far along it is, and yielding how many bytes were
+    /// copied.
+    pub async fn copy_reporting_progress(
+        &self,
+        src: &mut File,
+        dest: &mut File,
+        src_str: &str,
+        buf: &mut [u8],
+    ) -> Result<u64> {
+        let src_path = Path::new(src_str);
+        let size = src.metadata().await.map_err(reading_source)?.len();
+
+        let mut copied = 0;
+        loop {
+            if self.is_stopped() {
+                return Err(CopyingStopped::Stopped.into());
+            }
+            let read = src.read(buf).await.map_err(reading_source)?;
+            if read == 0 {
+                break;
+            }
+            if let Some(limit) = self.policy.bandwidth_limit {
+                self.throttle(read, limit).await;
+            }
+            dest.write_all(&buf[..read]).await?;
+            copied += read as u64;
+            observe(|observer| observer.copy_progress(src_path, copied, size)).await?;
+        }
+        dest.flush().await?;
+        Ok(copied)
+    }
+
+    /// Wait for long enough that having read `bytes` more keeps copies within `limit` bytes per
+    /// second. Bytes not read in one second can't be saved up for later, so the limit holds over
+    /// short periods too.
+    async fn throttle(&self, bytes: usize, limit: u64) {
+        let limit = limit as f64;
+        let wait = {
+            let mut bucket = self
+                .bandwidth
+                .lock()
+                .unwrap_or_else(PoisonError::into_inner);
+            let now = Instant::now();
+            let elapsed = now - bucket.refilled_at.unwrap_or(now);
+            bucket.available = (bucket.available + elapsed.as_secs_f64() * limit).min(limit);
+            bucket.refilled_at = Some(now);
+            bucket.available -= bytes as f64;
+            Duration::from_secs_f64((-bucket.available).max(0.0) / limit)
+        };
+        sleep(wait).await;
+    }
+
+    /// Whether to attempt a failed copy again, which isn't worth it once copying has been stopped,
+    /// such as for the destination having been disconnected.
+    fn should_retry(&self, err: &Error, retried: u32) -> bool {
+        retried < self.policy.retries && is_transient(err) && !self.is_stopped()
+    }
+}
+
+/// A buffer to copy a book with, returned for other copies to use once dropped.
+pub struct CopyBuffer<'a> {
+    pub buf: Vec<u8>,
+    copier: &'a Copier,
+    _permit: SemaphorePermit<'a>,
+}
+
+impl Drop for CopyBuffer<'_> {
+    fn drop(&mut self) {
+        self.copier
+            .buffers
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .push(std::mem::take(&mut self.buf));
+    }
+}
+
+/// Why a copy was never made, having been stopped rather than having failed.
+#[derive(Debug)]
+pub enum CopyingStopped {
+    /// The `--timeout` passed before the copy could start.
+    TimedOut,
+    /// Copying was stopped, such as by `--fail-fast`.
+    Stopped,
+}
+
+impl Display for CopyingStopped {
+    fn fmt(&self, f: &mut Formatter<'_>) -> fmt::Result {
+        match self {
+            CopyingStopped::TimedOut => write!(f, "the --timeout passed before it could be copied"),
+            CopyingStopped::Stopped => write!(f, "copying was stopped"),
+        }
+    }
+}
+
+impl StdError for CopyingStopped {}
+
+pub async fn create_new(path: &Path) -> io::Result<File> {
+    fs::OpenOptions::new()
+        .write(true)
+        .create_new(true)
+        .open(path)
+        .await
+}
+
+/// Give a copy the modification time of its book unless `--no-preserve-times` is given, so that
+/// the Kobo's recently added books are those most recently added to the sources, and write it out.
+/// Readers are often unplugged as soon as this exits, before the OS would have written its cache
+/// out by itself.
+async fn finish_copy(src: &File, dest: File, policy: CopyPolicy) -> Result<()> {
+    let modified = if policy.preserve_times {
+        src.metadata()
+            .await
+            .and_then(|metadata| metadata.modified())
+            .ok()
+    } else {
+        None
+    };
+
+    let dest = dest.into_std().await;
+    spawn_blocking(move || {
+        // Some destinations, such as readers over MTP, can't have their times set, which doesn't
+        // make the copy any less usable.
+        if let Some(modified) = modified {
+            let _ = dest.set_modified(modified);
+        }
+        dest.sync_all()
+    })
+    .await??;
+    Ok(())
+}
+
+/// Give up on a copy taking longer than the `--file-timeout`, as copies to readers busy with
+/// something else, such as indexing, sometimes stall indefinitely.
+async fn within_file_timeout<T>(
+    file_timeout: Option<Duration>,
+    copying: impl Future<Output = Result<T>>,
+) -> Result<T> {
+    match file_timeout {
+        Some(limit) => timeout(limit, copying).await.unwrap_or_else(|_| {
+            let limit_str = humantime::format_duration(limit);
+            Err(anyhow!("it stalled for longer than {limit_str}"))
+        }),
+        None => copying.await,
+    }
+}
+
+/// Whether a failed copy might succeed if attempted again, such as after a one-off I/O error from
+/// a flaky USB hub, unlike when the destination is full or can't be written to.
+fn is_transient(err: &Error) -> bool {
+    use io::ErrorKind::*;
+    err.downcast_ref::<io::Error>().is_some_and(|err| {
+        !matches!(
+            err.kind(),
+            AlreadyExists
+                | NotFound
+                | PermissionDenied
+                | ReadOnlyFilesystem
+                | StorageFull
+                | FileTooLarge
+                | InvalidInput
+        )
+    })
+}
+
+/// Wait before retrying a copy, twice as long as before for each retry.
+async fn wait_to_retry(src_str: &str, err: &Error, retry: u32) -> Result<()> {
+    let delay = FIRST_RETRY_DELAY * 2u32.pow(retry - 1);
+    let delay_str = humantime::format_duration(delay);
+    let msg = format!("Copying {src_str} failed: {err}; retrying in {delay_str}.");
+    let attrs = vec![
+        ("src", json!(src_str)),
+        ("reason", json!(err.to_string())),
+        ("duration", json!(delay.as_secs_f64())),
+    ];
+    write_record(Verbosity::Quiet, Style::Error, msg, attrs).await?;
+    sleep(delay).await;
+    Ok(())
+}
+
+async fn open_source(path: &Path) -> io::Result<File> {
+    File::open(path).await.map_err(reading_source)
+}
+
+/// Marks an error as coming from reading a book rather than from writing its copy, keeping its
+/// kind so that it's handled the same otherwise.
+fn reading_source(err: io::Error) -> io::Error {
+    io::Error::new(err.kind(), SourceReadError(err))
+}
+
+#[derive(Debug)]
+pub struct SourceReadError(io::Error);
+
+impl Display for SourceReadError {
+    fn fmt(&self, f: &mut Formatter<'_>) -> fmt::Result {
+        self.0.fmt(f)
+    }
+}
+
+impl StdError for SourceReadError {}
+
+/// Marks a book as having failed `--validate`, so that it's counted apart from failed copies.
+#[derive(Debug)]
+pub struct InvalidBook(Error);
+
+impl Display for InvalidBook {
+    fn fmt(&self, f: &mut Formatter<'_>) -> fmt::Result {
+        write!(f, "failed validation, as {}", self.0)
+    }
+}
+
+impl StdError for InvalidBook {}
+
+/// Check a book under `--validate`, before anything is created to copy it into.
+async fn validate_before_copying(src_path: &Path, policy: CopyPolicy) -> Result<()> {
+    if !policy.validate {
+        return Ok(());
+    }
+    validate_book(src_path)
+        .await
+        .map_err(|err| InvalidBook(err).into())
+}
+
+/// Where a book is copied to before replacing the copy at `dest_path`.
+fn partial_path(dest_path: &Path) -> PathBuf {
+    let name = dest_path.file_name().unwrap_or_default().to_string_lossy();
+    dest_path.with_file_name(format!(".{name}.sync-partial"))
+}
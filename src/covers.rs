@@ -0,0 +1,118 @@
+use {
+    crate::{kobo_database::content_id, metadata::read_book_cover, path_str},
+    anyhow::{anyhow, Result},
+    image::{imageops::FilterType, ImageFormat},
+    std::{
+        fs,
+        io::Cursor,
+        path::{Path, PathBuf},
+        process::Stdio,
+    },
+    tokio::{process::Command, task::spawn_blocking},
+};
+
+// The Kobo caches the covers it shows in its own directory rather than reading them from books.
+const IMAGES_DIR: &str = ".kobo-images";
+
+// The sizes of the covers the Kobo shows when reading, in its library list, and in its library
+// grid, for its 300 PPI screens. Covers are scaled to fit within them, keeping their proportions.
+const COVER_SIZES: [(&str, u32, u32); 3] = [
+    ("N3_FULL", 1072, 1448),
+    ("N3_LIBRARY_FULL", 355, 530),
+    ("N3_LIBRARY_GRID", 149, 223),
+];
+
+/// Get the cover of a book, either embedded in an EPUB or rendered from the first page of a PDF
+/// by a renderer command. Books in other formats, and PDFs without a renderer, yield nothing.
+pub async fn read_cover(book: &Path, pdf_renderer: Option<&str>) -> Result<Option<Vec<u8>>> {
+    let is_pdf = book
+        .extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("pdf"));
+    match pdf_renderer {
+        Some(renderer) if is_pdf => render_pdf_cover(book, renderer).await.map(Some),
+        _ => read_book_cover(book).await,
+    }
+}
+
+/// Run the renderer with the PDF appended to its arguments, expecting an image on its standard
+/// output.
+async fn render_pdf_cover(book: &Path, renderer: &str) -> Result<Vec<u8>> {
+    let mut words = renderer.split_whitespace();
+    let program = words
+        .next()
+        .ok_or_else(|| anyhow!("the PDF cover renderer is empty"))?;
+
+    let output = Command::new(program)
+        .args(words)
+        .arg(book)
+        .stdin(Stdio::null())
+        .stderr(Stdio::inherit())
+        .output()
+        .await
+        .map_err(|err| anyhow!("could not run {program}: {err}"))?;
+    if !output.status.success() {
+        return Err(anyhow!("{program} failed with {}", output.status));
+    }
+    if output.stdout.is_empty() {
+        return Err(anyhow!("{program} rendered nothing"));
+    }
+    Ok(output.stdout)
+}
+
+/// Write a cover where the Kobo looks for that of a book copied to `dest`, relative to the root of
+/// the Kobo, scaled to each size the Kobo shows it at.
+pub async fn write_cover(device_dir: &Path, dest: &Path, cover: Vec<u8>) -> Result<()> {
+    let image_id = image_id(&content_id(dest));
+    let dir = images_dir(device_dir, &image_id);
+
+    spawn_blocking(move || {
+        let image = image::load_from_memory(&cover)
+            .map_err(|err| anyhow!("could not decode the cover: {err}"))?;
+
+        let dir_str = path_str(&dir)?;
+        fs::create_dir_all(&dir).map_err(|err| anyhow!("could not create {dir_str}: {err}"))?;
+
+        for (kind, width, height) in COVER_SIZES {
+            // The Kobo reads JPEGs, which have no alpha channel to keep.
+            let resized = image
+                .resize(width, height, FilterType::Triangle)
+                .into_rgb8();
+            let mut encoded = Cursor::new(vec![]);
+            resized
+                .write_to(&mut encoded, ImageFormat::Jpeg)
+                .map_err(|err| anyhow!("could not encode the cover: {err}"))?;
+
+            let path = dir.join(format!("{image_id} - {kind}.parsed"));
+            let path_str = path_str(&path)?;
+            fs::write(&path, encoded.into_inner())
+                .map_err(|err| anyhow!("could not write {path_str}: {err}"))?;
+        }
+        Ok(())
+    })
+    .await
+    .map_err(|err| anyhow!("could not write the cover: {err}"))?
+}
+
+/// The Kobo names cover images after the content ID, with the characters troublesome in filenames
+/// replaced.
+fn image_id(content_id: &str) -> String {
+    content_id.replace([' ', '/', ':', '.'], "_")
+}
+
+/// The Kobo spreads cover images across two levels of directories, named after the bottom two
+/// bytes of the Qt hash of the image ID.
+fn images_dir(device_dir: &Path, image_id: &str) -> PathBuf {
+    let hash = qt_hash(image_id);
+    device_dir
+        .join(IMAGES_DIR)
+        .join((hash & 0xff).to_string())
+        .join(((hash & 0xff00) >> 8).to_string())
+}
+
+/// The ELF-style hash Qt used for strings before Qt 5, over their UTF-8 bytes.
+fn qt_hash(s: &str) -> u32 {
+    s.bytes().fold(0u32, |hash, byte| {
+        let hash = (hash << 4).wrapping_add(u32::from(byte));
+        (hash ^ ((hash & 0xf000_0000) >> 23)) & 0x0fff_ffff
+    })
+}
@@ -0,0 +1,120 @@
+use {
+    crate::{hash_file, path_str, to_hex},
+    anyhow::{anyhow, Result},
+    serde::{Deserialize, Serialize},
+    std::{
+        collections::BTreeMap,
+        io::ErrorKind,
+        path::{Path, PathBuf},
+    },
+    tokio::fs,
+};
+
+pub const DEVICE_MANIFEST_NAME: &str = ".sync-manifest.json";
+
+#[derive(Deserialize, Serialize)]
+struct ManifestEntry {
+    size: u64,
+    sha256: String,
+}
+
+/// A record kept on the destination itself of the books this tool put there, keyed by their paths
+/// relative to it, so that any workstation it's plugged into can tell them apart from books put
+/// there by other means, and notice when they've changed since.
+#[derive(Default, Deserialize, Serialize)]
+pub struct DeviceManifest {
+    books: BTreeMap<PathBuf, ManifestEntry>,
+}
+
+impl DeviceManifest {
+    /// Load the manifest on the destination at `device_dir`, yielding nothing if it has none.
+    pub async fn load(device_dir: &Path) -> Result<Option<Self>> {
+        let path = device_dir.join(DEVICE_MANIFEST_NAME);
+        let path_str = path_str(&path)?;
+
+        match fs::read_to_string(&path).await {
+            Ok(contents) => serde_json::from_str(&contents)
+                .map(Some)
+                .map_err(|err| anyhow!("invalid manifest in {path_str}: {err}")),
+            Err(err) if err.kind() == ErrorKind::NotFound => Ok(None),
+            Err(err) => Err(anyhow!("could not read the manifest at {path_str}: {err}")),
+        }
+    }
+
+    /// Whether no books are recorded, such as for a manifest just started.
+    pub fn is_empty(&self) -> bool {
+        self.books.is_empty()
+    }
+
+    /// Whether the book at `dest`, relative to the destination, was put there by this tool.
+    pub fn contains(&self, dest: &Path) -> bool {
+        self.books.contains_key(dest)
+    }
+
+    /// Record the book at `src` as having just been copied to `dest`, relative to the destination.
+    /// The book is hashed rather than its copy, as reading it is usually much faster. Books that
+    /// can't be hashed are left out, rather than recording something wrong for them.
+    pub async fn record(&mut self, src: &Path, dest: &Path) {
+        let entry = async {
+            let size = fs::metadata(src).await?.len();
+            let sha256 = to_hex(&hash_file(src).await?);
+            Result::<_>::Ok(ManifestEntry { size, sha256 })
+        };
+        match entry.await {
+            Ok(entry) => self.books.insert(dest.to_path_buf(), entry),
+            Err(_) => self.books.remove(dest),
+        };
+    }
+
+    pub fn remove(&mut self, dest: &Path) {
+        self.books.remove(dest);
+    }
+
+    /// Find the books put on the destination at `device_dir` whose contents have changed since,
+    /// such as by being corrupted or edited by hand, yielding their paths and what's wrong with
+    /// them. Books no longer there at all are left for checks on missing books to report.
+    pub async fn find_changed(&self, device_dir: &Path) -> Result<Vec<(PathBuf, String)>> {
+        let mut changed = vec![];
+        for (dest, entry) in &self.books {
+            let path = device_dir.join(dest);
+            let Ok(metadata) = fs::metadata(&path).await else {
+                continue;
+            };
+
+            let problem = if metadata.len() != entry.size {
+                Some(format!(
+                    "is {} bytes rather than {} bytes",
+                    metadata.len(),
+                    entry.size
+                ))
+            } else {
+                match hash_file(&path).await {
+                    Ok(digest) if to_hex(&digest) == entry.sha256 => None,
+                    Ok(_) => Some("has different contents".to_owned()),
+                    Err(err) => Some(format!("could not be read: {err}")),
+                }
+            };
+            if let Some(problem) = problem {
+                changed.push((path, problem));
+            }
+        }
+        Ok(changed)
+    }
+
+    /// Save the manifest onto the destination at `device_dir`, replacing the old one in one go so
+    /// that unplugging the destination part-way through doesn't lose it.
+    pub async fn save(&self, device_dir: &Path) -> Result<()> {
+        let path = device_dir.join(DEVICE_MANIFEST_NAME);
+        let path_str = path_str(&path)?;
+
+        let saving = path.with_extension("json.saving");
+        let contents = serde_json::to_string_pretty(self)?;
+        fs::write(&saving, contents)
+            .await
+            .map_err(|err| anyhow!("could not save the manifest to {path_str}: {err}"))?;
+        fs::rename(&saving, &path)
+            .await
+            .map_err(|err| anyhow!("could not save the manifest to {path_str}: {err}"))?;
+        Ok(())
+    }
+}
@@ -0,0 +1,214 @@
+use {
+    crate::{find_books_on_device, hash_file, path_str, to_hex},
+    anyhow::{anyhow, Result},
+    chrono::{DateTime, Local},
+    serde::{Deserialize, Serialize},
+    std::{
+        collections::BTreeMap,
+        path::{Path, PathBuf},
+    },
+    tokio::fs,
+};
+
+#[derive(Clone, Deserialize, PartialEq, Serialize)]
+pub struct InventoryEntry {
+    pub path: PathBuf,
+    pub size: u64,
+    pub modified: Option<String>,
+    pub sha256: Option<String>,
+}
+
+/// A snapshot of the books on a destination, such as to see what changed on a Kobo while it was
+/// lent out. Paths are relative to the destination, so that snapshots still compare when it's
+/// mounted elsewhere.
+pub struct Inventory {
+    entries: BTreeMap<PathBuf, InventoryEntry>,
+}
+
+/// How the books on a destination differ from an earlier snapshot of it.
+pub struct InventoryDiff {
+    pub added: Vec<InventoryEntry>,
+    pub removed: Vec<InventoryEntry>,
+    pub modified: Vec<(InventoryEntry, InventoryEntry)>,
+}
+
+impl InventoryDiff {
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.modified.is_empty()
+    }
+}
+
+impl Inventory {
+    /// Take stock of the books on the destination at `device_dir`, hashing each of them if `hash`,
+    /// which takes much longer over USB.
+    pub async fn take(device_dir: &Path, hash: bool) -> Result<Self> {
+        let mut entries = BTreeMap::new();
+        for (path, size) in find_books_on_device(device_dir)
+            .await?
+            .into_values()
+            .flatten()
+        {
+            let modified = fs::metadata(&path)
+                .await
+                .and_then(|metadata| metadata.modified())
+                .ok()
+                .map(|modified| DateTime::<Local>::from(modified).to_rfc3339());
+            let sha256 = if hash {
+                let path_str = path_str(&path)?;
+                let digest = hash_file(&path)
+                    .await
+                    .map_err(|err| anyhow!("could not read {path_str}: {err}"))?;
+                Some(to_hex(&digest))
+            } else {
+                None
+            };
+
+            let path = path.strip_prefix(device_dir)?.to_path_buf();
+            let entry = InventoryEntry {
+                path: path.clone(),
+                size,
+                modified,
+                sha256,
+            };
+            entries.insert(path, entry);
+        }
+        Ok(Self { entries })
+    }
+
+    /// Load a snapshot saved by `save`, as CSV if its name ends in `.csv` and as JSON otherwise.
+    pub async fn load(path: &Path) -> Result<Self> {
+        let path_str = path_str(path)?;
+        let contents = fs::read_to_string(path)
+            .await
+            .map_err(|err| anyhow!("could not read the inventory at {path_str}: {err}"))?;
+
+        let entries: Vec<InventoryEntry> = if is_csv(path) {
+            contents
+                .lines()
+                .zip(1..)
+                .skip(1)
+                .filter(|(line, _)| !line.is_empty())
+                .map(|(line, number)| {
+                    parse_csv_entry(line).ok_or_else(|| {
+                        anyhow!("line {number} of the inventory at {path_str} is invalid")
+                    })
+                })
+                .collect::<Result<_>>()?
+        } else {
+            serde_json::from_str(&contents)
+                .map_err(|err| anyhow!("invalid inventory in {path_str}: {err}"))?
+        };
+
+        let entries = entries
+            .into_iter()
+            .map(|entry| (entry.path.clone(), entry))
+            .collect();
+        Ok(Self { entries })
+    }
+
+    /// Save the snapshot, as CSV if the name ends in `.csv` and as JSON otherwise.
+    pub async fn save(&self, path: &Path) -> Result<()> {
+        let contents = if is_csv(path) {
+            let mut csv = "path,size,modified,sha256\n".to_owned();
+            for entry in self.entries.values() {
+                let fields = [
+                    path_str(&entry.path)?,
+                    &entry.size.to_string(),
+                    entry.modified.as_deref().unwrap_or_default(),
+                    entry.sha256.as_deref().unwrap_or_default(),
+                ];
+                let fields: Vec<_> = fields.into_iter().map(quote_csv_field).collect();
+                csv += &fields.join(",");
+                csv.push('\n');
+            }
+            csv
+        } else {
+            let entries: Vec<_> = self.entries.values().collect();
+            serde_json::to_string_pretty(&entries)? + "\n"
+        };
+
+        fs::write(path, contents).await.map_err(|err| {
+            let path_str = path.to_string_lossy();
+            anyhow!("could not write the inventory to {path_str}: {err}")
+        })
+    }
+
+    /// Compare the snapshot to an earlier one. Books count as modified if their sizes or
+    /// modification times changed, or if both snapshots have hashes for them that differ.
+    pub fn diff(&self, old: &Inventory) -> InventoryDiff {
+        let added = self
+            .entries
+            .iter()
+            .filter(|(path, _)| !old.entries.contains_key(*path))
+            .map(|(_, entry)| entry.clone())
+            .collect();
+        let removed = old
+            .entries
+            .iter()
+            .filter(|(path, _)| !self.entries.contains_key(*path))
+            .map(|(_, entry)| entry.clone())
+            .collect();
+        let modified = self
+            .entries
+            .iter()
+            .filter_map(|(path, entry)| {
+                let old_entry = old.entries.get(path)?;
+                let hashes_differ = matches!(
+                    (&entry.sha256, &old_entry.sha256),
+                    (Some(hash), Some(old_hash)) if hash != old_hash
+                );
+                let changed = entry.size != old_entry.size
+                    || entry.modified != old_entry.modified
+                    || hashes_differ;
+                changed.then(|| (old_entry.clone(), entry.clone()))
+            })
+            .collect();
+
+        InventoryDiff {
+            added,
+            removed,
+            modified,
+        }
+    }
+}
+
+fn is_csv(path: &Path) -> bool {
+    path.extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("csv"))
+}
+
+fn quote_csv_field(field: &str) -> String {
+    if field.contains([',', '"', '\n']) {
+        format!("\"{}\"", field.replace('"', "\"\""))
+    } else {
+        field.to_owned()
+    }
+}
+
+fn parse_csv_entry(line: &str) -> Option<InventoryEntry> {
+    let mut fields = vec![];
+    let mut field = String::new();
+    let mut chars = line.chars().peekable();
+    let mut quoted = false;
+    while let Some(c) = chars.next() {
+        match (c, quoted) {
+            ('"', true) if chars.peek() == Some(&'"') => {
+                chars.next();
+                field.push('"');
+            }
+            ('"', _) => quoted = !quoted,
+            (',', false) => fields.push(std::mem::take(&mut field)),
+            (c, _) => field.push(c),
+        }
+    }
+    fields.push(field);
+
+    let [path, size, modified, sha256] = <[String; 4]>::try_from(fields).ok()?;
+    let optional = |field: String| (!field.is_empty()).then_some(field);
+    Some(InventoryEntry {
+        path: PathBuf::from(path),
+        size: size.parse().ok()?,
+        modified: optional(modified),
+        sha256: optional(sha256),
+    })
+}
@@ -0,0 +1,64 @@
+use {regex::Regex, std::sync::LazyLock};
+
+// Runs of digits that might be ISBNs, optionally split into groups by hyphens and ending in an `X`
+// check digit for ISBN-10s. Lookarounds aren't supported, so candidates that are merely part of
+// longer numbers are rejected by the length check instead.
+static CANDIDATES: LazyLock<Regex> =
+    LazyLock::new(|| Regex::new(r"[0-9](?:-?[0-9]){8,12}(?:-?[0-9Xx])?").unwrap());
+
+/// Find valid ISBNs in text such as a file name or a metadata identifier, normalised to ISBN-13
+/// so that the ISBN-10 and ISBN-13 forms of the same ISBN compare equal.
+pub fn find_isbns(text: &str) -> Vec<String> {
+    CANDIDATES
+        .find_iter(text)
+        .filter_map(|candidate| {
+            let digits: String = candidate
+                .as_str()
+                .chars()
+                .filter(|&c| c != '-')
+                .map(|c| c.to_ascii_uppercase())
+                .collect();
+            match digits.len() {
+                10 if is_valid_isbn10(&digits) => Some(isbn10_to_isbn13(&digits)),
+                13 if is_valid_isbn13(&digits) => Some(digits),
+                _ => None,
+            }
+        })
+        .collect()
+}
+
+fn digit_values(digits: &str) -> impl Iterator<Item = u32> + '_ {
+    digits.chars().map(|c| c.to_digit(10).unwrap_or(10))
+}
+
+fn is_valid_isbn10(digits: &str) -> bool {
+    // Only the check digit may be an X.
+    if digits[..9].contains('X') {
+        return false;
+    }
+    let sum: u32 = digit_values(digits)
+        .zip((1..=10).rev())
+        .map(|(value, weight)| value * weight)
+        .sum();
+    sum.is_multiple_of(11)
+}
+
+fn is_valid_isbn13(digits: &str) -> bool {
+    if digits.contains('X') || !(digits.starts_with("978") || digits.starts_with("979")) {
+        return false;
+    }
+    let sum: u32 = digit_values(digits)
+        .zip([1, 3].into_iter().cycle())
+        .map(|(value, weight)| value * weight)
+        .sum();
+    sum.is_multiple_of(10)
+}
+
+fn isbn10_to_isbn13(digits: &str) -> String {
+    let without_check = format!("978{}", &digits[..9]);
+    let sum: u32 = digit_values(&without_check)
+        .zip([1, 3].into_iter().cycle())
+        .map(|(value, weight)| value * weight)
+        .sum();
+    format!("{without_check}{}", (10 - sum % 10) % 10)
+}
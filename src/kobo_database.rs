@@ -0,0 +1,43 @@
+mod annotations;
+mod collections;
+
+pub use {
+    annotations::read_annotations,
+    collections::{add_to_collections, CollectionEntry},
+};
+
+use {
+    anyhow::Result,
+    rusqlite::Connection,
+    std::{
+        collections::HashSet,
+        path::{Path, PathBuf},
+    },
+};
+
+// The Kobo keeps highlights, collections, and most of the rest of its state in this database.
+const DATABASE_PATH: &str = ".kobo/KoboReader.sqlite";
+
+// Where the Kobo sees its own storage, which prefixes the content IDs of sideloaded books.
+const DEVICE_MOUNT_POINT: &str = "/mnt/onboard";
+
+fn database_path(device_dir: &Path) -> PathBuf {
+    device_dir.join(DATABASE_PATH)
+}
+
+/// Identify a sideloaded book as the Kobo does, by where it was copied to relative to the root of
+/// the Kobo.
+pub fn content_id(dest: &Path) -> String {
+    let dest = dest.to_string_lossy().replace('\\', "/");
+    format!("file://{DEVICE_MOUNT_POINT}/{dest}")
+}
+
+/// The columns of a table, which come and go across firmware versions. Tables that don't exist
+/// have no columns.
+fn table_columns(connection: &Connection, table: &str) -> Result<HashSet<String>> {
+    let mut statement = connection.prepare(&format!("PRAGMA table_info({table})"))?;
+    let columns = statement
+        .query_map([], |row| row.get::<_, String>(1))?
+        .collect::<Result<_, _>>()?;
+    Ok(columns)
+}
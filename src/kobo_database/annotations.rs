@@ -0,0 +1,169 @@
+use {
+    super::{database_path, table_columns},
+    crate::{path_str, sanitise_fat32_name},
+    anyhow::{anyhow, Result},
+    rusqlite::{Connection, OpenFlags},
+    serde::Serialize,
+    std::path::Path,
+    tokio::{fs, task::spawn_blocking},
+};
+
+/// A highlight or note made on the Kobo.
+#[derive(Debug, Serialize)]
+pub struct Annotation {
+    pub highlight: Option<String>,
+    pub note: Option<String>,
+    pub created: Option<String>,
+}
+
+/// The annotations made in a book.
+#[derive(Debug, Serialize)]
+pub struct AnnotatedBook {
+    /// The Kobo's identifier for the book, which for sideloaded books is its location on the Kobo,
+    /// such as `file:///mnt/onboard/Books/Dune.epub`.
+    pub volume_id: String,
+    pub title: Option<String>,
+    pub author: Option<String>,
+    pub annotations: Vec<Annotation>,
+}
+
+impl AnnotatedBook {
+    /// A file stem to export the annotations under, falling back to the name of the book on the
+    /// Kobo when it has no title.
+    pub fn file_stem(&self) -> String {
+        let name = self.title.clone().unwrap_or_else(|| {
+            let name = self.volume_id.rsplit('/').next().unwrap_or_default();
+            Path::new(name)
+                .file_stem()
+                .unwrap_or_default()
+                .to_string_lossy()
+                .into_owned()
+        });
+        sanitise_fat32_name(&name)
+    }
+
+    pub fn to_markdown(&self) -> String {
+        let mut markdown = format!("# {}\n", self.title.as_deref().unwrap_or(&self.volume_id));
+        if let Some(author) = &self.author {
+            markdown.push_str(&format!("\n{author}\n"));
+        }
+
+        for Annotation {
+            highlight, note, ..
+        } in &self.annotations
+        {
+            markdown.push('\n');
+            if let Some(highlight) = highlight {
+                for line in highlight.lines() {
+                    markdown.push_str(&format!("> {line}\n"));
+                }
+            }
+            if let Some(note) = note {
+                if highlight.is_some() {
+                    markdown.push('\n');
+                }
+                markdown.push_str(&format!("{note}\n"));
+            }
+        }
+        markdown
+    }
+}
+
+/// Read the highlights and notes made on a Kobo, grouped by book. Plain bookmarks, with neither
+/// highlighted text nor a note, are left out.
+pub async fn read_annotations(device_dir: &Path) -> Result<Vec<AnnotatedBook>> {
+    let database = database_path(device_dir);
+    if !fs::try_exists(&database).await? {
+        let database_str = path_str(&database)?;
+        return Err(anyhow!("there is no database at {database_str}"));
+    }
+
+    spawn_blocking(move || read_database(&database))
+        .await
+        .map_err(|err| anyhow!("could not read annotations: {err}"))?
+}
+
+fn read_database(path: &Path) -> Result<Vec<AnnotatedBook>> {
+    // Opening the database read-only avoids locking out the Kobo or leaving a journal behind.
+    let connection = Connection::open_with_flags(
+        path,
+        OpenFlags::SQLITE_OPEN_READ_ONLY | OpenFlags::SQLITE_OPEN_NO_MUTEX,
+    )?;
+
+    let bookmark_columns = table_columns(&connection, "Bookmark")?;
+    if !bookmark_columns.contains("VolumeID") {
+        return Err(anyhow!("its Bookmark table has no VolumeID column"));
+    }
+    let content_columns = table_columns(&connection, "content")?;
+    let can_join_content = content_columns.contains("ContentID");
+
+    // Columns come and go across firmware versions, so those missing are selected as nulls.
+    let bookmark_column = |name: &str| {
+        if bookmark_columns.contains(name) {
+            format!("b.{name}")
+        } else {
+            "NULL".to_owned()
+        }
+    };
+    let content_column = |name: &str| {
+        if can_join_content && content_columns.contains(name) {
+            format!("c.{name}")
+        } else {
+            "NULL".to_owned()
+        }
+    };
+    let join = if can_join_content {
+        "LEFT JOIN content c ON c.ContentID = b.VolumeID"
+    } else {
+        ""
+    };
+    let query = format!(
+        "SELECT b.VolumeID, {}, {}, {}, {}, {} FROM Bookmark b {join} \
+            ORDER BY b.VolumeID, {}, {}",
+        bookmark_column("Text"),
+        bookmark_column("Annotation"),
+        bookmark_column("DateCreated"),
+        content_column("Title"),
+        content_column("Attribution"),
+        bookmark_column("ChapterProgress"),
+        bookmark_column("DateCreated"),
+    );
+
+    let mut statement = connection.prepare(&query)?;
+    let rows = statement.query_map([], |row| {
+        Ok((
+            row.get::<_, String>(0)?,
+            row.get::<_, Option<String>>(4)?,
+            row.get::<_, Option<String>>(5)?,
+            Annotation {
+                highlight: non_empty(row.get(1)?),
+                note: non_empty(row.get(2)?),
+                created: row.get(3)?,
+            },
+        ))
+    })?;
+
+    let mut books: Vec<AnnotatedBook> = vec![];
+    for row in rows {
+        let (volume_id, title, author, annotation) = row?;
+        if annotation.highlight.is_none() && annotation.note.is_none() {
+            continue;
+        }
+        match books.last_mut() {
+            Some(book) if book.volume_id == volume_id => book.annotations.push(annotation),
+            _ => books.push(AnnotatedBook {
+                volume_id,
+                title: non_empty(title),
+                author: non_empty(author),
+                annotations: vec![annotation],
+            }),
+        }
+    }
+    Ok(books)
+}
+
+fn non_empty(field: Option<String>) -> Option<String> {
+    field
+        .map(|field| field.trim().to_owned())
+        .filter(|field| !field.is_empty())
+}
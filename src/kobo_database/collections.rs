@@ -0,0 +1,125 @@
+use {
+    super::{content_id, database_path, table_columns},
+    crate::path_str,
+    anyhow::{anyhow, Result},
+    chrono::Utc,
+    rusqlite::{params, Connection, OpenFlags},
+    std::{fs, path::Path},
+    tokio::task::spawn_blocking,
+};
+
+const SHELF_COLUMNS: [&str; 8] = [
+    "Id",
+    "InternalName",
+    "Name",
+    "CreationDate",
+    "LastModified",
+    "_IsDeleted",
+    "_IsVisible",
+    "_IsSynced",
+];
+const SHELF_CONTENT_COLUMNS: [&str; 5] = [
+    "ShelfName",
+    "ContentId",
+    "DateModified",
+    "_IsDeleted",
+    "_IsSynced",
+];
+
+/// A book to add to a collection, identified as the Kobo identifies sideloaded books.
+pub struct CollectionEntry {
+    pub collection: String,
+    pub content_id: String,
+}
+
+impl CollectionEntry {
+    /// Identify a book by where it was copied to, relative to the root of the Kobo.
+    pub fn new(collection: String, dest: &Path) -> Self {
+        CollectionEntry {
+            collection,
+            content_id: content_id(dest),
+        }
+    }
+}
+
+/// Add books to collections on the Kobo, creating the collections if need be. The database is
+/// backed up alongside itself first, and is left untouched if its tables aren't laid out as
+/// expected. Yields how many books were added to collections that weren't already in them.
+pub async fn add_to_collections(device_dir: &Path, entries: Vec<CollectionEntry>) -> Result<usize> {
+    let database = database_path(device_dir);
+    if !tokio::fs::try_exists(&database).await? {
+        let database_str = path_str(&database)?;
+        return Err(anyhow!("there is no database at {database_str}"));
+    }
+
+    spawn_blocking(move || update_database(&database, &entries))
+        .await
+        .map_err(|err| anyhow!("could not update collections: {err}"))?
+}
+
+fn update_database(path: &Path, entries: &[CollectionEntry]) -> Result<usize> {
+    let mut connection = Connection::open_with_flags(
+        path,
+        OpenFlags::SQLITE_OPEN_READ_WRITE | OpenFlags::SQLITE_OPEN_NO_MUTEX,
+    )?;
+
+    for (table, expected_columns) in [
+        ("Shelf", &SHELF_COLUMNS[..]),
+        ("ShelfContent", &SHELF_CONTENT_COLUMNS[..]),
+    ] {
+        let columns = table_columns(&connection, table)?;
+        if let Some(missing) = expected_columns
+            .iter()
+            .find(|column| !columns.contains(**column))
+        {
+            return Err(anyhow!("its {table} table has no {missing} column"));
+        }
+    }
+
+    let backup = path.with_extension("sqlite.sync-backup");
+    let backup_str = path_str(&backup)?;
+    fs::copy(path, &backup)
+        .map_err(|err| anyhow!("could not back up the database to {backup_str}: {err}"))?;
+
+    let now = Utc::now().format("%Y-%m-%dT%H:%M:%SZ").to_string();
+    let transaction = connection.transaction()?;
+    let mut added = 0;
+
+    for CollectionEntry {
+        collection,
+        content_id,
+    } in entries
+    {
+        // Collections and their books deleted on the Kobo linger as rows marked as deleted, so
+        // those are revived rather than duplicated.
+        transaction.execute(
+            "UPDATE Shelf SET _IsDeleted = 'false', LastModified = ?1 \
+                WHERE Name = ?2 AND _IsDeleted = 'true'",
+            params![now, collection],
+        )?;
+        transaction.execute(
+            "INSERT INTO Shelf \
+                (Id, InternalName, Name, CreationDate, LastModified, _IsDeleted, _IsVisible, \
+                    _IsSynced) \
+                SELECT ?2, ?2, ?2, ?1, ?1, 'false', 'true', 'false' \
+                WHERE NOT EXISTS (SELECT 1 FROM Shelf WHERE Name = ?2)",
+            params![now, collection],
+        )?;
+
+        added += transaction.execute(
+            "UPDATE ShelfContent SET _IsDeleted = 'false', DateModified = ?3 \
+                WHERE ShelfName = ?1 AND ContentId = ?2 AND _IsDeleted = 'true'",
+            params![collection, content_id, now],
+        )?;
+        added += transaction.execute(
+            "INSERT INTO ShelfContent (ShelfName, ContentId, DateModified, _IsDeleted, _IsSynced) \
+                SELECT ?1, ?2, ?3, 'false', 'false' \
+                WHERE NOT EXISTS \
+                    (SELECT 1 FROM ShelfContent WHERE ShelfName = ?1 AND ContentId = ?2)",
+            params![collection, content_id, now],
+        )?;
+    }
+
+    transaction.commit()?;
+    Ok(added)
+}
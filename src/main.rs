@@ -5,23 +5,77 @@
 
 #![forbid(unsafe_code)]
 
+mod copying;
+mod covers;
+mod device_manifest;
+mod inventory;
+mod isbn;
+mod kobo_database;
+mod metadata;
+mod observer;
+mod picker;
+mod sftp;
+mod sync_state;
+mod syncignore;
+
 use {
     anyhow::{anyhow, Error, Result},
-    async_walkdir::WalkDir,
-    clap::Parser,
+    async_walkdir::{Filtering, WalkDir},
+    chrono::{Local, NaiveDate, NaiveTime},
+    clap::{CommandFactory, Parser, ValueEnum, ValueHint},
+    clap_complete::Shell,
+    copying::{
+        create_new, Copier, CopyKind, CopyPolicy, CopyingStopped, InvalidBook, SourceReadError,
+    },
+    covers::{read_cover, write_cover},
+    deunicode::deunicode,
+    device_manifest::DeviceManifest,
     directories::UserDirs,
+    globset::{GlobBuilder, GlobSet, GlobSetBuilder},
+    inventory::{Inventory, InventoryEntry},
+    isbn::find_isbns,
+    kobo_database::{add_to_collections, read_annotations, CollectionEntry},
+    metadata::read_book_metadata,
+    notify::{Event, EventKind, RecursiveMode, Watcher},
+    observer::{ignore, Observer, Observing},
+    picker::Candidate,
+    regex::Regex,
+    serde::Serialize,
+    sftp::SftpTarget,
+    sha2::{Digest, Sha256},
     std::{
-        collections::HashSet,
+        cmp::Reverse,
+        collections::{BTreeMap, BTreeSet, HashMap, HashSet},
         ffi::OsStr,
-        path::{Path, PathBuf},
-        sync::Arc,
+        fmt::{self, Display, Formatter, Write as _},
+        io::IsTerminal,
+        path::{Component, Path, PathBuf},
+        pin::pin,
+        process::{exit, Stdio},
+        sync::{
+            atomic::{AtomicBool, AtomicU8, AtomicUsize, Ordering},
+            Arc, Mutex, OnceLock, PoisonError,
+        },
+        time::{Duration, SystemTime},
     },
+    sync_state::SyncState,
+    syncignore::SyncIgnore,
     tokio::{
         self,
         fs::{self, File},
-        io::{self, stdout, AsyncWriteExt},
-        sync::mpsc::{channel, Receiver, Sender},
-        task::{spawn, JoinHandle},
+        io::{
+            self, stderr, stdout, AsyncBufReadExt, AsyncRead, AsyncReadExt, AsyncWriteExt,
+            BufReader,
+        },
+        process::Command,
+        select,
+        signal::ctrl_c,
+        sync::{
+            mpsc::{channel, unbounded_channel, Receiver, Sender},
+            Semaphore,
+        },
+        task::{spawn, spawn_blocking, JoinHandle},
+        time::{interval, sleep, sleep_until, Instant},
     },
     tokio_stream::StreamExt,
     whoami::username,
@@ -29,6 +83,17 @@ use {
 
 const NAME: &str = "sync-kobo-and-workstation";
 
+// The version along with the revision and date it was built from, embedded by `build.rs`, so that
+// problem reports can say exactly which build they're about.
+const VERSION: &str = concat!(
+    env!("CARGO_PKG_VERSION"),
+    " (",
+    env!("BUILD_REVISION"),
+    ", built ",
+    env!("BUILD_DATE"),
+    ")"
+);
+
 const LONG_ABOUT: &str = "Synchronise books between a workstation and a Kobo e-book reader. In \
                           practice, this means synchronising a connected Kobo volume with EPUB \
                           and PDF files in the specified local documents directories. The \
@@ -36,310 +101,8332 @@ const LONG_ABOUT: &str = "Synchronise books between a workstation and a Kobo e-b
                           directory such as /var/media/user/KOBOeReader for the destination Kobo \
                           and defaulting to just ~/Documents for the source. However, if these \
                           defaults are overridden with explicit values, it will likely work on \
-                          other OSes too.";
+                          other OSes too.\n\n\
+                          Exits with status 0 on success and 1 on errors that stop it, such as \
+                          the Kobo not being found. Dry runs exit with 2 when books would be \
+                          copied or removed, as do checks when the Kobo differs from the \
+                          sources. Runs that finish despite some books not being copied or read \
+                          exit with 3.";
+
+// The directory at the root of a Kobo's storage in which it keeps its own state.
+const KOBO_STATE_DIR: &str = ".kobo";
 
-const EXTENSIONS_TO_SYNCHRONISE: [&str; 2] = ["epub", ".pdf"];
+const EXTENSIONS_TO_SYNCHRONISE: [&str; 2] = ["epub", "pdf"];
+
+const BOOK_LIST_FROM_STDIN: &str = "-";
+
+// Like `diff`, distinguish finding differences from errors, which exit with 1. Dry runs exit with
+// this when books would be copied or removed, and checks when the Kobo differs from the sources.
+const CHANGES_PENDING_EXIT_CODE: i32 = 2;
+
+// For runs that finish despite some books failing, so that they can be told apart from runs that
+// couldn't even start.
+const PARTLY_FAILED_EXIT_CODE: i32 = 3;
 
 const FOUND_BOOKS_CHANNEL_BOUND: usize = 128;
 const STATISTICS_CHANNEL_BOUND: usize = 128;
 
+const HASHING_CONCURRENCY: usize = 4;
+const HASHING_BUFFER_SIZE: usize = 64 * 1024;
+
+// FAT filesystems, as on Kobos, only store modification times to the nearest two seconds.
+const MODIFIED_TIME_RESOLUTION: Duration = Duration::from_secs(2);
+const METADATA_READING_CONCURRENCY: usize = 4;
+
+const MIN_MAX_NAME_LENGTH: usize = 32;
+
+// Pruned books are moved here, relative to the root of the Kobo. Being hidden, neither the Kobo nor
+// this tool treat what's in it as books.
+const TRASH_DIR_NAME: &str = ".sync-trash";
+
+// `EIO` and `ENODEV`, which are the same across Linux and macOS, as given by I/O to a device that
+// has gone away.
+const DEVICE_ERROR_CODES: [i32; 2] = [5, 19];
+
+// How many copies in a row must fail with device errors for the destination to be taken to have
+// been disconnected.
+const DISCONNECTION_FAILURES: usize = 3;
+
+// Created and deleted on the destination to check that it can be written to.
+const WRITE_PROBE_NAME: &str = ".sync-write-probe";
+
+// Held on the destination while synchronising to it, so that runs don't race each other.
+const LOCK_FILE_NAME: &str = ".sync-lock";
+
+// Locks taken on other workstations, whose processes can't be checked on, are only broken once
+// this old.
+const STALE_LOCK_AGE: Duration = Duration::from_secs(24 * 60 * 60);
+
+// How often `--watch` checks whether the Kobo has been plugged in or unplugged, and for how many
+// checks in a row it must be there before synchronising to it.
+const WATCH_POLL_INTERVAL: Duration = Duration::from_secs(2);
+const WATCH_SETTLE_POLLS: usize = 2;
+
+// How long changes in the documents directories must stop for before `--watch-sources` copies the
+// books changed.
+const WATCH_SOURCES_SETTLE_TIME: Duration = Duration::from_secs(2);
+
+// Leave some room on the destination for the reader's own databases and thumbnails.
+const FREE_SPACE_MARGIN: u64 = 16 * 1024 * 1024;
+
 macro_rules! println_async {
     ($fmt:literal $(, $elem:expr )* $(,)?) => {
-        {
-            let msg = format!($fmt, $( $elem, )*);
-            stdout().write_all(msg.as_bytes()).await?;
-            stdout().write_all(b"\n")
-        }
+        write_message(Verbosity::Normal, Style::Plain, format!($fmt, $( $elem, )*))
     };
 }
 
-#[derive(Debug)]
-enum Statistic {
-    FoundSrcDocument,
-    NotCopiedBecauseAlreadyExistedAtDest,
-    Copied,
+// For messages written even under `--quiet` for being what was asked for, such as listings.
+macro_rules! println_always {
+    ($fmt:literal $(, $elem:expr )* $(,)?) => {
+        write_message(Verbosity::Quiet, Style::Plain, format!($fmt, $( $elem, )*))
+    };
 }
 
-async fn is_accessible_dir(path: &Path) -> bool {
-    fs::metadata(path)
-        .await
-        .map(|m| m.is_dir())
-        .unwrap_or(false)
+// For errors and warnings, which are written even under `--quiet`.
+macro_rules! println_error {
+    ($fmt:literal $(, $elem:expr )* $(,)?) => {
+        write_message(Verbosity::Quiet, Style::Error, format!($fmt, $( $elem, )*))
+    };
 }
 
-fn lookup_default_kobo_storage_directory() -> PathBuf {
-    let mut buf = PathBuf::new();
-    buf.push("/media");
-    buf.push(username());
-    buf.push("KOBOeReader");
-    buf
+// Messages about books can be followed by attributes after a semicolon, such as `dest = dest_str`,
+// which `--log-format json` gives their own keys.
+macro_rules! book_message {
+    (
+        $level:expr,
+        $style:expr,
+        $book:expr,
+        $fmt:literal $(, $elem:expr )* ;
+        $( $key:ident = $value:expr ),+ $(,)?
+    ) => {
+        write_book_message(
+            $book,
+            $level,
+            $style,
+            format!($fmt, $( $elem, )*),
+            log_attrs!($( $key = $value ),+),
+        )
+    };
+    ($level:expr, $style:expr, $book:expr, $fmt:literal $(, $elem:expr )* $(,)?) => {
+        write_book_message($book, $level, $style, format!($fmt, $( $elem, )*), vec![])
+    };
 }
 
-fn lookup_home_directory() -> Result<PathBuf> {
-    let dirs =
-        UserDirs::new().ok_or_else(|| anyhow!("failed to read the current home directory"))?;
+macro_rules! println_about_book {
+    ($( $arg:tt )*) => {
+        book_message!(Verbosity::Normal, Style::Plain, $( $arg )*)
+    };
+}
 
-    let home = dirs.home_dir();
-    Ok(home.to_path_buf())
+// For books copied, or that would be when dry-running.
+macro_rules! println_copied_book {
+    ($( $arg:tt )*) => {
+        book_message!(Verbosity::Normal, Style::Success, $( $arg )*)
+    };
 }
 
-fn lookup_default_documents_directories() -> Result<Vec<PathBuf>> {
-    let home = lookup_home_directory()?;
+// For books not copied, saying why.
+macro_rules! println_skipped_book {
+    ($( $arg:tt )*) => {
+        book_message!(Verbosity::Normal, Style::Dim, $( $arg )*)
+    };
+}
 
-    let mut documents = PathBuf::new();
-    documents.push(home);
-    documents.push("Documents");
+// For books that something went wrong for, which are written even under `--quiet`.
+macro_rules! println_error_about_book {
+    ($( $arg:tt )*) => {
+        book_message!(Verbosity::Quiet, Style::Error, $( $arg )*)
+    };
+}
 
-    Ok(vec![documents])
+macro_rules! log_attrs {
+    ($( $key:ident = $value:expr ),+) => {
+        vec![$( (stringify!($key), serde_json::json!($value)) ),+]
+    };
 }
 
-async fn find_books(
-    dirs: &[PathBuf],
-    extensions_to_match: &HashSet<&OsStr>,
-    books: Sender<PathBuf>,
-    stats: Sender<Statistic>,
-) -> Result<()> {
-    for dir in dirs {
-        let mut entries = WalkDir::new(dir);
-        loop {
-            match entries.next().await {
-                Some(Ok(entry)) => {
-                    let path = entry.path();
-                    if let Some(ext) = path.extension() {
-                        if extensions_to_match.contains(&ext) {
-                            stats.send(Statistic::FoundSrcDocument).await?;
-
-                            let path_buf = path.to_path_buf();
-                            books.send(path_buf).await?;
-                        }
-                    }
-                }
-                Some(Err(err)) => Err(anyhow!(err))?,
-                None => break,
-            }
+/// Attributes of a message beyond the book it's about, such as where the book was copied to.
+type LogAttrs = Vec<(&'static str, serde_json::Value)>;
+
+/// How much to say about what's happening. Messages are written at the least verbosity that they
+/// should be seen at.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+enum Verbosity {
+    Quiet,
+    Normal,
+    Verbose,
+}
+
+// Set by `--quiet` and `--verbose`.
+static VERBOSITY: AtomicU8 = AtomicU8::new(Verbosity::Normal as u8);
+
+fn verbosity() -> Verbosity {
+    match VERBOSITY.load(Ordering::Relaxed) {
+        0 => Verbosity::Quiet,
+        1 => Verbosity::Normal,
+        _ => Verbosity::Verbose,
+    }
+}
+
+impl Verbosity {
+    /// The level of messages written at the verbosity, as understood by journald and the like.
+    fn level_name(self) -> &'static str {
+        match self {
+            Verbosity::Quiet => "notice",
+            Verbosity::Normal => "info",
+            Verbosity::Verbose => "debug",
         }
     }
-    Ok(())
 }
 
-fn path_str(path: &Path) -> Result<&str> {
-    path.to_str()
-        .ok_or_else(|| anyhow!("could not decode a path to UTF-8"))
+/// How to write messages: as text for humans, or as a JSON object per message for tools.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+enum LogFormat {
+    Text,
+    Json,
 }
 
-async fn copy_to_non_existant(
-    src_path: &Path,
-    dest_path: &Path,
-    dry_run: bool,
-) -> Result<JoinHandle<Result<()>>> {
-    if dry_run {
-        let (src, dest) = (path_str(src_path)?, path_str(dest_path)?);
-        println_async!("Dry-running; would otherwise copy {src} to {dest}").await?;
-        Ok(spawn(async { Ok(()) }))
-    } else {
-        let mut src = File::open(src_path).await?;
+// Set by `--log-format json`.
+static LOG_AS_JSON: AtomicBool = AtomicBool::new(false);
 
-        let mut dest = fs::OpenOptions::new()
-            .write(true)
-            .create_new(true)
-            .open(dest_path)
-            .await?;
+/// Format a message as it will be written. As JSON, it gets the time, its level, and the book
+/// it's about as `src`, along with its attributes; as text, it stays as it is.
+fn format_message(level: Verbosity, book: Option<&Path>, msg: String, attrs: LogAttrs) -> String {
+    if !LOG_AS_JSON.load(Ordering::Relaxed) {
+        return msg;
+    }
+
+    let mut record = serde_json::Map::new();
+    record.insert("time".to_owned(), Local::now().to_rfc3339().into());
+    record.insert("level".to_owned(), level.level_name().into());
+    // Blank lines separating sections only make sense as text.
+    record.insert("msg".to_owned(), msg.trim().into());
+    if let Some(book) = book {
+        record.insert("src".to_owned(), book.to_string_lossy().into());
+    }
+    for (key, value) in attrs {
+        record.insert(key.to_owned(), value);
+    }
+    serde_json::Value::Object(record).to_string()
+}
 
-        let src_str = path_str(src_path)?.to_owned();
-        let dest_str = path_str(dest_path)?.to_owned();
+// Set when standard output is reserved for machine-readable output, which messages for humans
+// would otherwise corrupt.
+static MESSAGES_TO_STDERR: AtomicBool = AtomicBool::new(false);
 
-        Ok(spawn(async move {
-            io::copy(&mut src, &mut dest).await?;
-            println_async!("Copied {src_str} to {dest_str}").await?;
-            Ok(())
-        }))
+/// How a message stands out when written to a terminal in colour.
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+enum Style {
+    Plain,
+    Error,
+    Success,
+    Dim,
+    Bold,
+}
+
+impl Style {
+    fn paint(self, line: &str) -> String {
+        let code = match self {
+            Style::Plain => return line.to_owned(),
+            Style::Error => "31",
+            Style::Success => "32",
+            Style::Dim => "2",
+            Style::Bold => "1",
+        };
+        format!("\x1b[{code}m{line}\x1b[0m")
     }
 }
 
-async fn sync_books(
-    dest_dir: &Path,
-    dry_run: bool,
-    mut books_to_sync: Receiver<PathBuf>,
-    stats: Sender<Statistic>,
-) -> Result<()> {
-    let mut copy_tasks = vec![];
+/// When to write messages in colour, as chosen by `--color`.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, ValueEnum)]
+enum ColourChoice {
+    /// When writing messages to a terminal, unless `NO_COLOR` is set.
+    Auto,
+    Always,
+    Never,
+}
 
-    while let Some(book) = books_to_sync.recv().await {
-        let mut dest_path = PathBuf::new();
-        dest_path.push(dest_dir);
+// Set when messages are written to the terminal in colour. The log file and JSON output never are.
+static COLOUR: AtomicBool = AtomicBool::new(false);
 
-        if let Some(book_name) = book.file_name() {
-            dest_path.push(book_name);
+async fn write_message(level: Verbosity, style: Style, msg: String) -> io::Result<()> {
+    write_record(level, style, msg, vec![]).await
+}
 
-            if let Ok(copy_task) = copy_to_non_existant(&book, &dest_path, dry_run).await {
-                copy_tasks.push(copy_task);
-                stats.send(Statistic::Copied).await?;
-            } else {
-                let dest_str = path_str(&dest_path)?;
-                println_async!(
-                    "Book {dest_str} already exists on the destination; will not copy across."
-                )
-                .await?;
-                stats
-                    .send(Statistic::NotCopiedBecauseAlreadyExistedAtDest)
-                    .await?;
-            }
-        }
+async fn write_record(
+    level: Verbosity,
+    style: Style,
+    msg: String,
+    attrs: LogAttrs,
+) -> io::Result<()> {
+    if verbosity() < level {
+        return Ok(());
     }
+    write_line(format_message(level, None, msg, attrs), style).await
+}
+
+async fn write_line(line: String, style: Style) -> io::Result<()> {
+    append_to_log_file(&format!("{line}\n")).await?;
+    let mut line = if COLOUR.load(Ordering::Relaxed) {
+        style.paint(&line)
+    } else {
+        line
+    };
+    line.push('\n');
 
-    for task in copy_tasks {
-        task.await??;
+    // Each handle writes in the background, so the line is flushed through the same handle;
+    // otherwise, the last lines could still be unwritten when exiting with a status.
+    if MESSAGES_TO_STDERR.load(Ordering::Relaxed) {
+        let mut err = stderr();
+        err.write_all(line.as_bytes()).await?;
+        err.flush().await
+    } else {
+        let mut out = stdout();
+        out.write_all(line.as_bytes()).await?;
+        out.flush().await
     }
+}
+
+// Set by `--log-file`, which gets a copy of every message written.
+static LOG_FILE: tokio::sync::Mutex<Option<File>> = tokio::sync::Mutex::const_new(None);
 
+/// Open the `--log-file` for appending, creating it if need be. Only its owner can read it, as it
+/// names the books synchronised.
+async fn open_log_file(path: &Path) -> Result<()> {
+    let mut options = fs::OpenOptions::new();
+    options.create(true).append(true);
+    #[cfg(unix)]
+    options.mode(0o600);
+    let file = options.open(path).await.map_err(|err| {
+        let path_str = path.to_string_lossy();
+        anyhow!("Could not open the log file at {path_str}: {err}")
+    })?;
+    *LOG_FILE.lock().await = Some(file);
     Ok(())
 }
 
-async fn collect_stats(dest_dirs: &[PathBuf], mut stats: Receiver<Statistic>) -> Result<()> {
-    let mut found_src_documents: usize = 0;
-    let mut not_copied: usize = 0;
-    let mut copied: usize = 0;
-
-    while let Some(stat) = stats.recv().await {
-        use Statistic::*;
-        match stat {
-            FoundSrcDocument => {
-                found_src_documents += 1;
-            }
-            NotCopiedBecauseAlreadyExistedAtDest => {
-                not_copied += 1;
-            }
-            Copied => {
-                copied += 1;
-            }
-        }
+/// Append a line to the `--log-file`, if there is one. Each line is flushed straight away, so
+/// that nothing is lost when interrupted with Ctrl-C.
+async fn append_to_log_file(line: &str) -> io::Result<()> {
+    if let Some(file) = LOG_FILE.lock().await.as_mut() {
+        file.write_all(line.as_bytes()).await?;
+        file.flush().await?;
     }
+    Ok(())
+}
 
-    let len = dest_dirs.len();
-    let dest_str: String =
-        dest_dirs
-            .iter()
-            .zip(1..)
-            .try_fold(String::new(), |mut s, (dir, i)| {
-                s.push_str(path_str(dir)?);
-                if i < len {
-                    s.push_str(" and ");
-                }
-                Ok::<String, Error>(s)
-            })?;
+// Set by `--stream`, to write messages about books as soon as they happen rather than holding them
+// back to sort them.
+static STREAM_MESSAGES: AtomicBool = AtomicBool::new(false);
+static BOOK_MESSAGES: Mutex<Vec<(PathBuf, String, Style)>> = Mutex::new(vec![]);
 
-    println_async!(
-        "\n\
-        Found documents in documents directory at {dest_str}: {found_src_documents}\n\
-        Books not copied because they already exist on the destination Kobo: {not_copied}\n\
-        Book copied: {copied}"
-    )
-    .await?;
+/// Write a message about a book. Books are found and copied concurrently, so these are held back
+/// until `flush_book_messages` unless streaming, to keep the output the same across runs.
+async fn write_book_message(
+    book: &Path,
+    level: Verbosity,
+    style: Style,
+    msg: String,
+    attrs: LogAttrs,
+) -> io::Result<()> {
+    if verbosity() < level {
+        return Ok(());
+    }
+    let line = format_message(level, Some(book), msg, attrs);
+    if STREAM_MESSAGES.load(Ordering::Relaxed) {
+        write_line(line, style).await
+    } else {
+        BOOK_MESSAGES
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .push((book.to_path_buf(), line, style));
+        Ok(())
+    }
+}
 
+/// Write the messages held back so far, sorted by the books they're about. Messages about the same
+/// book stay in the order they happened.
+async fn flush_book_messages() -> io::Result<()> {
+    let mut messages =
+        std::mem::take(&mut *BOOK_MESSAGES.lock().unwrap_or_else(PoisonError::into_inner));
+    messages.sort_by(|(a, _, _), (b, _, _)| a.cmp(b));
+    for (_, line, style) in messages {
+        write_line(line, style).await?;
+    }
     Ok(())
 }
 
-#[derive(Debug, Parser)]
-#[command(name = NAME, about, author, version, long_about = LONG_ABOUT)]
-struct PartialArgs {
-    /// The directory of the mounted Kobo storage directory to which to synchronise the books and
-    /// documents.
-    #[arg(long)]
-    kobo_directory: Option<PathBuf>,
+// How many books to name for each kind of failure in the summary, unless `--verbose`.
+const FAILURE_EXAMPLES: usize = 3;
 
-    /// The directory of the documents directories from which to synchronise books and documents.
-    #[arg(long)]
-    documents_directories: Option<Vec<PathBuf>>,
+// Set by `--target-directory`, when synchronising to a plain directory rather than a Kobo.
+static PLAIN_TARGET: AtomicBool = AtomicBool::new(false);
 
-    /// Whether to dry run, documenting what would happen rather than doing it.
-    #[arg(long, default_value_t = false)]
-    dry_run: bool,
+/// How to refer to where books are being synchronised in messages.
+fn destination_name() -> &'static str {
+    if PLAIN_TARGET.load(Ordering::Relaxed) {
+        "the target directory"
+    } else {
+        "the Kobo"
+    }
 }
 
-struct Args {
-    kobo_directory: PathBuf,
-    documents_directories: Vec<PathBuf>,
-    dry_run: bool,
+// Those told what happens to each book, such as the progress reporter for `--progress`.
+static OBSERVERS: OnceLock<Vec<Box<dyn Observer>>> = OnceLock::new();
+
+/// Tell every observer of an event, waiting for each in turn.
+async fn observe(event: impl for<'a> Fn(&'a dyn Observer) -> Observing<'a>) -> Result<()> {
+    for observer in OBSERVERS.get().into_iter().flatten() {
+        event(observer.as_ref()).await?;
+    }
+    Ok(())
 }
 
-async fn parse_args() -> Result<Args> {
-    let partial @ PartialArgs { dry_run, .. } = PartialArgs::parse();
+/// Reports each tenth of the way through copying a book under `--progress`, for destinations slow
+/// enough that silence looks like a hang.
+#[derive(Default)]
+struct ProgressReporter {
+    reported_tenths: Mutex<HashMap<PathBuf, u64>>,
+}
 
-    let kobo_directory = partial
-        .kobo_directory
-        .unwrap_or_else(lookup_default_kobo_storage_directory);
+impl Observer for ProgressReporter {
+    fn copy_started(&self, src: &Path, _dest: &Path) -> Observing<'_> {
+        self.reported_tenths
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .insert(src.to_path_buf(), 0);
+        ignore()
+    }
 
-    let documents_directories = partial.documents_directories.unwrap_or_else(|| {
-        lookup_default_documents_directories().expect(
-            "failed to lookup the default documents directory while yielding a default \
-                    value for that missing argument",
-        )
-    });
+    fn copy_progress(&self, src: &Path, copied: u64, total: u64) -> Observing<'_> {
+        let tenths = copied * 10 / total.max(1);
+        let mut reported_tenths = self
+            .reported_tenths
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner);
+        let reported = reported_tenths.entry(src.to_path_buf()).or_default();
+        if tenths <= *reported {
+            return ignore();
+        }
+        *reported = tenths;
 
-    if !is_accessible_dir(&kobo_directory).await {
-        let inaccessible = kobo_directory.to_str().ok_or_else(|| {
-            anyhow!("could not decode Kobo directory path as UTF-8 while reporting its absense")
-        })?;
-        return Err(anyhow!(
-            "The Kobo storage directory at {inaccessible} is not accessible"
-        ));
+        let src_str = src.to_string_lossy().into_owned();
+        Box::pin(async move {
+            println_async!("Copying {src_str}: {}%", tenths * 10).await?;
+            Ok(())
+        })
     }
-    for dir in &documents_directories {
-        if !is_accessible_dir(dir).await {
-            let inaccessible = dir.to_str().ok_or_else(|| {
-                anyhow!(
-                    "could not a decode documents directory path as UTF-8 while reporting its \
-                        absence",
-                )
-            })?;
-            return Err(anyhow!(
-                "The documents directory at {inaccessible} is not accessible"
-            ));
-        }
+
+    fn copy_finished(&self, src: &Path, _result: Result<u64, &Error>) -> Observing<'_> {
+        self.reported_tenths
+            .lock()
+            .unwrap_or_else(PoisonError::into_inner)
+            .remove(src);
+        ignore()
     }
+}
 
-    Ok(Args {
-        kobo_directory,
-        documents_directories,
-        dry_run,
-    })
+/// Explains why each book was skipped under `--verbose`, including those that other messages
+/// don't.
+struct VerboseLogger;
+
+impl Observer for VerboseLogger {
+    fn skipped(&self, src: &Path, reason: &str) -> Observing<'_> {
+        let (src, reason) = (src.to_path_buf(), reason.to_owned());
+        Box::pin(async move {
+            let msg = format!("Skipped {}: {reason}.", path_str(&src)?);
+            let attrs = log_attrs!(reason = reason);
+            write_book_message(&src, Verbosity::Verbose, Style::Dim, msg, attrs).await?;
+            Ok(())
+        })
+    }
 }
 
-#[tokio::main]
-async fn main() -> Result<(), Error> {
-    let Args {
-        dry_run,
-        kobo_directory,
-        documents_directories,
-    } = parse_args().await?;
+/// A book that was found but won't be copied, and why.
+#[derive(Clone, Debug, Serialize)]
+struct SkippedBook {
+    path: PathBuf,
+    reason: String,
+}
 
-    let extensions: HashSet<&OsStr> = EXTENSIONS_TO_SYNCHRONISE.iter().map(OsStr::new).collect();
+/// Record why a book was skipped for the JSON report and any observers, such as the one explaining
+/// skips under `--verbose`. Otherwise, skips without messages of their own are only counted in the
+/// statistics.
+async fn record_skip(
+    path: &Path,
+    reason: impl Into<String>,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    let reason = reason.into();
+    observe(|observer| observer.skipped(path, &reason)).await?;
+    let skipped = SkippedBook {
+        path: path.to_path_buf(),
+        reason,
+    };
+    stats.send(Statistic::Skipped(skipped)).await?;
+    Ok(())
+}
 
-    let (book_path_tx, book_path_rx) = channel::<PathBuf>(FOUND_BOOKS_CHANNEL_BOUND);
-    let (stats_tx, stats_rx) = channel::<Statistic>(STATISTICS_CHANNEL_BOUND);
+/// What went wrong for a book that couldn't be copied, to group failures by in the summary.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, Serialize)]
+#[serde(rename_all = "kebab-case")]
+enum FailureCategory {
+    PermissionDenied,
+    NoSpace,
+    ReadError,
+    WriteError,
+    InvalidListing,
+    FailedValidation,
+    Other,
+}
 
-    let documents_directories_ptr = Arc::new(documents_directories);
+impl FailureCategory {
+    fn of(err: &Error) -> Self {
+        if err.is::<InvalidBook>() {
+            return FailureCategory::FailedValidation;
+        }
+        let Some(err) = err.downcast_ref::<io::Error>() else {
+            return FailureCategory::Other;
+        };
+        match err.kind() {
+            io::ErrorKind::PermissionDenied => FailureCategory::PermissionDenied,
+            io::ErrorKind::StorageFull => FailureCategory::NoSpace,
+            _ if err
+                .get_ref()
+                .is_some_and(|inner| inner.is::<SourceReadError>()) =>
+            {
+                FailureCategory::ReadError
+            }
+            _ => FailureCategory::WriteError,
+        }
+    }
 
-    let stats_collection = {
-        let documents_directories_ptr = documents_directories_ptr.clone();
-        spawn(async move { collect_stats(&(*documents_directories_ptr)[..], stats_rx).await })
-    };
+    fn describe(self) -> &'static str {
+        match self {
+            FailureCategory::PermissionDenied => "could not be accessed (permission denied)",
+            FailureCategory::NoSpace => "did not fit (no space left)",
+            FailureCategory::ReadError => "could not be read",
+            FailureCategory::WriteError => "could not be written",
+            FailureCategory::InvalidListing => "were listed but are not books",
+            FailureCategory::FailedValidation => "failed validation (corrupt or not really EPUBs)",
+            FailureCategory::Other => "could not be copied for other reasons",
+        }
+    }
+}
 
-    let book_finding = {
-        let stats_tx = stats_tx.clone();
-        spawn(async move {
-            find_books(
-                &(*documents_directories_ptr)[..],
-                &extensions,
-                book_path_tx,
-                stats_tx,
-            )
-            .await
-        })
+/// A book that couldn't be copied, and why.
+#[derive(Clone, Debug, Serialize)]
+struct FailedBook {
+    path: PathBuf,
+    category: FailureCategory,
+    reason: String,
+}
+
+async fn record_failure(
+    path: &Path,
+    category: FailureCategory,
+    reason: String,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    let failed = FailedBook {
+        path: path.to_path_buf(),
+        category,
+        reason,
     };
+    stats.send(Statistic::Failed(failed)).await?;
+    Ok(())
+}
 
-    sync_books(&kobo_directory, dry_run, book_path_rx, stats_tx).await?;
-    book_finding.await??;
-    stats_collection.await??;
+/// Summarise the books that couldn't be copied by what went wrong, naming only the first few of
+/// each unless `--verbose`, as whatever goes wrong for one book tends to for many.
+async fn summarise_failures(failed: &[FailedBook]) -> Result<()> {
+    if failed.is_empty() {
+        return Ok(());
+    }
+
+    let mut by_category = BTreeMap::<_, Vec<_>>::new();
+    for book in failed {
+        by_category
+            .entry(book.category)
+            .or_default()
+            .push(&book.path);
+    }
 
+    println_error!("\nBooks that could not be copied, by what went wrong:").await?;
+    for (category, paths) in by_category {
+        let (count, description) = (paths.len(), category.describe());
+        let shown = if verbosity() == Verbosity::Verbose {
+            count
+        } else {
+            count.min(FAILURE_EXAMPLES)
+        };
+        let names = paths[..shown]
+            .iter()
+            .map(|path| path_str(path))
+            .collect::<Result<Vec<_>>>()?
+            .join(", ");
+        if shown < count {
+            let more = count - shown;
+            println_error!("{count} {description}, first few: {names}, and {more} more").await?;
+        } else {
+            println_error!("{count} {description}: {names}").await?;
+        }
+    }
     Ok(())
 }
+
+#[derive(Clone, Debug)]
+enum Statistic {
+    SkippedNestedDocumentsDirectory,
+    /// A book found in a documents directory or book list, with its extension in lowercase.
+    FoundSrcDocument {
+        source: PathBuf,
+        extension: String,
+    },
+    InvalidListedBook,
+    IgnoredMacOSMetadataFile,
+    PrunedDirectories(usize),
+    IgnoredBySyncIgnore(usize),
+    SkippedForPermissions,
+    FilteredOutByName,
+    FilteredOutByRegex,
+    SkippedForSize,
+    SkippedEmptyFile,
+    SkippedAsModifiedBeforeSince,
+    SkippedDuplicateSourceFile,
+    SkippedDuplicateContent,
+    SkippedDuplicateMetadata,
+    SkippedDuplicateIsbn,
+    RenamedForNameCollision,
+    SkippedForNameCollision,
+    RenamedForFat32,
+    Transliterated,
+    ShortenedForNameLength,
+    NotCopiedBecauseAlreadyExistedAtDest,
+    NotCopiedBecauseOtherBookAtDest,
+    UnchangedSinceLastSync,
+    NotPicked,
+    DeclinedInteractively,
+    MissingOnDevice,
+    OrphanedOnDevice,
+    SizeMismatchOnDevice,
+    ChangedOnDevice,
+    CutOffByMaxBooks(usize),
+    DeferredByMaxTotalSize(usize, u64),
+    NotCopiedBeforeTimeout,
+    FailedToCopy,
+    FailedValidation,
+    RetriedCopy,
+    Transferred(u64),
+    CopyingTook(Duration),
+    Copied,
+    Updated,
+    PulledFromDevice,
+    /// Things done by a feature besides copying books, such as books' annotations being exported.
+    AuxiliarySucceeded(AuxiliaryFeature, usize),
+    AuxiliaryFailed(AuxiliaryFeature),
+    TrashedOnDevice(u64),
+    RemovedFromDevice,
+    FailedToPrune,
+    EmptiedTrash(usize, u64),
+    /// Why a book was skipped, for the JSON report.
+    Skipped(SkippedBook),
+    Failed(FailedBook),
+    /// What a dry run would have done, for `--dry-run --json`, which is written once the skipped
+    /// and failed books are all known.
+    PlannedDryRun(Box<DryRunReport>),
+}
+
+async fn is_accessible_dir(path: &Path) -> bool {
+    fs::metadata(path)
+        .await
+        .map(|m| m.is_dir())
+        .unwrap_or(false)
+}
+
+/// macOS litters volumes lacking native support for its metadata, such as exFAT drives, with
+/// AppleDouble `._` files alongside the real ones; these carry the extension of the file they
+/// describe despite not being books. It also leaves `.DS_Store` files in every directory browsed.
+fn is_macos_metadata_file(path: &Path) -> bool {
+    path.file_name()
+        .and_then(OsStr::to_str)
+        .map(|name| name.starts_with("._") || name == ".DS_Store")
+        .unwrap_or(false)
+}
+
+fn lookup_default_kobo_storage_directory() -> PathBuf {
+    let mut buf = PathBuf::new();
+    buf.push("/media");
+    buf.push(username());
+    buf.push("KOBOeReader");
+    buf
+}
+
+// Where desktops automount removable volumes: udisks2 on older and newer Linux distributions, and
+// macOS.
+fn mount_roots() -> [PathBuf; 3] {
+    let user = username();
+    [
+        Path::new("/media").join(&user),
+        Path::new("/run/media").join(&user),
+        PathBuf::from("/Volumes"),
+    ]
+}
+
+/// Find the Kobos among the mounted volumes, which are those with the `.kobo` directory the Kobo
+/// keeps its state in.
+async fn find_mounted_kobos() -> Result<Vec<PathBuf>> {
+    let mut kobos = vec![];
+    for root in mount_roots() {
+        let Ok(mut volumes) = fs::read_dir(&root).await else {
+            continue;
+        };
+        while let Some(volume) = volumes.next_entry().await? {
+            let volume = volume.path();
+            if is_accessible_dir(&volume.join(KOBO_STATE_DIR)).await {
+                kobos.push(volume);
+            }
+        }
+    }
+    kobos.sort();
+    Ok(kobos)
+}
+
+/// Find the Kobo among the mounted volumes. Without any, the default Kobo storage directory is
+/// assumed; with several, the user must choose.
+async fn detect_kobo_storage_directory() -> Result<PathBuf> {
+    let mut kobos = find_mounted_kobos().await?;
+    match kobos.len() {
+        0 => Ok(lookup_default_kobo_storage_directory()),
+        1 => Ok(kobos.remove(0)),
+        _ => {
+            let kobos = kobos
+                .iter()
+                .map(|kobo| path_str(kobo))
+                .collect::<Result<Vec<_>>>()?
+                .join(", ");
+            Err(anyhow!(
+                "Several Kobos are mounted, at {kobos}; choose one with --kobo-directory"
+            ))
+        }
+    }
+}
+
+/// Where `--watch` waits for a Kobo to be plugged in.
+enum WatchedDevice {
+    /// Whichever Kobo is mounted, as long as there is only one.
+    Detected,
+    /// A given directory, which must have a `.kobo` directory too unless the device check is
+    /// disabled.
+    At { dir: PathBuf, check_device: bool },
+}
+
+impl WatchedDevice {
+    async fn find(&self) -> Result<Option<PathBuf>> {
+        match self {
+            WatchedDevice::Detected => {
+                let mut kobos = find_mounted_kobos().await?;
+                Ok((kobos.len() == 1).then(|| kobos.remove(0)))
+            }
+            WatchedDevice::At { dir, check_device } => {
+                let present = is_accessible_dir(dir).await
+                    && (!check_device || is_accessible_dir(&dir.join(KOBO_STATE_DIR)).await);
+                Ok(present.then(|| dir.clone()))
+            }
+        }
+    }
+
+    /// Wait until the Kobo has been present for a few polls in a row, so that a volume still being
+    /// mounted isn't synchronised to half-way through.
+    async fn wait_until_plugged_in(&self) -> Result<PathBuf> {
+        let (mut candidate, mut polls_present) = (None, 0);
+        loop {
+            let found = self.find().await?;
+            if found.is_some() && found == candidate {
+                polls_present += 1;
+            } else {
+                (candidate, polls_present) = (found, 0);
+            }
+            if let (Some(device), WATCH_SETTLE_POLLS..) = (&candidate, polls_present) {
+                return Ok(device.clone());
+            }
+            sleep(WATCH_POLL_INTERVAL).await;
+        }
+    }
+
+    async fn wait_until_unplugged(&self, device: &Path) -> Result<()> {
+        while self.find().await?.as_deref() == Some(device) {
+            sleep(WATCH_POLL_INTERVAL).await;
+        }
+        Ok(())
+    }
+}
+
+/// Synchronise to the Kobo each time it's plugged in, until interrupted. A failed synchronisation
+/// is reported without stopping the watch. Interrupting during a synchronisation stops once it
+/// finishes, rather than leaving books half-copied.
+async fn watch_device(
+    watched: &WatchedDevice,
+    sources: &BookSources,
+    options: &SyncOptions,
+) -> Result<()> {
+    let mut interrupted = pin!(stop_requested(options.deadline));
+    loop {
+        let dest = destination_name();
+        println_async!("Waiting for {dest} to be plugged in.").await?;
+        let device = select! {
+            device = watched.wait_until_plugged_in() => device?,
+            result = &mut interrupted => {
+                result?;
+                println_async!("Stopped watching.").await?;
+                return Ok(());
+            }
+        };
+
+        let device_str = path_str(&device)?;
+        println_async!("Found {dest} at {device_str}; synchronising.").await?;
+        let outcome = match run(&device, Mode::Sync, sources, options, None).await {
+            Ok(_) => "finished".to_owned(),
+            Err(err) => format!("failed: {err}"),
+        };
+        let now = Local::now().format("%Y-%m-%d %H:%M:%S");
+        println_async!(
+            "Synchronising to {device_str} {outcome} at {now}; unplug it to synchronise again."
+        )
+        .await?;
+
+        select! {
+            result = watched.wait_until_unplugged(&device) => result?,
+            result = &mut interrupted => {
+                result?;
+                println_async!("Stopped watching.").await?;
+                return Ok(());
+            }
+        }
+    }
+}
+
+/// Copy books to the destination as they change in the documents directories, until interrupted.
+/// Changes are gathered until they settle, as books are often written in several steps. Everything
+/// is searched when starting and every `reconcile_interval` afterwards, to catch what was missed,
+/// such as changes made while not watching.
+async fn watch_sources_for_changes(
+    dest_dir: &Path,
+    sources: &BookSources,
+    options: &SyncOptions,
+    reconcile_interval: Duration,
+) -> Result<()> {
+    let (changes_tx, mut changes) = unbounded_channel();
+    let mut watcher = notify::recommended_watcher(move |event| {
+        // Changes only stop being received once watching has stopped.
+        let _ = changes_tx.send(event);
+    })?;
+
+    // Changes are reported under the real paths of the directories, which are mapped back to
+    // the documents directories as given.
+    let mut watched_dirs = vec![];
+    for dir in &sources.documents_directories {
+        let real_dir = fs::canonicalize(dir).await?;
+        watcher.watch(&real_dir, RecursiveMode::Recursive)?;
+        watched_dirs.push((real_dir, dir.clone()));
+    }
+
+    let mut interrupted = pin!(stop_requested(options.deadline));
+    let mut reconciliation = interval(reconcile_interval);
+    let mut changed = BTreeSet::new();
+    let mut settled_at = None;
+    let (mut batches, mut passes) = (0, 0);
+
+    loop {
+        select! {
+            _ = reconciliation.tick() => {
+                // A full search covers anything that changed in the meantime.
+                (changed, settled_at) = (BTreeSet::new(), None);
+                let result = run(dest_dir, Mode::Sync, sources, options, None).await;
+                if let Err(err) = result {
+                    println_error!("Warning: could not synchronise the books: {err}.").await?;
+                }
+                passes += 1;
+            }
+            Some(event) = changes.recv() => match event {
+                Ok(Event {
+                    kind: EventKind::Create(_) | EventKind::Modify(_),
+                    paths,
+                    ..
+                }) => {
+                    changed.extend(paths.iter().filter_map(|path| {
+                        watched_dirs.iter().find_map(|(real_dir, dir)| {
+                            Some(dir.join(path.strip_prefix(real_dir).ok()?))
+                        })
+                    }));
+                    settled_at = Some(Instant::now() + WATCH_SOURCES_SETTLE_TIME);
+                }
+                Ok(_) => {}
+                Err(err) => {
+                    println_error!("Warning: could not watch the documents directories: {err}.")
+                        .await?;
+                }
+            },
+            _ = sleep_until(settled_at.unwrap_or_else(Instant::now)), if settled_at.is_some() => {
+                settled_at = None;
+                let changed_books = Some(std::mem::take(&mut changed).into_iter().collect());
+                let result = run(dest_dir, Mode::Sync, sources, options, changed_books).await;
+                if let Err(err) = result {
+                    println_error!("Warning: could not synchronise the changed books: {err}.")
+                        .await?;
+                }
+                batches += 1;
+            }
+            result = &mut interrupted => {
+                result?;
+                break;
+            }
+        }
+    }
+
+    println_async!(
+        "Stopped watching the documents directories after synchronising {batches} batches of \
+            changes and {passes} full searches."
+    )
+    .await?;
+    Ok(())
+}
+
+/// Find the storage of the only reader connected over MTP, as mounted by GVfs. Readers without
+/// USB mass storage, such as Android-based ones, are only reachable this way.
+async fn detect_mtp_storage_directory() -> Result<PathBuf> {
+    let runtime_dir = std::env::var_os("XDG_RUNTIME_DIR")
+        .ok_or_else(|| anyhow!("XDG_RUNTIME_DIR is not set, so GVfs mounts can't be found"))?;
+    let gvfs_dir = Path::new(&runtime_dir).join("gvfs");
+
+    // GVfs mounts each device as `mtp:host=...`, with a directory inside for each of its storages.
+    let mut storages = vec![];
+    if let Ok(mut mounts) = fs::read_dir(&gvfs_dir).await {
+        while let Some(mount) = mounts.next_entry().await? {
+            if !mount.file_name().to_string_lossy().starts_with("mtp:") {
+                continue;
+            }
+            let mut mount_storages = fs::read_dir(mount.path()).await?;
+            while let Some(storage) = mount_storages.next_entry().await? {
+                storages.push(storage.path());
+            }
+        }
+    }
+    storages.sort();
+
+    match storages.len() {
+        0 => {
+            let gvfs_str = path_str(&gvfs_dir)?;
+            Err(anyhow!(
+                "No reader connected over MTP was found in {gvfs_str}; is it unlocked and set to \
+                    transfer files?"
+            ))
+        }
+        1 => Ok(storages.remove(0)),
+        _ => {
+            let storages = storages
+                .iter()
+                .map(|storage| path_str(storage))
+                .collect::<Result<Vec<_>>>()?
+                .join(", ");
+            Err(anyhow!(
+                "Several MTP storages are mounted, at {storages}; choose one with \
+                    --target-directory and --progress instead"
+            ))
+        }
+    }
+}
+
+fn lookup_home_directory() -> Result<PathBuf> {
+    let dirs =
+        UserDirs::new().ok_or_else(|| anyhow!("failed to read the current home directory"))?;
+
+    let home = dirs.home_dir();
+    Ok(home.to_path_buf())
+}
+
+fn lookup_default_documents_directories() -> Result<Vec<PathBuf>> {
+    let home = lookup_home_directory()?;
+
+    let mut documents = PathBuf::new();
+    documents.push(home);
+    documents.push("Documents");
+
+    Ok(vec![documents])
+}
+
+/// A book found within a documents directory.
+#[derive(Clone, Debug)]
+struct FoundBook {
+    path: PathBuf,
+
+    /// The book's path relative to the documents directory in which it was found.
+    relative_path: PathBuf,
+}
+
+/// Rules deciding which parts of the documents directories are searched for books.
+struct SearchFilters {
+    excluded_dirs: GlobSet,
+    included_names: GlobSet,
+    excluded_names: GlobSet,
+    matching_regex: Option<Regex>,
+    excluding_regex: Option<Regex>,
+    max_depth: Option<usize>,
+    follow_symlinks: bool,
+    max_file_size: Option<u64>,
+    include_empty: bool,
+    modified_since: Option<SystemTime>,
+    strict_permissions: bool,
+    strict_discovery: bool,
+}
+
+impl SearchFilters {
+    /// If any inclusion patterns are given, a book's file name must match at least one of them.
+    /// Regardless, it must not match any of the exclusion patterns.
+    fn is_filtered_out_by_name(&self, path: &Path) -> bool {
+        let Some(name) = path.file_name() else {
+            return false;
+        };
+
+        let included = self.included_names.is_empty() || self.included_names.is_match(name);
+        !included || self.excluded_names.is_match(name)
+    }
+
+    /// Regular expressions are matched against a book's path relative to the documents directory
+    /// in which it was found.
+    fn is_filtered_out_by_regex(&self, relative: &Path) -> bool {
+        let relative = relative.to_string_lossy();
+
+        let matches = self
+            .matching_regex
+            .as_ref()
+            .map(|regex| regex.is_match(&relative))
+            .unwrap_or(true);
+        let excluded = self
+            .excluding_regex
+            .as_ref()
+            .map(|regex| regex.is_match(&relative))
+            .unwrap_or(false);
+
+        !matches || excluded
+    }
+
+    /// Empty books are usually left by interrupted downloads or files evicted to the cloud, and
+    /// can't be opened on the Kobo.
+    fn is_empty_and_excluded(&self, size: u64) -> bool {
+        size == 0 && !self.include_empty
+    }
+
+    fn is_too_old(&self, modified: SystemTime) -> bool {
+        self.modified_since
+            .map(|modified_since| modified < modified_since)
+            .unwrap_or(false)
+    }
+
+    fn is_too_large(&self, size: u64) -> bool {
+        self.max_file_size
+            .map(|max_file_size| max_file_size < size)
+            .unwrap_or(false)
+    }
+
+    /// Whether failing to search part of the documents directories stops the run. Otherwise, it's
+    /// skipped over, such as for old backups owned by another user.
+    fn is_fatal_search_error(&self, err: &io::Error) -> bool {
+        self.strict_discovery
+            || (self.strict_permissions && err.kind() == io::ErrorKind::PermissionDenied)
+    }
+
+    /// Files directly inside a documents directory are at a depth of 1, so directories at the
+    /// maximum depth have nothing within reach to offer.
+    fn is_too_deep(&self, relative_dir: &Path) -> bool {
+        self.max_depth
+            .map(|max_depth| max_depth <= relative_dir.components().count())
+            .unwrap_or(false)
+    }
+}
+
+fn build_glob_set(patterns: &[String], case_insensitive: bool) -> Result<GlobSet> {
+    let mut builder = GlobSetBuilder::new();
+    for pattern in patterns {
+        let glob = GlobBuilder::new(pattern)
+            .literal_separator(true)
+            .case_insensitive(case_insensitive)
+            .build()
+            .map_err(|err| anyhow!("invalid pattern {pattern}: {err}"))?;
+        builder.add(glob);
+    }
+    Ok(builder.build()?)
+}
+
+/// Excluded directories are matched both on their names and on their paths relative to the
+/// documents directory being searched, so that both `node_modules` and `Archive/2019` work.
+fn is_excluded_dir(excluded_dirs: &GlobSet, root: &Path, dir: &Path) -> bool {
+    let name_matches = dir
+        .file_name()
+        .map(|name| excluded_dirs.is_match(name))
+        .unwrap_or(false);
+
+    name_matches
+        || dir
+            .strip_prefix(root)
+            .map(|relative| excluded_dirs.is_match(relative))
+            .unwrap_or(false)
+}
+
+/// Tallies of entries filtered out while walking a documents directory. The walk's filter runs
+/// outside of `find_books`, so these are counted atomically and sent as statistics once the walk
+/// finishes.
+#[derive(Default)]
+struct WalkCounters {
+    pruned_dirs: AtomicUsize,
+    sync_ignored: AtomicUsize,
+}
+
+/// Walk a directory within the documents directory `root`. These differ only when following a
+/// symlink to a directory, in which case filtering still happens relative to `root`.
+fn walk_documents_directory(
+    root: &Path,
+    walk_root: &Path,
+    filters: &Arc<SearchFilters>,
+    sync_ignore: &Arc<SyncIgnore>,
+    counters: &Arc<WalkCounters>,
+    stats: &Sender<Statistic>,
+) -> WalkDir {
+    let (root, filters, sync_ignore, counters, stats) = (
+        root.to_path_buf(),
+        filters.clone(),
+        sync_ignore.clone(),
+        counters.clone(),
+        stats.clone(),
+    );
+
+    WalkDir::new(walk_root).filter(move |entry| {
+        let (root, filters, sync_ignore, counters, stats) = (
+            root.clone(),
+            filters.clone(),
+            sync_ignore.clone(),
+            counters.clone(),
+            stats.clone(),
+        );
+        async move {
+            let path = entry.path();
+
+            // The type comes with the directory listing on most platforms, whereas following a
+            // symlink needs a stat; over network shares, doing so for every entry adds up.
+            let file_type = entry.file_type().await.ok();
+            let is_dir = match file_type {
+                Some(file_type) if filters.follow_symlinks && file_type.is_symlink() => {
+                    fs::metadata(&path)
+                        .await
+                        .map(|m| m.is_dir())
+                        .unwrap_or(false)
+                }
+                Some(file_type) => file_type.is_dir(),
+                None => false,
+            };
+
+            let too_deep = path
+                .strip_prefix(&root)
+                .map(|relative| filters.is_too_deep(relative))
+                .unwrap_or(false);
+            if is_dir && too_deep {
+                return Filtering::IgnoreDir;
+            }
+
+            // Failing to explain a skip isn't worth abandoning the walk over.
+            if is_dir && is_excluded_dir(&filters.excluded_dirs, &root, &path) {
+                counters.pruned_dirs.fetch_add(1, Ordering::Relaxed);
+                let _ = record_skip(&path, "directory excluded by pattern", &stats).await;
+                return Filtering::IgnoreDir;
+            }
+
+            let sync_ignored = path
+                .strip_prefix(&root)
+                .map(|relative| sync_ignore.is_ignored(relative, is_dir))
+                .unwrap_or(false);
+            if sync_ignored {
+                counters.sync_ignored.fetch_add(1, Ordering::Relaxed);
+                let _ = record_skip(&path, "ignored by .syncignore", &stats).await;
+                if is_dir {
+                    Filtering::IgnoreDir
+                } else {
+                    Filtering::Ignore
+                }
+            } else {
+                Filtering::Continue
+            }
+        }
+    })
+}
+
+fn is_book(path: &Path, extensions_to_match: &HashSet<&OsStr>) -> bool {
+    path.extension()
+        .map(|ext| extensions_to_match.contains(&ext))
+        .unwrap_or(false)
+}
+
+fn lowercase_extension(path: &Path) -> String {
+    path.extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_default()
+}
+
+/// Identifies the physical file behind a path, so that the same file reached via hardlinks, bind
+/// mounts, or overlapping documents directories isn't synchronised more than once.
+#[cfg(unix)]
+#[derive(PartialEq, Eq, Hash)]
+struct FileIdentity {
+    dev: u64,
+    ino: u64,
+}
+
+/// Metadata already read for the file is used rather than reading it again, which adds up over
+/// network shares.
+#[cfg(unix)]
+async fn lookup_file_identity(
+    path: &Path,
+    metadata: Option<&std::fs::Metadata>,
+) -> Result<FileIdentity> {
+    use std::os::unix::fs::MetadataExt;
+
+    let metadata = match metadata {
+        Some(metadata) => metadata.clone(),
+        None => fs::metadata(path).await?,
+    };
+    Ok(FileIdentity {
+        dev: metadata.dev(),
+        ino: metadata.ino(),
+    })
+}
+
+/// Without inodes to go on, fall back to comparing absolute paths with symlinks resolved.
+#[cfg(not(unix))]
+#[derive(PartialEq, Eq, Hash)]
+struct FileIdentity(PathBuf);
+
+#[cfg(not(unix))]
+async fn lookup_file_identity(
+    path: &Path,
+    _metadata: Option<&std::fs::Metadata>,
+) -> Result<FileIdentity> {
+    Ok(FileIdentity(fs::canonicalize(path).await?))
+}
+
+/// Files whose identities can't be looked up, such as broken symlinks, are left for the copying
+/// stage to report on.
+async fn is_duplicate_file(
+    path: &Path,
+    metadata: Option<&std::fs::Metadata>,
+    found_files: &mut HashSet<FileIdentity>,
+) -> bool {
+    lookup_file_identity(path, metadata)
+        .await
+        .map(|identity| !found_files.insert(identity))
+        .unwrap_or(false)
+}
+
+/// Follow a symlink found while searching, queueing its target to be walked too if it's a directory
+/// that isn't already being searched. Yields whether the symlink was dealt with, as opposed to it
+/// leading to a file that should be considered like any other.
+async fn follow_symlink(
+    path: &Path,
+    searched_real_dirs: &mut Vec<PathBuf>,
+    walk_roots: &mut Vec<PathBuf>,
+) -> Result<bool> {
+    match fs::metadata(path).await {
+        Err(_) => {
+            let path_str = path_str(path)?;
+            println_about_book!(path, "Symlink {path_str} is broken; will not follow it.").await?;
+            Ok(true)
+        }
+        Ok(metadata) if metadata.is_dir() => {
+            let real_dir = fs::canonicalize(path).await?;
+            if !searched_real_dirs
+                .iter()
+                .any(|dir| real_dir.starts_with(dir))
+            {
+                searched_real_dirs.push(real_dir);
+                walk_roots.push(path.to_path_buf());
+            }
+            Ok(true)
+        }
+        Ok(_) => Ok(false),
+    }
+}
+
+/// Search the documents directories for books, yielding whether every book in them was found. They
+/// weren't if parts of them couldn't be searched, or if books were left out by filters or
+/// `.syncignore`, any of which would make those books look removed when pruning. A documents
+/// directory that can't be searched at all is warned about, whereas parts of them that can't be
+/// searched are only counted if for lack of permission, being common in old backups.
+async fn find_books(
+    dirs: &[PathBuf],
+    extensions_to_match: &HashSet<&OsStr>,
+    filters: Arc<SearchFilters>,
+    books: Sender<FoundBook>,
+    stats: Sender<Statistic>,
+) -> Result<bool> {
+    let mut found_files = HashSet::new();
+    let mut complete = true;
+
+    for dir in dirs {
+        let dir_str = path_str(dir)?;
+        if let Err(err) = fs::read_dir(dir).await {
+            if filters.is_fatal_search_error(&err) {
+                return Err(anyhow!("could not search {dir_str}: {err}"));
+            }
+            println_error!(
+                "Warning: could not search the documents directory at {dir_str}: {err}; will not \
+                    synchronise its books."
+            )
+            .await?;
+            complete = false;
+            continue;
+        }
+
+        let sync_ignore = Arc::new(SyncIgnore::load(dir).await?);
+        let counters = Arc::new(WalkCounters::default());
+
+        // Real paths of directories already searched, to avoid following symlink cycles.
+        let real_dir = fs::canonicalize(dir)
+            .await
+            .map_err(|err| anyhow!("could not search {dir_str}: {err}"))?;
+        let mut searched_real_dirs = vec![real_dir];
+        let mut walk_roots = vec![dir.clone()];
+
+        while let Some(walk_root) = walk_roots.pop() {
+            let mut entries = walk_documents_directory(
+                dir,
+                &walk_root,
+                &filters,
+                &sync_ignore,
+                &counters,
+                &stats,
+            );
+            loop {
+                match entries.next().await {
+                    Some(Ok(entry)) => {
+                        let path = entry.path();
+
+                        let is_symlink = entry
+                            .file_type()
+                            .await
+                            .map_err(|err| {
+                                let path_str = path.to_string_lossy();
+                                anyhow!("could not search {path_str} in {dir_str}: {err}")
+                            })?
+                            .is_symlink();
+                        if filters.follow_symlinks
+                            && is_symlink
+                            && follow_symlink(&path, &mut searched_real_dirs, &mut walk_roots)
+                                .await?
+                        {
+                            continue;
+                        }
+
+                        if is_macos_metadata_file(&path) {
+                            record_skip(&path, "macOS metadata file", &stats).await?;
+                            stats.send(Statistic::IgnoredMacOSMetadataFile).await?;
+                        } else if is_book(&path, extensions_to_match) {
+                            let filtered_out = consider_book(
+                                path,
+                                dir,
+                                &filters,
+                                &mut found_files,
+                                &books,
+                                &stats,
+                            )
+                            .await?;
+                            complete &= !filtered_out;
+                        }
+                    }
+                    Some(Err(err)) if filters.is_fatal_search_error(&err) => {
+                        Err(anyhow!("could not search {dir_str}: {err}"))?
+                    }
+                    Some(Err(err)) => {
+                        complete = false;
+                        if err.kind() == io::ErrorKind::PermissionDenied {
+                            stats.send(Statistic::SkippedForPermissions).await?;
+                        } else {
+                            println_error!(
+                                "Warning: part of {dir_str} could not be searched: {err}; will \
+                                    not synchronise the books there."
+                            )
+                            .await?;
+                        }
+                    }
+                    None => break,
+                }
+            }
+        }
+
+        let pruned_dirs = counters.pruned_dirs.load(Ordering::Relaxed);
+        stats
+            .send(Statistic::PrunedDirectories(pruned_dirs))
+            .await?;
+
+        let sync_ignored = counters.sync_ignored.load(Ordering::Relaxed);
+        stats
+            .send(Statistic::IgnoredBySyncIgnore(sync_ignored))
+            .await?;
+        complete &= sync_ignored == 0;
+    }
+    Ok(complete)
+}
+
+/// Apply the filters that single books are subject to, wherever they were found within the
+/// documents directory `dir`, sending on those that pass. Yields whether the book was filtered
+/// out, as opposed to being found or being the same file as one already found.
+async fn consider_book(
+    path: PathBuf,
+    dir: &Path,
+    filters: &SearchFilters,
+    found_files: &mut HashSet<FileIdentity>,
+    books: &Sender<FoundBook>,
+    stats: &Sender<Statistic>,
+) -> Result<bool> {
+    let relative = path.strip_prefix(dir)?;
+
+    // Books whose metadata can't be read are left for the copying stage to report on.
+    let metadata = fs::metadata(&path).await.ok();
+    let size = metadata.as_ref().map(|m| m.len());
+    let modified = metadata.as_ref().and_then(|m| m.modified().ok());
+
+    let filtered_out = if filters.is_filtered_out_by_name(&path) {
+        record_skip(
+            &path,
+            "filtered out by --include and --exclude patterns",
+            stats,
+        )
+        .await?;
+        stats.send(Statistic::FilteredOutByName).await?;
+        true
+    } else if filters.is_filtered_out_by_regex(relative) {
+        record_skip(
+            &path,
+            "filtered out by --match-regex and --exclude-regex",
+            stats,
+        )
+        .await?;
+        stats.send(Statistic::FilteredOutByRegex).await?;
+        true
+    } else if let Some(size) = size.filter(|&size| filters.is_too_large(size)) {
+        let (book_str, size) = (path_str(&path)?, format_size(size));
+        println_about_book!(
+            &path,
+            "Book {book_str} is {size}, which is larger than the maximum file size; will not copy \
+                across."
+        )
+        .await?;
+        record_skip(&path, format!("{size}, larger than --max-file-size"), stats).await?;
+        stats.send(Statistic::SkippedForSize).await?;
+        true
+    } else if size.is_some_and(|size| filters.is_empty_and_excluded(size)) {
+        let book_str = path_str(&path)?;
+        println_about_book!(&path, "Book {book_str} is empty; will not copy across.").await?;
+        record_skip(&path, "zero bytes", stats).await?;
+        stats.send(Statistic::SkippedEmptyFile).await?;
+        true
+    } else if modified.is_some_and(|modified| filters.is_too_old(modified)) {
+        record_skip(&path, "modified before --since", stats).await?;
+        stats.send(Statistic::SkippedAsModifiedBeforeSince).await?;
+        true
+    } else if is_duplicate_file(&path, metadata.as_ref(), found_files).await {
+        record_skip(&path, "same file already found elsewhere", stats).await?;
+        stats.send(Statistic::SkippedDuplicateSourceFile).await?;
+        false
+    } else {
+        stats
+            .send(Statistic::FoundSrcDocument {
+                source: dir.to_path_buf(),
+                extension: lowercase_extension(&path),
+            })
+            .await?;
+        observe(|observer| observer.book_discovered(&path, size)).await?;
+
+        let relative_path = relative.to_path_buf();
+        books
+            .send(FoundBook {
+                path,
+                relative_path,
+            })
+            .await?;
+        false
+    };
+    Ok(filtered_out)
+}
+
+/// Consider only books that changed within the documents directories, rather than searching them.
+/// The same filters apply as when searching, including those on the directories that a search
+/// would skip over.
+async fn find_changed_books(
+    dirs: &[PathBuf],
+    changed: &[PathBuf],
+    extensions_to_match: &HashSet<&OsStr>,
+    filters: Arc<SearchFilters>,
+    books: Sender<FoundBook>,
+    stats: Sender<Statistic>,
+) -> Result<bool> {
+    let mut found_files = HashSet::new();
+    let mut sync_ignores = HashMap::new();
+
+    for path in changed {
+        let Some(dir) = dirs.iter().find(|dir| path.starts_with(dir)) else {
+            continue;
+        };
+        // Books removed again since changing have nothing left to copy.
+        let is_file = fs::metadata(path).await.is_ok_and(|m| m.is_file());
+        if !is_file || !is_book(path, extensions_to_match) || is_macos_metadata_file(path) {
+            continue;
+        }
+
+        if !sync_ignores.contains_key(dir) {
+            sync_ignores.insert(dir.clone(), SyncIgnore::load(dir).await?);
+        }
+        let sync_ignore = &sync_ignores[dir];
+        let relative = path.strip_prefix(dir)?;
+        let in_skipped_dir = relative.ancestors().skip(1).any(|relative_dir| {
+            !relative_dir.as_os_str().is_empty()
+                && (filters.is_too_deep(relative_dir)
+                    || is_excluded_dir(&filters.excluded_dirs, dir, &dir.join(relative_dir))
+                    || sync_ignore.is_ignored(relative_dir, true))
+        });
+        if in_skipped_dir || sync_ignore.is_ignored(relative, false) {
+            continue;
+        }
+
+        consider_book(
+            path.clone(),
+            dir,
+            &filters,
+            &mut found_files,
+            &books,
+            &stats,
+        )
+        .await?;
+    }
+    // Only the changed books are considered, under `--watch-sources`, which never prunes.
+    Ok(true)
+}
+
+/// Read the books to synchronise from a list of paths, one per line, rather than searching the
+/// documents directories. Paths that aren't readable books are reported along with their line
+/// numbers, without stopping the rest from being synchronised. Yields whether every listed book
+/// could be read.
+async fn read_book_list(
+    book_list: &Path,
+    extensions_to_match: &HashSet<&OsStr>,
+    books: Sender<FoundBook>,
+    stats: Sender<Statistic>,
+) -> Result<bool> {
+    let (reader, list_str): (Box<dyn AsyncRead + Send + Unpin>, _) =
+        if book_list == Path::new(BOOK_LIST_FROM_STDIN) {
+            (Box::new(io::stdin()), "standard input")
+        } else {
+            let list_str = path_str(book_list)?;
+            let file = File::open(book_list)
+                .await
+                .map_err(|err| anyhow!("could not open the book list at {list_str}: {err}"))?;
+            (Box::new(file), list_str)
+        };
+
+    let mut found_files = HashSet::new();
+    let mut lines = BufReader::new(reader).lines();
+    let mut number = 0;
+    let mut complete = true;
+
+    while let Some(line) = lines
+        .next_line()
+        .await
+        .map_err(|err| anyhow!("could not read the book list at {list_str}: {err}"))?
+    {
+        number += 1;
+        let line = line.trim();
+        if line.is_empty() {
+            continue;
+        }
+
+        // Relative paths are resolved against the current directory.
+        let path = PathBuf::from(line);
+        let problem = match fs::metadata(&path).await {
+            Ok(metadata) if !metadata.is_file() => {
+                Some((FailureCategory::InvalidListing, "is not a file".to_owned()))
+            }
+            Ok(_) if !is_book(&path, extensions_to_match) => Some((
+                FailureCategory::InvalidListing,
+                "is not an EPUB or PDF".to_owned(),
+            )),
+            Ok(_) => None,
+            Err(err) => {
+                complete = false;
+                let category = if err.kind() == io::ErrorKind::PermissionDenied {
+                    FailureCategory::PermissionDenied
+                } else {
+                    FailureCategory::ReadError
+                };
+                Some((category, format!("could not be read: {err}")))
+            }
+        };
+        if let Some((category, problem)) = problem {
+            record_failure(&path, category, problem.clone(), &stats).await?;
+            println_about_book!(
+                &path,
+                "Line {number} of {list_str}: {line} {problem}; will not copy across."
+            )
+            .await?;
+            record_skip(
+                &path,
+                format!("line {number} of {list_str} {problem}"),
+                &stats,
+            )
+            .await?;
+            stats.send(Statistic::InvalidListedBook).await?;
+            continue;
+        }
+
+        if is_duplicate_file(&path, None, &mut found_files).await {
+            record_skip(&path, "same file already listed", &stats).await?;
+            stats.send(Statistic::SkippedDuplicateSourceFile).await?;
+            continue;
+        }
+
+        stats
+            .send(Statistic::FoundSrcDocument {
+                source: book_list.to_path_buf(),
+                extension: lowercase_extension(&path),
+            })
+            .await?;
+        let size = fs::metadata(&path)
+            .await
+            .ok()
+            .map(|metadata| metadata.len());
+        observe(|observer| observer.book_discovered(&path, size)).await?;
+        let Some(file_name) = path.file_name() else {
+            continue;
+        };
+        let relative_path = PathBuf::from(file_name);
+        books
+            .send(FoundBook {
+                path,
+                relative_path,
+            })
+            .await?;
+    }
+
+    Ok(complete)
+}
+
+fn path_str(path: &Path) -> Result<&str> {
+    path.to_str()
+        .ok_or_else(|| anyhow!("could not decode a path to UTF-8"))
+}
+
+/// A book that a dry run would have copied.
+#[derive(Clone, Debug, Serialize)]
+struct DryRunCopy {
+    src: PathBuf,
+    dest: PathBuf,
+    size: u64,
+    title: Option<String>,
+    authors: Vec<String>,
+}
+
+/// Everything a dry run would have copied, updated, pruned, and skipped, for `--dry-run --json`.
+#[derive(Clone, Debug, Serialize)]
+struct DryRunReport {
+    version: &'static str,
+    books: Vec<DryRunCopy>,
+    updated: Vec<DryRunCopy>,
+    pruned: Vec<PathBuf>,
+    skipped: Vec<SkippedBook>,
+    failed: Vec<FailedBook>,
+    total_books: usize,
+    total_size: u64,
+    /// Whether the books were picked by hand with `--pick` rather than all being synchronised.
+    picked: bool,
+}
+
+async fn report_dry_run_copy(
+    src_path: &Path,
+    dest_path: &Path,
+    updating: bool,
+) -> Result<DryRunCopy> {
+    let (src, dest) = (path_str(src_path)?, path_str(dest_path)?);
+
+    // Books are often named after ISBNs or export IDs, so say what they actually are. Books whose
+    // metadata can't be read just go without.
+    let metadata = read_book_metadata(src_path).await.unwrap_or_default();
+    let description = metadata
+        .describe()
+        .map(|description| format!(" ({description})"))
+        .unwrap_or_default();
+
+    if updating {
+        println_copied_book!(
+            src_path,
+            "Dry-running; would otherwise update {dest} from {src}{description}";
+            dest = dest,
+        )
+        .await?;
+    } else {
+        println_copied_book!(
+            src_path,
+            "Dry-running; would otherwise copy {src} to {dest}{description}";
+            dest = dest,
+        )
+        .await?;
+    }
+
+    // Books that can't be read are left for a real synchronisation to report on.
+    let size = fs::metadata(src_path).await.map(|m| m.len()).unwrap_or(0);
+    Ok(DryRunCopy {
+        src: src_path.to_path_buf(),
+        dest: dest_path.to_path_buf(),
+        size,
+        title: metadata.title,
+        authors: metadata.authors,
+    })
+}
+
+/// Whether the copy of a book on the Kobo is out of date, either differing in size or being older
+/// than the book. Books that can't be read are left alone. Copies given the modification times of
+/// their books can have them rounded down by the Kobo's filesystem, which doesn't count as older.
+async fn is_outdated(src_path: &Path, dest_path: &Path) -> bool {
+    let (Ok(src), Ok(dest)) = (fs::metadata(src_path).await, fs::metadata(dest_path).await) else {
+        return false;
+    };
+    let src_is_newer = match (src.modified(), dest.modified()) {
+        (Ok(src_modified), Ok(dest_modified)) => {
+            dest_modified + MODIFIED_TIME_RESOLUTION <= src_modified
+        }
+        _ => false,
+    };
+    src.len() != dest.len() || src_is_newer
+}
+
+/// Report a book that could not be copied, leaving any existing copy of it in place.
+async fn report_failed_copy(
+    src: &Path,
+    dest_path: &Path,
+    updating: bool,
+    err: &Error,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    let (src_str, dest_str) = (path_str(src)?, path_str(dest_path)?);
+    if updating {
+        println_error_about_book!(
+            src,
+            "Book {src_str} could not be updated at {dest_str}: {err}; will leave the existing \
+                copy.";
+            dest = dest_str,
+            reason = err.to_string(),
+        )
+        .await?;
+    } else {
+        println_error_about_book!(
+            src,
+            "Book {src_str} could not be copied to {dest_str}: {err}; will not copy across.";
+            dest = dest_str,
+            reason = err.to_string(),
+        )
+        .await?;
+    }
+    let category = FailureCategory::of(err);
+    record_failure(src, category, err.to_string(), stats).await?;
+    let stat = if category == FailureCategory::FailedValidation {
+        Statistic::FailedValidation
+    } else {
+        Statistic::FailedToCopy
+    };
+    stats.send(stat).await?;
+    Ok(())
+}
+
+/// Count a book as skipped for the `--timeout` having passed before it could be copied.
+async fn report_timed_out(src: &Path, stats: &Sender<Statistic>) -> Result<()> {
+    record_skip(src, &CopyingStopped::TimedOut.to_string(), stats).await?;
+    stats.send(Statistic::NotCopiedBeforeTimeout).await?;
+    Ok(())
+}
+
+fn is_already_existing(err: &Error) -> bool {
+    err.downcast_ref::<io::Error>()
+        .is_some_and(|err| err.kind() == io::ErrorKind::AlreadyExists)
+}
+
+fn has_passed(deadline: Option<Instant>) -> bool {
+    deadline.is_some_and(|deadline| deadline <= Instant::now())
+}
+
+/// Wait for Ctrl-C, or for the `--timeout` to pass, either of which stop watching.
+async fn stop_requested(deadline: Option<Instant>) -> io::Result<()> {
+    match deadline {
+        Some(deadline) => select! {
+            result = ctrl_c() => result,
+            () = sleep_until(deadline) => Ok(()),
+        },
+        None => ctrl_c().await,
+    }
+}
+
+/// Tells when copies fail because the destination was unplugged rather than for reasons of their
+/// own, so that the rest aren't attempted too.
+#[derive(Default)]
+struct DisconnectionDetector {
+    consecutive_device_errors: usize,
+    disconnected: bool,
+}
+
+impl DisconnectionDetector {
+    fn succeeded(&mut self) {
+        self.consecutive_device_errors = 0;
+    }
+
+    /// Note a failed copy, yielding whether the destination appears to have been disconnected,
+    /// either by having gone or by several copies in a row failing as I/O to a missing device
+    /// does.
+    async fn failed(&mut self, dest_dir: &Path, err: &Error) -> bool {
+        let is_device_error = err
+            .downcast_ref::<io::Error>()
+            .and_then(io::Error::raw_os_error)
+            .is_some_and(|code| DEVICE_ERROR_CODES.contains(&code));
+        self.consecutive_device_errors = if is_device_error {
+            self.consecutive_device_errors + 1
+        } else {
+            0
+        };
+        self.disconnected |= self.consecutive_device_errors >= DISCONNECTION_FAILURES
+            || !is_accessible_dir(dest_dir).await;
+        self.disconnected
+    }
+}
+
+type Sha256Digest = [u8; 32];
+
+async fn hash_file(path: &Path) -> Result<Sha256Digest> {
+    let mut file = File::open(path).await?;
+    let mut hasher = Sha256::new();
+    let mut buf = vec![0; HASHING_BUFFER_SIZE];
+
+    loop {
+        let read = file.read(&mut buf).await?;
+        if read == 0 {
+            break;
+        }
+        hasher.update(&buf[..read]);
+    }
+
+    Ok(hasher.finalize().into())
+}
+
+fn to_hex(digest: &Sha256Digest) -> String {
+    digest.iter().fold(String::new(), |mut hex, byte| {
+        let _ = write!(hex, "{byte:02x}");
+        hex
+    })
+}
+
+/// Keep only the first of each set of books with identical contents, regardless of their names.
+/// Books are hashed a few at a time, overlapping the I/O without flooding the disk with reads.
+async fn dedupe_by_content(
+    books: Vec<FoundBook>,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<FoundBook>> {
+    let permits = Arc::new(Semaphore::new(HASHING_CONCURRENCY));
+    let hashing_tasks: Vec<_> = books
+        .iter()
+        .map(|book| book.path.clone())
+        .map(|book| {
+            let permits = permits.clone();
+            spawn(async move {
+                let _permit = permits.acquire_owned().await?;
+                hash_file(&book).await
+            })
+        })
+        .collect();
+
+    let mut kept_by_digest = HashMap::<Sha256Digest, PathBuf>::new();
+    let mut unique_books = vec![];
+
+    for (book, hashing_task) in books.into_iter().zip(hashing_tasks) {
+        // Books that can't be read are left for the copying stage to report on.
+        let Ok(digest) = hashing_task.await? else {
+            unique_books.push(book);
+            continue;
+        };
+
+        if let Some(kept) = kept_by_digest.get(&digest) {
+            let (book_str, kept_str) = (path_str(&book.path)?, path_str(kept)?);
+            println_about_book!(
+                &book.path,
+                "Book {book_str} has the same contents as {kept_str}; will not copy across."
+            )
+            .await?;
+            record_skip(&book.path, format!("same contents as {kept_str}"), stats).await?;
+            stats.send(Statistic::SkippedDuplicateContent).await?;
+        } else {
+            kept_by_digest.insert(digest, book.path.clone());
+            unique_books.push(book);
+        }
+    }
+
+    Ok(unique_books)
+}
+
+/// Skip EPUBs with the same title and authors as another found earlier. EPUBs whose metadata
+/// can't be read, perhaps due to corruption or DRM, are kept and left to the usual name-based
+/// handling.
+async fn dedupe_by_metadata(
+    books: Vec<FoundBook>,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<FoundBook>> {
+    let permits = Arc::new(Semaphore::new(METADATA_READING_CONCURRENCY));
+    let reading_tasks: Vec<_> = books
+        .iter()
+        .map(|book| book.path.clone())
+        .map(|book| {
+            let permits = permits.clone();
+            spawn(async move {
+                let _permit = permits.acquire_owned().await?;
+                let is_epub = book
+                    .extension()
+                    .is_some_and(|ext| ext.eq_ignore_ascii_case("epub"));
+                if is_epub {
+                    read_book_metadata(&book).await.map(Some)
+                } else {
+                    Ok(None)
+                }
+            })
+        })
+        .collect();
+
+    let mut kept_by_identity = HashMap::<(String, Vec<String>), PathBuf>::new();
+    let mut unique_books = vec![];
+
+    for (book, reading_task) in books.into_iter().zip(reading_tasks) {
+        let identity = match reading_task.await? {
+            Ok(metadata) => metadata.and_then(|metadata| metadata.identity()),
+            Err(err) => {
+                let book_str = path_str(&book.path)?;
+                println_error_about_book!(
+                    &book.path,
+                    "Warning: could not read the metadata of book {book_str}: {err}; will only \
+                        compare it with others by name."
+                )
+                .await?;
+                None
+            }
+        };
+        let Some(identity) = identity else {
+            unique_books.push(book);
+            continue;
+        };
+
+        if let Some(kept) = kept_by_identity.get(&identity) {
+            let (book_str, kept_str) = (path_str(&book.path)?, path_str(kept)?);
+            println_about_book!(
+                &book.path,
+                "Book {book_str} has the same title and authors as {kept_str}; will not copy \
+                    across."
+            )
+            .await?;
+            record_skip(
+                &book.path,
+                format!("same title and authors as {kept_str}"),
+                stats,
+            )
+            .await?;
+            stats.send(Statistic::SkippedDuplicateMetadata).await?;
+        } else {
+            kept_by_identity.insert(identity, book.path.clone());
+            unique_books.push(book);
+        }
+    }
+
+    Ok(unique_books)
+}
+
+/// Copy only one format of each book, identifying them by the ISBNs in their names and metadata
+/// and picking the format that comes first in the preferred formats. Unlisted formats are least
+/// preferred, and books without ISBNs are left alone.
+async fn dedupe_by_isbn(
+    books: Vec<FoundBook>,
+    preferred_formats: &[String],
+    stats: &Sender<Statistic>,
+) -> Result<Vec<FoundBook>> {
+    let permits = Arc::new(Semaphore::new(METADATA_READING_CONCURRENCY));
+    let reading_tasks: Vec<_> = books
+        .iter()
+        .map(|book| book.path.clone())
+        .map(|book| {
+            let permits = permits.clone();
+            spawn(async move {
+                let _permit = permits.acquire_owned().await?;
+                read_book_metadata(&book).await
+            })
+        })
+        .collect();
+
+    // Books with several ISBNs, such as those for the print and electronic editions, join the
+    // group of whichever is seen first.
+    let mut groups: Vec<Vec<usize>> = vec![];
+    let mut group_indices = HashMap::<String, usize>::new();
+    let mut isbns_by_book = vec![];
+
+    for (i, (book, reading_task)) in books.iter().zip(reading_tasks).enumerate() {
+        let file_name = book.path.file_name().unwrap_or_default().to_string_lossy();
+        let mut isbns = find_isbns(&file_name);
+        // Books whose metadata can't be read still have the ISBNs in their names to go on.
+        if let Ok(metadata) = reading_task.await? {
+            for identifier in &metadata.identifiers {
+                isbns.extend(find_isbns(identifier));
+            }
+        }
+        isbns.sort();
+        isbns.dedup();
+
+        if let Some(&group) = isbns.iter().find_map(|isbn| group_indices.get(isbn)) {
+            groups[group].push(i);
+            for isbn in &isbns {
+                group_indices.entry(isbn.clone()).or_insert(group);
+            }
+        } else if !isbns.is_empty() {
+            for isbn in &isbns {
+                group_indices.insert(isbn.clone(), groups.len());
+            }
+            groups.push(vec![i]);
+        }
+        isbns_by_book.push(isbns);
+    }
+
+    let format_rank = |book: &FoundBook| {
+        let ext = book
+            .path
+            .extension()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .to_lowercase();
+        preferred_formats
+            .iter()
+            .position(|format| *format == ext)
+            .unwrap_or(preferred_formats.len())
+    };
+
+    let mut suppressed = HashSet::new();
+    for group in groups {
+        // The earliest found book wins ties, as `min_by_key` yields the first minimum.
+        let Some(&kept) = group.iter().min_by_key(|&&i| format_rank(&books[i])) else {
+            continue;
+        };
+        for i in group.into_iter().filter(|&i| i != kept) {
+            let (book_str, kept_str) = (path_str(&books[i].path)?, path_str(&books[kept].path)?);
+            let isbn = isbns_by_book[i]
+                .iter()
+                .find(|isbn| isbns_by_book[kept].contains(isbn))
+                .unwrap_or(&isbns_by_book[i][0]);
+            println_about_book!(
+                &books[i].path,
+                "Book {book_str} has the same ISBN, {isbn}, as {kept_str}, which is in a more \
+                    preferred format; will not copy across."
+            )
+            .await?;
+            record_skip(
+                &books[i].path,
+                format!("same ISBN, {isbn}, as {kept_str}"),
+                stats,
+            )
+            .await?;
+            stats.send(Statistic::SkippedDuplicateIsbn).await?;
+            suppressed.insert(i);
+        }
+    }
+
+    Ok(books
+        .into_iter()
+        .enumerate()
+        .filter(|(i, _)| !suppressed.contains(i))
+        .map(|(_, book)| book)
+        .collect())
+}
+
+/// A found book along with where it will be copied to, relative to the destination directory.
+struct PlannedCopy {
+    src: PathBuf,
+    dest: PathBuf,
+}
+
+/// What to do with books that would be copied to the same destination as another book with
+/// different contents.
+#[derive(Clone, Copy, Debug, ValueEnum)]
+enum CollisionPolicy {
+    /// Rename all but the first, suffixing them with the name of their parent directory.
+    Rename,
+
+    /// Copy only the first.
+    Skip,
+
+    /// Fail before copying anything.
+    Error,
+}
+
+/// Fold the case of a path for comparison, as FAT32 names are case-insensitive.
+fn fold_case(path: &Path) -> String {
+    path.to_string_lossy().to_lowercase()
+}
+
+/// Derive a destination from the name of a book's parent directory, such as `notes (ProjectX).pdf`
+/// for `ProjectX/notes.pdf`, so that it stays the same across runs. Numbers are added if that is
+/// taken too.
+fn disambiguate_dest(
+    dest: &Path,
+    src: &Path,
+    transliterate: bool,
+    taken_dests: &mut HashSet<String>,
+) -> PathBuf {
+    let stem = dest.file_stem().unwrap_or_default().to_string_lossy();
+    let ext = dest
+        .extension()
+        .map(|ext| format!(".{}", ext.to_string_lossy()))
+        .unwrap_or_default();
+    let parent = dest_name(
+        &src.parent()
+            .and_then(Path::file_name)
+            .unwrap_or_default()
+            .to_string_lossy(),
+        transliterate,
+    );
+
+    let mut attempt = 1;
+    loop {
+        let suffix = if attempt == 1 {
+            parent.clone()
+        } else {
+            format!("{parent} {attempt}")
+        };
+        let candidate = dest.with_file_name(format!("{stem} ({suffix}){ext}"));
+        if taken_dests.insert(fold_case(&candidate)) {
+            break candidate;
+        }
+        attempt += 1;
+    }
+}
+
+/// Resolve books that would be copied to the same destination. Those with identical contents are
+/// deduplicated, whereas the rest are dealt with according to the collision policy.
+async fn resolve_collisions(
+    copies: Vec<PlannedCopy>,
+    policy: CollisionPolicy,
+    transliterate: bool,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    let mut taken_dests: HashSet<String> =
+        copies.iter().map(|copy| fold_case(&copy.dest)).collect();
+
+    // FAT32 is case-insensitive, so destinations differing only by case collide too.
+    let mut srcs_by_dest: Vec<(PathBuf, Vec<PathBuf>)> = vec![];
+    let mut group_indices = HashMap::<String, usize>::new();
+    for PlannedCopy { src, dest } in copies {
+        match group_indices.get(&fold_case(&dest)) {
+            Some(&i) => srcs_by_dest[i].1.push(src),
+            None => {
+                group_indices.insert(fold_case(&dest), srcs_by_dest.len());
+                srcs_by_dest.push((dest, vec![src]));
+            }
+        }
+    }
+
+    let mut resolved = vec![];
+    let mut conflicts = vec![];
+
+    for (dest, srcs) in srcs_by_dest {
+        if srcs.len() == 1 {
+            resolved.extend(srcs.into_iter().map(|src| PlannedCopy {
+                src,
+                dest: dest.clone(),
+            }));
+            continue;
+        }
+
+        let mut kept_digests: Vec<(Sha256Digest, PathBuf)> = vec![];
+
+        for (i, src) in srcs.into_iter().enumerate() {
+            // Books that can't be read are left for the copying stage to report on.
+            let digest = hash_file(&src).await.ok();
+
+            let same_contents = digest.and_then(|digest| {
+                kept_digests
+                    .iter()
+                    .find(|(kept_digest, _)| *kept_digest == digest)
+            });
+            if let Some((_, kept)) = same_contents {
+                let (src_str, kept_str) = (path_str(&src)?, path_str(kept)?);
+                println_about_book!(
+                    &src,
+                    "Book {src_str} has the same contents as {kept_str}; will not copy across."
+                )
+                .await?;
+                record_skip(&src, format!("same contents as {kept_str}"), stats).await?;
+                stats.send(Statistic::SkippedDuplicateContent).await?;
+                continue;
+            }
+            if i == 0 {
+                kept_digests.extend(digest.map(|digest| (digest, src.clone())));
+                resolved.push(PlannedCopy {
+                    src,
+                    dest: dest.clone(),
+                });
+                continue;
+            }
+
+            let (src_str, dest_str) = (path_str(&src)?, path_str(&dest)?);
+            match policy {
+                CollisionPolicy::Rename => {
+                    let renamed = disambiguate_dest(&dest, &src, transliterate, &mut taken_dests);
+                    let renamed_str = path_str(&renamed)?;
+                    println_about_book!(
+                        &src,
+                        "Book {src_str} has the same name as another book, {dest_str}; will copy \
+                            it across as {renamed_str} instead."
+                    )
+                    .await?;
+                    stats.send(Statistic::RenamedForNameCollision).await?;
+                    kept_digests.extend(digest.map(|digest| (digest, src.clone())));
+                    resolved.push(PlannedCopy { src, dest: renamed });
+                }
+                CollisionPolicy::Skip => {
+                    println_about_book!(
+                        &src,
+                        "Book {src_str} has the same name as another book, {dest_str}; will not \
+                            copy across."
+                    )
+                    .await?;
+                    record_skip(
+                        &src,
+                        format!("same name as another book, {dest_str}"),
+                        stats,
+                    )
+                    .await?;
+                    stats.send(Statistic::SkippedForNameCollision).await?;
+                }
+                CollisionPolicy::Error => {
+                    conflicts.push(format!("{src_str} would also be copied to {dest_str}"));
+                }
+            }
+        }
+    }
+
+    if conflicts.is_empty() {
+        Ok(resolved)
+    } else {
+        Err(anyhow!(
+            "Different books have the same names:\n{}",
+            conflicts.join("\n")
+        ))
+    }
+}
+
+// Names that Windows reserves for devices, even with an extension such as `CON.pdf`. Readers
+// formatted as FAT32 are usually browsed from Windows at some point, where these can't be opened.
+const RESERVED_FAT32_NAMES: [&str; 22] = [
+    "CON", "PRN", "AUX", "NUL", "COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8",
+    "COM9", "LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+];
+
+/// Replace characters that FAT32 forbids in names with underscores, strip the trailing spaces and
+/// dots it silently drops, and suffix reserved device names with an underscore.
+fn sanitise_fat32_name(name: &str) -> String {
+    let sanitised: String = name
+        .chars()
+        .map(|c| {
+            if c.is_control() || r#"<>:"/\|?*"#.contains(c) {
+                '_'
+            } else {
+                c
+            }
+        })
+        .collect();
+    let sanitised = match sanitised.trim_end_matches([' ', '.']) {
+        "" => "_",
+        trimmed => trimmed,
+    };
+
+    let (base, rest) = sanitised.split_at(sanitised.find('.').unwrap_or(sanitised.len()));
+    if RESERVED_FAT32_NAMES
+        .iter()
+        .any(|reserved| base.trim_end().eq_ignore_ascii_case(reserved))
+    {
+        format!("{base}_{rest}")
+    } else {
+        sanitised.to_owned()
+    }
+}
+
+/// Make a name safe for FAT32, approximating it in ASCII first if transliterating.
+fn dest_name(name: &str, transliterate: bool) -> String {
+    if transliterate {
+        sanitise_fat32_name(&deunicode(name))
+    } else {
+        sanitise_fat32_name(name)
+    }
+}
+
+/// Truncate the stem of a name longer than the maximum length in bytes, suffixing it with a hash
+/// of the whole name so that it stays the same across runs and differs from other truncated names
+/// that share a prefix. The extension is kept. Names that already fit yield nothing.
+fn shorten_name(name: &str, max_len: usize) -> Option<String> {
+    if name.len() <= max_len {
+        return None;
+    }
+
+    let (stem, ext) = match name.rfind('.') {
+        Some(dot) if dot > 0 => name.split_at(dot),
+        _ => (name, ""),
+    };
+    let digest = Sha256::digest(name.as_bytes());
+    let suffix = format!(
+        " ~{}",
+        digest[..4]
+            .iter()
+            .map(|byte| format!("{byte:02x}"))
+            .collect::<String>()
+    );
+
+    let mut stem_len = max_len.saturating_sub(ext.len() + suffix.len());
+    while !stem.is_char_boundary(stem_len) {
+        stem_len -= 1;
+    }
+    let stem = stem[..stem_len].trim_end_matches([' ', '.']);
+    Some(format!("{stem}{suffix}{ext}"))
+}
+
+/// Mirror a book's path within its documents directory at the destination, making its parent
+/// directories' names safe for FAT32 along the way.
+fn preserved_tree_dest(
+    book: &FoundBook,
+    file_name: &OsStr,
+    transliterate: bool,
+) -> Option<PathBuf> {
+    let mut dest: PathBuf = book
+        .relative_path
+        .parent()?
+        .components()
+        .map(|dir| dest_name(&dir.as_os_str().to_string_lossy(), transliterate))
+        .collect();
+    dest.push(file_name);
+    Some(dest)
+}
+
+/// Name a book `Author - Title.ext` after its embedded metadata, yielding nothing for books
+/// without a title or whose metadata can't be read.
+async fn metadata_file_name(path: &Path) -> Option<String> {
+    let metadata = read_book_metadata(path).await.ok()?;
+    let title = metadata.title.as_deref()?;
+    let ext = path.extension()?.to_string_lossy();
+
+    let stem = match metadata.lead_author() {
+        Some(author) => format!("{author} - {title}"),
+        None => title.to_owned(),
+    };
+    Some(format!("{}.{ext}", sanitise_fat32_name(&stem)))
+}
+
+/// Parse a `--extension-directory` mapping such as `pdf=PDFs` into a lowercase extension without a
+/// leading dot and a directory relative to the destination.
+fn parse_extension_directory(mapping: &str) -> Result<(String, PathBuf)> {
+    let (ext, dir) = mapping
+        .split_once('=')
+        .ok_or_else(|| anyhow!("{mapping} is not in the form EXTENSION=DIRECTORY"))?;
+
+    let ext = ext.trim_start_matches('.').to_lowercase();
+    let dir = PathBuf::from(dir);
+    let is_relative_descendant = dir
+        .components()
+        .all(|component| matches!(component, Component::Normal(_)));
+    if ext.is_empty() || !is_relative_descendant {
+        return Err(anyhow!(
+            "{mapping} must map an extension to a directory within the destination"
+        ));
+    }
+
+    Ok((ext, dir))
+}
+
+/// One of several destinations synchronised to in a run, given with `--dest`.
+struct Destination {
+    name: String,
+    dir: PathBuf,
+    /// The lowercase extensions, without leading dots, of the books copied to it.
+    extensions: Vec<String>,
+}
+
+impl Destination {
+    fn takes(&self, book: &FoundBook) -> bool {
+        let ext = book.path.extension().unwrap_or_default().to_string_lossy();
+        self.extensions.contains(&ext.to_lowercase())
+    }
+}
+
+/// Parse a `--dest` such as `kindle:pdf=/media/Kindle/documents` into a destination taking books
+/// with the extensions given, or every book if none are.
+fn parse_destination(spec: &str) -> Result<Destination> {
+    let (name, dir) = spec
+        .split_once('=')
+        .ok_or_else(|| anyhow!("{spec} is not in the form NAME=DIRECTORY"))?;
+    let (name, extensions) = match name.split_once(':') {
+        Some((name, extensions)) => (
+            name,
+            extensions
+                .split(',')
+                .map(|ext| ext.trim().trim_start_matches('.').to_lowercase())
+                .collect(),
+        ),
+        None => (name, EXTENSIONS_TO_SYNCHRONISE.map(str::to_owned).to_vec()),
+    };
+    if name.is_empty() || dir.is_empty() {
+        return Err(anyhow!("{spec} must name a destination and its directory"));
+    }
+    let unsynchronised = extensions
+        .iter()
+        .find(|ext| !EXTENSIONS_TO_SYNCHRONISE.contains(&ext.as_str()));
+    if let Some(ext) = unsynchronised {
+        let synchronised = EXTENSIONS_TO_SYNCHRONISE.join(" and ");
+        return Err(anyhow!(
+            "{spec} takes {ext} books, but only {synchronised} books are synchronised"
+        ));
+    }
+
+    Ok(Destination {
+        name: name.to_owned(),
+        dir: PathBuf::from(dir),
+        extensions,
+    })
+}
+
+/// Create the directories that planned copies need, or just report them when dry-running.
+async fn create_dest_dirs(dest_dir: &Path, copies: &[PlannedCopy], dry_run: bool) -> Result<()> {
+    let dirs: HashSet<_> = copies
+        .iter()
+        .filter_map(|copy| copy.dest.parent())
+        .filter(|dir| !dir.as_os_str().is_empty())
+        .map(|dir| dest_dir.join(dir))
+        .collect();
+
+    for dir in dirs {
+        if is_accessible_dir(&dir).await {
+            continue;
+        }
+        if dry_run {
+            let dir_str = path_str(&dir)?;
+            println_async!("Dry-running; would otherwise create directory {dir_str}").await?;
+        } else {
+            fs::create_dir_all(&dir).await.map_err(|err| {
+                let dir_str = dir.to_string_lossy();
+                anyhow!("could not create {dir_str}: {err}")
+            })?;
+        }
+    }
+
+    Ok(())
+}
+
+/// List what already exists in the destination directories that planned copies will go into,
+/// relative to the destination and with their case folded. Each directory is read once, rather
+/// than checking every book individually, which is slow over USB and misses names that differ only
+/// by case.
+async fn list_existing_dests(dest_dir: &Path, copies: &[PlannedCopy]) -> Result<HashSet<String>> {
+    let dirs: HashSet<_> = copies
+        .iter()
+        .map(|copy| copy.dest.parent().unwrap_or(Path::new("")))
+        .collect();
+
+    let mut existing = HashSet::new();
+    for dir in dirs {
+        let full_dir = dest_dir.join(dir);
+        let dir_str = path_str(&full_dir)?;
+        let mut entries = match fs::read_dir(&full_dir).await {
+            Ok(entries) => entries,
+            // Directories yet to be created while dry-running contain nothing so far.
+            Err(err) if err.kind() == io::ErrorKind::NotFound => continue,
+            Err(err) => return Err(anyhow!("could not list {dir_str}: {err}")),
+        };
+        while let Some(entry) = entries
+            .next_entry()
+            .await
+            .map_err(|err| anyhow!("could not list {dir_str}: {err}"))?
+        {
+            existing.insert(fold_case(&dir.join(entry.file_name())));
+        }
+    }
+
+    Ok(existing)
+}
+
+async fn report_unchanged(src_path: &Path, stats: &Sender<Statistic>) -> Result<()> {
+    let src_str = path_str(src_path)?;
+    println_skipped_book!(
+        src_path,
+        "Book {src_str} is unchanged since it was last synchronised; will not copy across.";
+        reason = "unchanged since last synchronised",
+    )
+    .await?;
+    record_skip(src_path, "unchanged since last synchronised", stats).await?;
+    stats.send(Statistic::UnchangedSinceLastSync).await?;
+    Ok(())
+}
+
+async fn report_other_book_existing(
+    src_path: &Path,
+    dest_path: &Path,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    let dest_str = path_str(dest_path)?;
+    println_skipped_book!(
+        src_path,
+        "Book {dest_str} already exists on the destination, but was not put there by this tool; \
+            will not copy across.";
+        dest = dest_str,
+        reason = "another book is there",
+    )
+    .await?;
+    record_skip(src_path, format!("another book is at {dest_str}"), stats).await?;
+    stats
+        .send(Statistic::NotCopiedBecauseOtherBookAtDest)
+        .await?;
+    Ok(())
+}
+
+async fn report_already_existing(
+    src_path: &Path,
+    dest_path: &Path,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    let dest_str = path_str(dest_path)?;
+    println_skipped_book!(
+        src_path,
+        "Book {dest_str} already exists on the destination; will not copy across.";
+        dest = dest_str,
+        reason = "already exists",
+    )
+    .await?;
+    record_skip(src_path, format!("already exists at {dest_str}"), stats).await?;
+    stats
+        .send(Statistic::NotCopiedBecauseAlreadyExistedAtDest)
+        .await?;
+    Ok(())
+}
+
+/// Parse a size such as `500M`, `1.5G`, or `1.5GiB` in binary units, or a plain number of bytes.
+fn parse_size(size: &str) -> Result<u64, String> {
+    let size = size.trim();
+    let number_len = size
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(size.len());
+    let (number, unit) = size.split_at(number_len);
+
+    let number: f64 = number
+        .parse()
+        .map_err(|_| format!("{size} does not start with a number"))?;
+    let exponent = match unit.trim().to_uppercase().trim_end_matches(['B', 'I']) {
+        "" => 0,
+        "K" => 1,
+        "M" => 2,
+        "G" => 3,
+        "T" => 4,
+        _ => return Err(format!("{size} does not have a unit of K, M, G, or T")),
+    };
+
+    Ok((number * 1024f64.powi(exponent)) as u64)
+}
+
+/// Parse a `--since` cutoff, either as a duration before now or as the start of a local date.
+fn parse_since(since: &str) -> Result<SystemTime, String> {
+    if let Ok(date) = NaiveDate::parse_from_str(since, "%Y-%m-%d") {
+        return date
+            .and_time(NaiveTime::MIN)
+            .and_local_timezone(Local)
+            .earliest()
+            .map(SystemTime::from)
+            .ok_or_else(|| format!("{since} does not exist in the local timezone"));
+    }
+
+    let ago = humantime::parse_duration(since)
+        .map_err(|err| format!("{since} is neither a date nor a duration: {err}"))?;
+    SystemTime::now()
+        .checked_sub(ago)
+        .ok_or_else(|| format!("{since} is too long ago"))
+}
+
+/// Format a size in bytes with binary units, such as `1.5 GiB`.
+fn format_size(bytes: u64) -> String {
+    const UNITS: [&str; 5] = ["B", "KiB", "MiB", "GiB", "TiB"];
+
+    let mut size = bytes as f64;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+
+    if unit == 0 {
+        format!("{bytes} B")
+    } else {
+        format!("{size:.1} {}", UNITS[unit])
+    }
+}
+
+/// The space available to unprivileged users on the filesystem holding a directory, if it can be
+/// determined on this OS.
+#[cfg(unix)]
+fn available_space(dir: &Path) -> Result<Option<u64>> {
+    use nix::sys::statvfs::statvfs;
+
+    let stats = statvfs(dir)?;
+    #[allow(clippy::useless_conversion)]
+    let available = u64::from(stats.blocks_available()) * u64::from(stats.fragment_size());
+    Ok(Some(available))
+}
+
+#[cfg(not(unix))]
+fn available_space(_dir: &Path) -> Result<Option<u64>> {
+    Ok(None)
+}
+
+/// Fail before copying anything if the books won't fit on the destination, rather than leaving it
+/// littered with truncated books that later runs would consider already copied. Dry runs and
+/// best-effort runs only warn.
+async fn check_free_space(
+    dest_dir: &Path,
+    copies: &[PlannedCopy],
+    dry_run: bool,
+    best_effort: bool,
+) -> Result<()> {
+    let dest_str = path_str(dest_dir)?;
+    let Some(available) = available_space(dest_dir)
+        .map_err(|err| anyhow!("could not determine the free space on {dest_str}: {err}"))?
+    else {
+        return Ok(());
+    };
+
+    let mut needed = 0;
+    for copy in copies {
+        // Books that can't be read are left for the copying stage to report on.
+        needed += fs::metadata(&copy.src).await.map(|m| m.len()).unwrap_or(0);
+    }
+    if needed <= available.saturating_sub(FREE_SPACE_MARGIN) {
+        return Ok(());
+    }
+
+    let message = format!(
+        "The books to copy need {}, but only {} is available on {dest_str}, which must keep {} \
+            free",
+        format_size(needed),
+        format_size(available),
+        format_size(FREE_SPACE_MARGIN)
+    );
+    if dry_run {
+        println_error!("Dry-running; would otherwise abort: {message}.").await?;
+        Ok(())
+    } else if best_effort {
+        println_error!("Warning: {message}; will copy as many books as fit.").await?;
+        Ok(())
+    } else {
+        Err(anyhow!(
+            "{message}. Pass --best-effort to copy as many books as fit anyway."
+        ))
+    }
+}
+
+/// Asks on the terminal whether to go ahead with each book under `--interactive`, much like
+/// `rm -i`.
+struct Confirmation {
+    answers: io::Lines<BufReader<io::Stdin>>,
+    /// Whether to go ahead with every other book without asking.
+    all: bool,
+    /// Whether to go ahead with nothing else, including pruning.
+    quitting: bool,
+}
+
+impl Confirmation {
+    fn new() -> Self {
+        Self {
+            answers: BufReader::new(io::stdin()).lines(),
+            all: false,
+            quitting: false,
+        }
+    }
+
+    /// Yield whether to go ahead, asking unless `a` or `q` was answered before. The end of
+    /// standard input counts as quitting.
+    async fn confirm(&mut self, question: &str) -> Result<bool> {
+        let mut err = stderr();
+        loop {
+            if self.all {
+                return Ok(true);
+            }
+            if self.quitting {
+                return Ok(false);
+            }
+
+            err.write_all(format!("{question} [y/n/a/q] ").as_bytes())
+                .await?;
+            err.flush().await?;
+            let Some(answer) = self.answers.next_line().await? else {
+                err.write_all(b"\n").await?;
+                self.quitting = true;
+                continue;
+            };
+            match answer.trim().to_lowercase().as_str() {
+                "y" | "yes" => return Ok(true),
+                "n" | "no" => return Ok(false),
+                "a" | "all" => self.all = true,
+                "q" | "quit" => self.quitting = true,
+                _ => {
+                    err.write_all(b"Answer y(es), n(o), a(ll), or q(uit).\n")
+                        .await?;
+                }
+            }
+        }
+    }
+}
+
+/// Keep only the copies picked from a list on the terminal under `--pick`, in their original order.
+async fn pick_copies(
+    dest_dir: &Path,
+    copies: Vec<PlannedCopy>,
+    existing_dests: &HashSet<String>,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    let dest = destination_name();
+    let mut candidates = vec![];
+    for copy in &copies {
+        let size = match fs::metadata(&copy.src).await {
+            Ok(metadata) => format_size(metadata.len()),
+            Err(_) => "unknown size".to_owned(),
+        };
+        let details = if existing_dests.contains(&fold_case(&copy.dest)) {
+            format!("{size}, already on {dest}")
+        } else {
+            size
+        };
+        candidates.push(Candidate {
+            name: path_str(&dest_dir.join(&copy.dest))?.to_owned(),
+            details,
+        });
+    }
+
+    let picked = spawn_blocking(move || picker::pick(&candidates))
+        .await??
+        .ok_or_else(|| anyhow!("picking the books to synchronise was cancelled"))?;
+    let mut kept = vec![];
+    for (copy, picked) in copies.into_iter().zip(picked) {
+        if picked {
+            kept.push(copy);
+        } else {
+            record_skip(&copy.src, "not picked", stats).await?;
+            stats.send(Statistic::NotPicked).await?;
+        }
+    }
+    println_async!(
+        "Picked {} of the books found to synchronise by hand.",
+        kept.len()
+    )
+    .await?;
+    Ok(kept)
+}
+
+/// Keep only the copies confirmed under `--interactive`, in their original order.
+async fn confirm_copies(
+    confirmation: &mut Confirmation,
+    dest_dir: &Path,
+    copies: Vec<PlannedCopy>,
+    updating: bool,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    let mut confirmed = vec![];
+    for copy in copies {
+        let src_str = path_str(&copy.src)?;
+        let dest_path = dest_dir.join(&copy.dest);
+        let dest_str = path_str(&dest_path)?;
+        let size = match fs::metadata(&copy.src).await {
+            Ok(metadata) => format_size(metadata.len()),
+            Err(_) => "unknown size".to_owned(),
+        };
+        let question = if updating {
+            format!("Update {dest_str} from {src_str} ({size})?")
+        } else {
+            format!("Copy {src_str} to {dest_str} ({size})?")
+        };
+
+        if confirmation.confirm(&question).await? {
+            confirmed.push(copy);
+        } else {
+            record_skip(&copy.src, "declined", stats).await?;
+            stats.send(Statistic::DeclinedInteractively).await?;
+        }
+    }
+    Ok(confirmed)
+}
+
+/// Keep only the most recently modified books, in their original order. Books whose modification
+/// times can't be read are considered the oldest.
+async fn keep_newest(
+    copies: Vec<PlannedCopy>,
+    max_books: usize,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    if copies.len() <= max_books {
+        return Ok(copies);
+    }
+
+    let mut modified_times = vec![];
+    for copy in &copies {
+        let modified = fs::metadata(&copy.src)
+            .await
+            .and_then(|m| m.modified())
+            .unwrap_or(SystemTime::UNIX_EPOCH);
+        modified_times.push(modified);
+    }
+
+    let mut newest_first: Vec<_> = (0..copies.len()).collect();
+    newest_first.sort_by_key(|&i| Reverse(modified_times[i]));
+    let kept: HashSet<_> = newest_first.into_iter().take(max_books).collect();
+
+    let cut_off = copies.len() - max_books;
+    println_async!(
+        "Only the {max_books} most recently modified books will be copied across; {cut_off} \
+            older ones will not."
+    )
+    .await?;
+    stats.send(Statistic::CutOffByMaxBooks(cut_off)).await?;
+
+    let mut newest = vec![];
+    for (i, copy) in copies.into_iter().enumerate() {
+        if kept.contains(&i) {
+            newest.push(copy);
+        } else {
+            record_skip(&copy.src, "older than the books kept by --max-books", stats).await?;
+        }
+    }
+    Ok(newest)
+}
+
+/// A cap on how much is copied in one run.
+#[derive(Clone, Copy, Debug)]
+enum TotalSizeLimit {
+    /// Whatever is free on the destination, less the safety margin.
+    Auto,
+    Bytes(u64),
+}
+
+fn parse_total_size_limit(limit: &str) -> Result<TotalSizeLimit, String> {
+    if limit.eq_ignore_ascii_case("auto") {
+        Ok(TotalSizeLimit::Auto)
+    } else {
+        parse_size(limit).map(TotalSizeLimit::Bytes)
+    }
+}
+
+/// Keep the books that fit within a total size, in order, deferring those that would take the
+/// total over it to later runs. Smaller books further on can still fill the remaining space.
+async fn keep_within_total_size(
+    dest_dir: &Path,
+    copies: Vec<PlannedCopy>,
+    limit: TotalSizeLimit,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    let max_total_size = match limit {
+        TotalSizeLimit::Bytes(bytes) => bytes,
+        TotalSizeLimit::Auto => {
+            let dest_str = path_str(dest_dir)?;
+            match available_space(dest_dir)
+                .map_err(|err| anyhow!("could not determine the free space on {dest_str}: {err}"))?
+            {
+                Some(available) => available.saturating_sub(FREE_SPACE_MARGIN),
+                None => {
+                    println_error!(
+                        "Warning: the free space on {dest_str} can't be determined on this OS; \
+                            will not limit the total size of books copied."
+                    )
+                    .await?;
+                    return Ok(copies);
+                }
+            }
+        }
+    };
+
+    let mut kept = vec![];
+    let mut total_size = 0;
+    let (mut deferred, mut deferred_size) = (0, 0);
+
+    for copy in copies {
+        // Books that can't be read are left for the copying stage to report on.
+        let size = fs::metadata(&copy.src).await.map(|m| m.len()).unwrap_or(0);
+        if total_size + size <= max_total_size {
+            total_size += size;
+            kept.push(copy);
+        } else {
+            record_skip(&copy.src, "deferred by --max-total-size", stats).await?;
+            deferred += 1;
+            deferred_size += size;
+        }
+    }
+
+    if 0 < deferred {
+        println_async!(
+            "Only up to {} of books will be copied across; {deferred} books totalling {} will be left \
+                for a later run.",
+            format_size(max_total_size),
+            format_size(deferred_size)
+        )
+        .await?;
+        stats
+            .send(Statistic::DeferredByMaxTotalSize(deferred, deferred_size))
+            .await?;
+    }
+
+    Ok(kept)
+}
+
+/// What to do with the books found.
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum Mode {
+    Sync,
+    List(ListingFormat),
+    Check,
+}
+
+#[derive(Clone, Copy, PartialEq, Eq)]
+enum ListingFormat {
+    Text,
+    Json,
+}
+
+#[derive(Serialize)]
+struct ListedBook {
+    path: PathBuf,
+    size: u64,
+    source: PathBuf,
+}
+
+/// List found books sorted by path, along with their sizes and the documents directories they
+/// were found in, rather than synchronising them.
+async fn list_books(
+    format: ListingFormat,
+    mut found_books: Receiver<FoundBook>,
+    book_finding: JoinHandle<Result<bool>>,
+) -> Result<()> {
+    let mut listed = vec![];
+    while let Some(FoundBook {
+        path,
+        relative_path,
+    }) = found_books.recv().await
+    {
+        // Books that can't be read are listed regardless, as they were still found.
+        let size = fs::metadata(&path).await.map(|m| m.len()).unwrap_or(0);
+        let source = path
+            .ancestors()
+            .nth(relative_path.components().count())
+            .unwrap_or(Path::new(""))
+            .to_path_buf();
+        listed.push(ListedBook { path, size, source });
+    }
+    book_finding.await??;
+    listed.sort_by(|a, b| a.path.cmp(&b.path));
+    flush_book_messages().await?;
+
+    match format {
+        ListingFormat::Json => {
+            let mut json = serde_json::to_string_pretty(&listed)?;
+            json.push('\n');
+            stdout().write_all(json.as_bytes()).await?;
+        }
+        ListingFormat::Text => {
+            for ListedBook { path, size, source } in &listed {
+                let (path_str, source_str) = (path_str(path)?, path_str(source)?);
+                let size = format_size(*size);
+                println_always!("{path_str} ({size}, found in {source_str})").await?;
+            }
+        }
+    }
+
+    Ok(())
+}
+
+/// Books on the Kobo keyed by their case-folded names, as books are matched by name regardless of
+/// where on the Kobo they are.
+async fn find_books_on_device(device_dir: &Path) -> Result<HashMap<String, Vec<(PathBuf, u64)>>> {
+    let extensions: HashSet<&OsStr> = EXTENSIONS_TO_SYNCHRONISE.iter().map(OsStr::new).collect();
+
+    // Hidden directories such as `.kobo` hold the reader's own files rather than books.
+    let mut entries = WalkDir::new(device_dir).filter(|entry| async move {
+        let is_hidden = entry.file_name().to_string_lossy().starts_with('.');
+        let is_dir = entry.file_type().await.map(|t| t.is_dir()).unwrap_or(false);
+        if is_hidden && is_dir {
+            Filtering::IgnoreDir
+        } else {
+            Filtering::Continue
+        }
+    });
+
+    let device_str = path_str(device_dir)?;
+    let mut books = HashMap::<String, Vec<(PathBuf, u64)>>::new();
+    while let Some(entry) = entries.next().await {
+        let path = entry
+            .map_err(|err| anyhow!("could not search {device_str}: {err}"))?
+            .path();
+        if !is_book(&path, &extensions) || is_macos_metadata_file(&path) {
+            continue;
+        }
+        let Some(name) = path.file_name() else {
+            continue;
+        };
+        let size = fs::metadata(&path)
+            .await
+            .map_err(|err| anyhow!("could not read {}: {err}", path.to_string_lossy()))?
+            .len();
+        books
+            .entry(fold_case(Path::new(name)))
+            .or_default()
+            .push((path, size));
+    }
+    Ok(books)
+}
+
+/// Books on the Kobo, along with their sizes, whose names don't match any of the books found.
+/// Hidden directories, such as the trash directory, aren't searched.
+async fn find_orphans_on_device(
+    device_dir: &Path,
+    synced_names: &HashSet<String>,
+) -> Result<Vec<(PathBuf, u64)>> {
+    let mut device_books = find_books_on_device(device_dir).await?;
+    device_books.retain(|name, _| !synced_names.contains(name));
+    let mut orphans: Vec<_> = device_books.into_values().flatten().collect();
+    orphans.sort();
+    Ok(orphans)
+}
+
+/// Copy books that are only on the Kobo, such as those sideloaded from elsewhere, back into a
+/// local directory. Nothing is removed from the Kobo, and books already in the directory aren't
+/// overwritten.
+async fn pull_orphans_from_device(
+    device_dir: &Path,
+    synced_names: &HashSet<String>,
+    pull_dir: &Path,
+    dry_run: bool,
+    policy: CopyPolicy,
+    stats: &Sender<Statistic>,
+) -> Result<bool> {
+    let orphans = find_orphans_on_device(device_dir, synced_names).await?;
+    if orphans.is_empty() {
+        return Ok(false);
+    }
+    if !dry_run {
+        let pull_dir_str = path_str(pull_dir)?;
+        fs::create_dir_all(pull_dir)
+            .await
+            .map_err(|err| anyhow!("could not create {pull_dir_str}: {err}"))?;
+    }
+
+    let mut pull_tasks = vec![];
+    let dest = destination_name();
+    let mut any_pulled = false;
+    // Books are pulled back once copying is over, which the `--timeout` doesn't hold back.
+    let copier = Copier::new(CopyPolicy {
+        deadline: None,
+        ..policy
+    });
+    for (path, _) in orphans {
+        let Some(name) = path.file_name() else {
+            continue;
+        };
+        let local_path = pull_dir.join(name);
+        let (device_str, local_str) = (path_str(&path)?, path_str(&local_path)?);
+
+        if dry_run {
+            if fs::try_exists(&local_path).await? {
+                println_about_book!(
+                    &path,
+                    "Book {local_str} already exists; will not pull {device_str} back from \
+                        {dest}."
+                )
+                .await?;
+                continue;
+            }
+            println_about_book!(
+                &path,
+                "Dry-running; would otherwise pull {device_str} back from {dest} to {local_str}"
+            )
+            .await?;
+            stats.send(Statistic::PulledFromDevice).await?;
+            any_pulled = true;
+            continue;
+        }
+
+        let pulling = copier.spawn_copy(&path, &local_path, CopyKind::New, stats);
+        pull_tasks.push((pulling, path, local_path));
+    }
+
+    for (pulling, path, local_path) in pull_tasks {
+        let (device_str, local_str) = (path_str(&path)?, path_str(&local_path)?);
+        let pulled = match pulling {
+            Ok(task) => task.await?,
+            Err(err) => Err(err),
+        };
+        match pulled {
+            Ok(()) => {
+                stats.send(Statistic::PulledFromDevice).await?;
+                any_pulled = true;
+            }
+            Err(err) if is_already_existing(&err) => {
+                println_about_book!(
+                    &path,
+                    "Book {local_str} already exists; will not pull {device_str} back from {dest}."
+                )
+                .await?;
+            }
+            Err(err) => {
+                println_error_about_book!(
+                    &path,
+                    "Book {device_str} could not be pulled back from {dest} to {local_str}: {err}"
+                )
+                .await?;
+                record_failure(&path, FailureCategory::of(&err), err.to_string(), stats).await?;
+                stats.send(Statistic::FailedToCopy).await?;
+            }
+        }
+    }
+    Ok(any_pulled)
+}
+
+/// The format in which to export annotations.
+#[derive(Clone, Copy, Debug, ValueEnum)]
+enum AnnotationsFormat {
+    Markdown,
+    Json,
+}
+
+/// Export the highlights and notes made on the Kobo, one file per book. A database that is missing,
+/// locked, or laid out unexpectedly only warrants a warning, as the books are synchronised
+/// regardless.
+async fn export_annotations_from_device(
+    device_dir: &Path,
+    export_dir: &Path,
+    format: AnnotationsFormat,
+    dry_run: bool,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    // The books are already copied by now, so failing to export annotations is only warned about
+    // rather than failing the run.
+    let books = match read_annotations(device_dir).await {
+        Ok(books) => books,
+        Err(err) => {
+            println_error!(
+                "Warning: could not read the annotations on the Kobo: {err}; will not export them."
+            )
+            .await?;
+            stats
+                .send(Statistic::AuxiliaryFailed(AuxiliaryFeature::Annotations))
+                .await?;
+            return Ok(());
+        }
+    };
+
+    let export_dir_str = path_str(export_dir)?;
+    if !dry_run {
+        if let Err(err) = fs::create_dir_all(export_dir).await {
+            println_error!(
+                "Warning: could not create {export_dir_str}: {err}; will not export annotations."
+            )
+            .await?;
+            stats
+                .send(Statistic::AuxiliaryFailed(AuxiliaryFeature::Annotations))
+                .await?;
+            return Ok(());
+        }
+    }
+
+    let ext = match format {
+        AnnotationsFormat::Markdown => "md",
+        AnnotationsFormat::Json => "json",
+    };
+
+    // Different books can have the same title, such as different editions.
+    let mut taken_names = HashSet::new();
+    for book in books {
+        let stem = book.file_stem();
+        let mut path = export_dir.join(format!("{stem}.{ext}"));
+        let mut attempt = 2;
+        while !taken_names.insert(fold_case(&path)) {
+            path = export_dir.join(format!("{stem} {attempt}.{ext}"));
+            attempt += 1;
+        }
+
+        let (path_str, count) = (path_str(&path)?, book.annotations.len());
+        if dry_run {
+            println_async!("Dry-running; would otherwise export {count} annotations to {path_str}")
+                .await?;
+        } else {
+            let contents = match format {
+                AnnotationsFormat::Markdown => book.to_markdown(),
+                AnnotationsFormat::Json => serde_json::to_string_pretty(&book)? + "\n",
+            };
+            if let Err(err) = fs::write(&path, contents).await {
+                println_error!("Warning: could not export annotations to {path_str}: {err}")
+                    .await?;
+                stats
+                    .send(Statistic::AuxiliaryFailed(AuxiliaryFeature::Annotations))
+                    .await?;
+                continue;
+            }
+            println_async!("Exported {count} annotations to {path_str}").await?;
+        }
+        stats
+            .send(Statistic::AuxiliarySucceeded(
+                AuxiliaryFeature::Annotations,
+                1,
+            ))
+            .await?;
+    }
+    Ok(())
+}
+
+/// Add books copied to the Kobo to collections named after the directories they were found in.
+/// Problems with the Kobo's database only warrant a warning, as the books were copied regardless.
+async fn add_books_to_collections(
+    device_dir: &Path,
+    entries: Vec<CollectionEntry>,
+    dry_run: bool,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    if entries.is_empty() {
+        return Ok(());
+    }
+
+    if dry_run {
+        let mut counts = HashMap::<&str, usize>::new();
+        for entry in &entries {
+            *counts.entry(&entry.collection).or_default() += 1;
+        }
+        let mut counts: Vec<_> = counts.into_iter().collect();
+        counts.sort();
+        for (collection, count) in counts {
+            println_async!(
+                "Dry-running; would otherwise add {count} books to the collection '{collection}' \
+                    on the Kobo"
+            )
+            .await?;
+        }
+        stats
+            .send(Statistic::AuxiliarySucceeded(
+                AuxiliaryFeature::Collections,
+                entries.len(),
+            ))
+            .await?;
+        return Ok(());
+    }
+
+    match add_to_collections(device_dir, entries).await {
+        Ok(added) => {
+            println_async!("Added {added} books to collections on the Kobo").await?;
+            stats
+                .send(Statistic::AuxiliarySucceeded(
+                    AuxiliaryFeature::Collections,
+                    added,
+                ))
+                .await?;
+        }
+        Err(err) => {
+            println_error!(
+                "Warning: could not add books to collections on the Kobo: {err}; will leave them \
+                    out of collections."
+            )
+            .await?;
+            stats
+                .send(Statistic::AuxiliaryFailed(AuxiliaryFeature::Collections))
+                .await?;
+        }
+    }
+    Ok(())
+}
+
+/// Write the covers of books copied to the Kobo where it looks for them, so that they show up
+/// straight away. Books whose covers can't be found or written only warrant a warning.
+async fn generate_covers(
+    device_dir: &Path,
+    copied: &[PlannedCopy],
+    pdf_renderer: Option<&str>,
+    stats: &Sender<Statistic>,
+) -> Result<()> {
+    for PlannedCopy { src, dest } in copied {
+        let src_str = path_str(src)?;
+        let result = match read_cover(src, pdf_renderer).await {
+            Ok(Some(cover)) => write_cover(device_dir, dest, cover).await,
+            Ok(None) => continue,
+            Err(err) => Err(err),
+        };
+        match result {
+            Ok(()) => {
+                stats
+                    .send(Statistic::AuxiliarySucceeded(AuxiliaryFeature::Covers, 1))
+                    .await?;
+            }
+            Err(err) => {
+                println_error_about_book!(
+                    src,
+                    "Warning: could not generate a cover for {src_str}: {err}; the Kobo will \
+                        generate its own."
+                )
+                .await?;
+                stats
+                    .send(Statistic::AuxiliaryFailed(AuxiliaryFeature::Covers))
+                    .await?;
+            }
+        }
+    }
+    Ok(())
+}
+
+/// How `--prune` gets rid of books that are no longer in the sources.
+#[derive(Clone, Copy, Debug, ValueEnum)]
+enum PruneMode {
+    /// Move them into the trash directory at the root of the Kobo, from which they can be
+    /// recovered.
+    Trash,
+
+    /// Delete them outright.
+    Delete,
+}
+
+/// Move a book into the trash directory, creating it if need be. Books already in the trash with
+/// the same name are kept, with the newcomer's name suffixed with the time it was trashed.
+async fn move_to_trash(trash_dir: &Path, path: &Path) -> Result<PathBuf> {
+    fs::create_dir_all(trash_dir).await?;
+
+    let name = path.file_name().unwrap_or_default();
+    let mut trashed = trash_dir.join(name);
+    if fs::try_exists(&trashed).await? {
+        let stem = trashed.file_stem().unwrap_or_default().to_string_lossy();
+        let ext = trashed
+            .extension()
+            .map(|ext| format!(".{}", ext.to_string_lossy()))
+            .unwrap_or_default();
+        let timestamp = Local::now().format("%Y-%m-%dT%H-%M-%S");
+        trashed = trash_dir.join(format!("{stem} ({timestamp}){ext}"));
+    }
+
+    fs::rename(path, &trashed).await?;
+    Ok(trashed)
+}
+
+/// Get rid of books on the Kobo whose names don't match any of the books found. This refuses to
+/// run if no books were found at all, as sources that are missing, such as unmounted drives, would
+/// otherwise look like a library that had every book deleted from it. The same goes for sources
+/// whose books weren't all found, such as those left out by `.syncignore`. Yields the books that
+/// were pruned.
+async fn prune_device(
+    device_dir: &Path,
+    synced_names: &HashSet<String>,
+    sources_complete: bool,
+    mode: PruneMode,
+    dry_run: bool,
+    mut confirmation: Option<&mut Confirmation>,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PathBuf>> {
+    let dest = destination_name();
+    if synced_names.is_empty() {
+        return Err(anyhow!(
+            "no books were found in the sources, which might be missing; refusing to prune {dest}"
+        ));
+    }
+    if !sources_complete {
+        return Err(anyhow!(
+            "not every book in the sources was found, as parts of them could not be searched, or \
+                books were left out by .syncignore or for being empty (see --include-empty), so \
+                they would look removed; refusing to prune {dest}"
+        ));
+    }
+
+    let trash_dir = device_dir.join(TRASH_DIR_NAME);
+    let trash_str = path_str(&trash_dir)?;
+
+    let mut pruned_books = vec![];
+    for (path, size) in find_orphans_on_device(device_dir, synced_names).await? {
+        let book_str = path_str(&path)?;
+        if let Some(confirmation) = &mut confirmation {
+            let question = format!("Prune {book_str} ({})?", format_size(size));
+            if !confirmation.confirm(&question).await? {
+                stats.send(Statistic::DeclinedInteractively).await?;
+                continue;
+            }
+        }
+        let pruned = match (mode, dry_run) {
+            (PruneMode::Trash, true) => Ok(format!(
+                "Dry-running; would otherwise move {book_str} to {trash_str}"
+            )),
+            (PruneMode::Delete, true) => {
+                Ok(format!("Dry-running; would otherwise remove {book_str}"))
+            }
+            (PruneMode::Trash, false) => move_to_trash(&trash_dir, &path)
+                .await
+                .and_then(|trashed| Ok(format!("Moved {book_str} to {}", path_str(&trashed)?))),
+            (PruneMode::Delete, false) => fs::remove_file(&path)
+                .await
+                .map(|()| format!("Removed {book_str}"))
+                .map_err(Error::from),
+        };
+
+        match pruned {
+            Ok(action) => {
+                println_about_book!(&path, "{action}, as it is no longer in the sources").await?;
+            }
+            Err(err) => {
+                println_error_about_book!(
+                    &path,
+                    "Book {book_str} could not be pruned from {dest}: {err}"
+                )
+                .await?;
+                stats.send(Statistic::FailedToPrune).await?;
+                continue;
+            }
+        }
+
+        let stat = match mode {
+            PruneMode::Trash => Statistic::TrashedOnDevice(size),
+            PruneMode::Delete => Statistic::RemovedFromDevice,
+        };
+        stats.send(stat).await?;
+        pruned_books.push(path);
+    }
+    pruned_books.sort();
+    Ok(pruned_books)
+}
+
+/// Permanently delete everything in the trash directory on the Kobo. Yields whether there was
+/// anything to delete.
+async fn empty_trash(device_dir: &Path, dry_run: bool, stats: &Sender<Statistic>) -> Result<bool> {
+    let trash_dir = device_dir.join(TRASH_DIR_NAME);
+    if !fs::try_exists(&trash_dir).await? {
+        return Ok(false);
+    }
+
+    let (mut count, mut size) = (0, 0);
+    let mut entries = WalkDir::new(&trash_dir);
+    while let Some(entry) = entries.next().await {
+        let entry = entry.map_err(|err| anyhow!(err))?;
+        let metadata = entry.metadata().await?;
+        if metadata.is_file() {
+            count += 1;
+            size += metadata.len();
+        }
+    }
+    if count == 0 {
+        return Ok(false);
+    }
+
+    let (trash_str, size_str) = (path_str(&trash_dir)?, format_size(size));
+    if dry_run {
+        println_async!(
+            "Dry-running; would otherwise empty {trash_str}, deleting {count} files totalling \
+                {size_str}"
+        )
+        .await?;
+    } else {
+        fs::remove_dir_all(&trash_dir)
+            .await
+            .map_err(|err| anyhow!("could not empty {trash_str}: {err}"))?;
+        println_async!("Emptied {trash_str}, deleting {count} files totalling {size_str}").await?;
+    }
+    stats.send(Statistic::EmptiedTrash(count, size)).await?;
+    Ok(true)
+}
+
+/// Audit the Kobo against the books found without changing anything, reporting books missing from
+/// it, books on it that weren't found, and books whose sizes differ between the two, along with
+/// books that changed on it since being synchronised if it has a manifest of them. Books are
+/// matched by the names synchronising would give them, case-folded. Yields whether any
+/// differences were found.
+async fn check_device(
+    device_dir: &Path,
+    options: &SyncOptions,
+    mut found_books: Receiver<FoundBook>,
+    book_finding: JoinHandle<Result<bool>>,
+    stats: Sender<Statistic>,
+) -> Result<bool> {
+    let mut device_books = find_books_on_device(device_dir).await?;
+
+    // Names are planned across the whole set, as duplicates are dropped and colliding books are
+    // renamed or skipped.
+    let mut books = vec![];
+    while let Some(book) = found_books.recv().await {
+        books.push(book);
+    }
+    book_finding.await??;
+    let books = dedupe_books(books, options, &stats).await?;
+    let copies = plan_copies(books, options, &stats).await?;
+
+    let mut missing = vec![];
+    let mut mismatched = vec![];
+    for PlannedCopy { src, dest } in copies {
+        let Some(name) = dest.file_name() else {
+            continue;
+        };
+        let Some(on_device) = device_books.remove(&fold_case(Path::new(name))) else {
+            missing.push(src);
+            continue;
+        };
+
+        // Books that can't be read are left for a real synchronisation to report on.
+        let size = fs::metadata(&src).await.map(|m| m.len()).unwrap_or(0);
+        if on_device
+            .iter()
+            .all(|&(_, device_size)| device_size != size)
+        {
+            let (device_path, device_size) = on_device[0].clone();
+            mismatched.push((src, size, device_path, device_size));
+        }
+    }
+
+    flush_book_messages().await?;
+
+    let mut orphaned: Vec<_> = device_books
+        .into_values()
+        .flatten()
+        .map(|(path, _)| path)
+        .collect();
+    missing.sort();
+    orphaned.sort();
+    mismatched.sort();
+
+    let dest = destination_name();
+    println_always!("Missing on {dest}:").await?;
+    for path in &missing {
+        let path_str = path_str(path)?;
+        println_always!("  {path_str}").await?;
+        stats.send(Statistic::MissingOnDevice).await?;
+    }
+    println_always!("\nOn {dest} but not found in the sources:").await?;
+    for path in &orphaned {
+        let path_str = path_str(path)?;
+        println_always!("  {path_str}").await?;
+        stats.send(Statistic::OrphanedOnDevice).await?;
+    }
+    println_always!("\nDifferent sizes on {dest}:").await?;
+    for (path, size, device_path, device_size) in &mismatched {
+        let (path_str, device_path_str) = (path_str(path)?, path_str(device_path)?);
+        let (size, device_size) = (format_size(*size), format_size(*device_size));
+        println_always!("  {path_str} is {size}, but {device_path_str} is {device_size}").await?;
+        stats.send(Statistic::SizeMismatchOnDevice).await?;
+    }
+
+    // Only books recorded in a manifest on the Kobo can be known to have changed there.
+    let mut changed = vec![];
+    if let Some(manifest) = DeviceManifest::load(device_dir).await? {
+        changed = manifest.find_changed(device_dir).await?;
+        println_always!("\nChanged on {dest} since being synchronised:").await?;
+        for (path, problem) in &changed {
+            let path_str = path_str(path)?;
+            println_always!("  {path_str} {problem}").await?;
+            stats.send(Statistic::ChangedOnDevice).await?;
+        }
+    }
+
+    Ok(!(missing.is_empty() && orphaned.is_empty() && mismatched.is_empty() && changed.is_empty()))
+}
+
+/// What to do with a snapshot of the books on the destination.
+struct InventoryOptions {
+    out: Option<PathBuf>,
+    diff: Option<PathBuf>,
+    hash: bool,
+}
+
+/// Take stock of the books on the destination, saving the snapshot and comparing it with an
+/// earlier one as asked. Yields whether any differences from the earlier one were found.
+async fn take_inventory(device_dir: &Path, options: &InventoryOptions) -> Result<bool> {
+    // The earlier snapshot is read first, in case it's about to be overwritten by the new one.
+    let old = match &options.diff {
+        Some(old_path) => Some(Inventory::load(old_path).await?),
+        None => None,
+    };
+    let inventory = Inventory::take(device_dir, options.hash).await?;
+
+    if let Some(out) = &options.out {
+        inventory.save(out).await?;
+        let out_str = path_str(out)?;
+        println_async!("Wrote an inventory of {} to {out_str}.", destination_name()).await?;
+    }
+
+    let Some(old) = old else {
+        return Ok(false);
+    };
+    let diff = inventory.diff(&old);
+    let dest = destination_name();
+
+    println_always!("Added to {dest}:").await?;
+    for entry in &diff.added {
+        println_always!("  {}", describe_inventory_entry(entry)?).await?;
+    }
+    println_always!("\nRemoved from {dest}:").await?;
+    for entry in &diff.removed {
+        println_always!("  {}", describe_inventory_entry(entry)?).await?;
+    }
+    println_always!("\nModified on {dest}:").await?;
+    for (old_entry, entry) in &diff.modified {
+        let (old_str, new_str) = (
+            describe_inventory_entry(old_entry)?,
+            describe_inventory_entry(entry)?,
+        );
+        println_always!("  {old_str}, now {new_str}").await?;
+    }
+    Ok(!diff.is_empty())
+}
+
+fn describe_inventory_entry(entry: &InventoryEntry) -> Result<String> {
+    let path_str = path_str(&entry.path)?;
+    let size = format_size(entry.size);
+    Ok(match &entry.modified {
+        Some(modified) => format!("{path_str} ({size}, modified {modified})"),
+        None => format!("{path_str} ({size})"),
+    })
+}
+
+/// How found books are synchronised to the destination.
+struct SyncOptions {
+    dry_run: bool,
+    extension_dirs: HashMap<String, PathBuf>,
+    preserve_tree: bool,
+    rename_from_metadata: bool,
+    transliterate: bool,
+    max_name_length: usize,
+    dedupe_content: bool,
+    dedupe_metadata: bool,
+    dedupe_isbn: bool,
+    preferred_formats: Vec<String>,
+    on_collision: CollisionPolicy,
+    max_books: Option<usize>,
+    max_total_size: Option<TotalSizeLimit>,
+    best_effort: bool,
+    retries: u32,
+    file_timeout: Option<Duration>,
+    buffer_size: usize,
+    bandwidth_limit: Option<u64>,
+    preserve_times: bool,
+    validate: bool,
+    deadline: Option<Instant>,
+    fail_fast: bool,
+    update: bool,
+    pull_orphans: Option<PathBuf>,
+    export_annotations: Option<PathBuf>,
+    annotations_format: AnnotationsFormat,
+    collections: bool,
+    covers: bool,
+    pdf_cover_renderer: Option<String>,
+    fail_on_auxiliary_errors: Vec<AuxiliaryFeature>,
+    prune: bool,
+    prune_mode: PruneMode,
+    empty_trash: bool,
+    mirror: bool,
+    json_report: bool,
+    sftp_target: Option<SftpTarget>,
+    pre_hook: Option<String>,
+    post_hook: Option<String>,
+    eject: bool,
+    state: bool,
+    reset_state: bool,
+    device_manifest: bool,
+    copy_books: bool,
+    pick: bool,
+    interactive: bool,
+}
+
+/// Drop books duplicating others by their contents, metadata, or ISBNs, as asked.
+async fn dedupe_books(
+    mut books: Vec<FoundBook>,
+    options: &SyncOptions,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<FoundBook>> {
+    if options.dedupe_content {
+        books = dedupe_by_content(books, stats).await?;
+    }
+    if options.dedupe_metadata {
+        books = dedupe_by_metadata(books, stats).await?;
+    }
+    if options.dedupe_isbn {
+        books = dedupe_by_isbn(books, &options.preferred_formats, stats).await?;
+    }
+    Ok(books)
+}
+
+/// Plan where on the destination each book goes: named from its metadata or made safe for FAT32,
+/// transliterated and shortened as asked, under its extension's directory and the tree it was
+/// found in if preserved, with any that then collide resolved.
+async fn plan_copies(
+    books: Vec<FoundBook>,
+    options: &SyncOptions,
+    stats: &Sender<Statistic>,
+) -> Result<Vec<PlannedCopy>> {
+    let SyncOptions {
+        ref extension_dirs,
+        preserve_tree,
+        rename_from_metadata,
+        transliterate,
+        max_name_length,
+        on_collision,
+        ..
+    } = *options;
+
+    let mut copies = vec![];
+    for book in books {
+        let Some(original_name) = book.path.file_name() else {
+            continue;
+        };
+        let renamed = if rename_from_metadata {
+            metadata_file_name(&book.path).await
+        } else {
+            None
+        };
+        let file_name = match renamed {
+            Some(renamed) => renamed,
+            None => {
+                let original_name = original_name.to_string_lossy();
+                let sanitised = sanitise_fat32_name(&original_name);
+                if sanitised != original_name {
+                    let src_str = path_str(&book.path)?;
+                    println_about_book!(
+                        &book.path,
+                        "Book {src_str} has a name that is invalid on FAT32; will copy it across \
+                            as {sanitised} instead."
+                    )
+                    .await?;
+                    stats.send(Statistic::RenamedForFat32).await?;
+                }
+                sanitised
+            }
+        };
+        let file_name = if transliterate {
+            let transliterated = dest_name(&file_name, true);
+            if transliterated != file_name {
+                let src_str = path_str(&book.path)?;
+                println_about_book!(
+                    &book.path,
+                    "Book {src_str} has a name that is not plain ASCII; will copy it across as \
+                        {transliterated} instead."
+                )
+                .await?;
+                stats.send(Statistic::Transliterated).await?;
+            }
+            transliterated
+        } else {
+            file_name
+        };
+        let file_name = match shorten_name(&file_name, max_name_length) {
+            Some(shortened) => {
+                let src_str = path_str(&book.path)?;
+                println_about_book!(
+                    &book.path,
+                    "Book {src_str} has a name longer than {max_name_length} bytes; will copy it \
+                        across as {shortened} instead."
+                )
+                .await?;
+                stats.send(Statistic::ShortenedForNameLength).await?;
+                shortened
+            }
+            None => file_name,
+        };
+
+        let within_ext_dir = if preserve_tree {
+            match preserved_tree_dest(&book, file_name.as_ref(), transliterate) {
+                Some(dest) => dest,
+                None => continue,
+            }
+        } else {
+            PathBuf::from(file_name)
+        };
+
+        let ext = book
+            .path
+            .extension()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .to_lowercase();
+        let dest = match extension_dirs.get(&ext) {
+            Some(ext_dir) => ext_dir.join(within_ext_dir),
+            None => within_ext_dir,
+        };
+
+        copies.push(PlannedCopy {
+            src: book.path,
+            dest,
+        });
+    }
+    let copies = resolve_collisions(copies, on_collision, transliterate, stats).await?;
+    Ok(copies)
+}
+
+/// Synchronise found books to the destination, yielding whether any were copied, or would have
+/// been when dry-running.
+async fn sync_books(
+    dest_dir: &Path,
+    options: &SyncOptions,
+    mut books_to_sync: Receiver<FoundBook>,
+    book_finding: JoinHandle<Result<bool>>,
+    stats: Sender<Statistic>,
+) -> Result<bool> {
+    let SyncOptions {
+        dry_run,
+        // Which books go where on the destination is decided from the options by `dedupe_books`
+        // and `plan_copies`.
+        extension_dirs: _,
+        preserve_tree: _,
+        rename_from_metadata: _,
+        transliterate: _,
+        max_name_length: _,
+        dedupe_content: _,
+        dedupe_metadata: _,
+        dedupe_isbn: _,
+        preferred_formats: _,
+        on_collision: _,
+        max_books,
+        max_total_size,
+        best_effort,
+        retries,
+        file_timeout,
+        buffer_size,
+        bandwidth_limit,
+        preserve_times,
+        validate,
+        deadline,
+        fail_fast,
+        update,
+        ref pull_orphans,
+        ref export_annotations,
+        annotations_format,
+        collections,
+        covers,
+        ref pdf_cover_renderer,
+        // Whether auxiliary failures fail the run is decided from the report afterwards.
+        fail_on_auxiliary_errors: _,
+        prune,
+        prune_mode,
+        empty_trash: should_empty_trash,
+        mirror,
+        json_report,
+        ref sftp_target,
+        // Hooks and ejecting happen around the whole run rather than in the synchronisation.
+        pre_hook: _,
+        post_hook: _,
+        eject: _,
+        state,
+        reset_state,
+        device_manifest,
+        copy_books,
+        pick,
+        interactive,
+    } = *options;
+
+    // Gather every book before copying any of them, so that decisions can be made across the
+    // whole set.
+    let mut books = vec![];
+    while let Some(book) = books_to_sync.recv().await {
+        books.push(book);
+    }
+    let sources_complete = book_finding.await??;
+
+    let books = dedupe_books(books, options, &stats).await?;
+
+    // Books found at the top of a documents directory, or listed explicitly, belong to no
+    // collection.
+    let collections_by_src: HashMap<PathBuf, String> = if collections {
+        books
+            .iter()
+            .filter_map(|book| {
+                let dir = book.relative_path.parent()?.file_name()?;
+                Some((book.path.clone(), dir.to_string_lossy().into_owned()))
+            })
+            .collect()
+    } else {
+        HashMap::new()
+    };
+
+    let copies = plan_copies(books, options, &stats).await?;
+    let synced_names: HashSet<_> = copies
+        .iter()
+        .filter_map(|copy| copy.dest.file_name())
+        .map(|name| fold_case(Path::new(name)))
+        .collect();
+
+    // The `prune` and `pull` subcommands still need to know which books belong on the destination,
+    // but copy none of them.
+    let copies = if copy_books { copies } else { vec![] };
+
+    // Books unchanged since they were last synchronised are taken to still be on the destination,
+    // without looking for them there.
+    let mut sync_state = if state {
+        Some(SyncState::load(dest_dir, reset_state).await?)
+    } else {
+        None
+    };
+    let copies = match &sync_state {
+        Some(sync_state) => {
+            let mut changed = vec![];
+            for copy in copies {
+                if sync_state.is_unchanged(&copy.src, &copy.dest).await {
+                    report_unchanged(&copy.src, &stats).await?;
+                } else {
+                    changed.push(copy);
+                }
+            }
+            changed
+        }
+        None => copies,
+    };
+
+    // Servers can't be checked against a manifest without downloading their books.
+    let mut manifest = match sftp_target {
+        Some(_) => None,
+        None => DeviceManifest::load(dest_dir).await?,
+    };
+    if device_manifest && manifest.is_none() {
+        manifest = Some(DeviceManifest::default());
+    }
+    // Without a manifest recording anything yet, there's no telling who put the books already on
+    // the destination there, rather than them all being put there by other means. Those matching
+    // their books are recorded instead, seeding the manifest.
+    let seeding_manifest = manifest.as_ref().is_some_and(DeviceManifest::is_empty);
+
+    let existing_dests = match sftp_target {
+        // Directories are created on the server as books are copied into them.
+        Some(target) => {
+            let dirs = copies
+                .iter()
+                .map(|copy| copy.dest.parent().unwrap_or(Path::new("")))
+                .collect();
+            target.list_existing(dirs).await?
+        }
+        None => {
+            create_dest_dirs(dest_dir, &copies, dry_run).await?;
+            list_existing_dests(dest_dir, &copies).await?
+        }
+    };
+
+    let copies = if pick {
+        pick_copies(dest_dir, copies, &existing_dests, &stats).await?
+    } else {
+        copies
+    };
+
+    let mut new_copies = vec![];
+    let mut updates = vec![];
+    for copy in copies {
+        if existing_dests.contains(&fold_case(&copy.dest)) {
+            let dest_path = dest_dir.join(&copy.dest);
+            if update && is_outdated(&copy.src, &dest_path).await {
+                updates.push(copy);
+            } else if !seeding_manifest
+                && manifest
+                    .as_ref()
+                    .is_some_and(|manifest| !manifest.contains(&copy.dest))
+            {
+                report_other_book_existing(&copy.src, &dest_path, &stats).await?;
+            } else {
+                report_already_existing(&copy.src, &dest_path, &stats).await?;
+                if let Some(sync_state) = &mut sync_state {
+                    sync_state.record(&copy.src, &copy.dest).await;
+                }
+                if let (Some(manifest), true) = (&mut manifest, seeding_manifest) {
+                    if !is_outdated(&copy.src, &dest_path).await {
+                        manifest.record(&copy.src, &copy.dest).await;
+                    }
+                }
+            }
+        } else {
+            new_copies.push(copy);
+        }
+    }
+
+    if let Some(max_books) = max_books {
+        new_copies = keep_newest(new_copies, max_books, &stats).await?;
+    }
+    if let Some(max_total_size) = max_total_size {
+        new_copies = keep_within_total_size(dest_dir, new_copies, max_total_size, &stats).await?;
+    }
+
+    // Every book is asked about before any are copied, so that the questions don't interleave with
+    // the messages of copies under way.
+    let mut confirmation = interactive.then(Confirmation::new);
+    if let Some(confirmation) = &mut confirmation {
+        new_copies = confirm_copies(confirmation, dest_dir, new_copies, false, &stats).await?;
+        updates = confirm_copies(confirmation, dest_dir, updates, true, &stats).await?;
+    }
+
+    // The free space on a server can't be determined through `sftp`.
+    if sftp_target.is_none() {
+        check_free_space(dest_dir, &new_copies, dry_run, best_effort).await?;
+    }
+
+    let mut copy_tasks = vec![];
+    let mut dry_run_copies = vec![];
+    let mut dry_run_updates = vec![];
+
+    let mut collection_entries = vec![];
+    let mut copied = vec![];
+
+    let policy = CopyPolicy {
+        retries,
+        file_timeout,
+        buffer_size,
+        bandwidth_limit,
+        preserve_times,
+        validate,
+        deadline,
+    };
+    let copier = Copier::new(policy);
+    let planned_copies = new_copies.len() + updates.len();
+    let copying_started = Instant::now();
+    let mut disconnection = DisconnectionDetector::default();
+    let mut timed_out = false;
+    // Under `--fail-fast`, the first book that couldn't be copied and why.
+    let mut first_failure = None;
+
+    for PlannedCopy { src, dest } in new_copies {
+        if first_failure.is_some() {
+            break;
+        }
+        if has_passed(deadline) {
+            timed_out = true;
+            report_timed_out(&src, &stats).await?;
+            continue;
+        }
+        let dest_path = dest_dir.join(&dest);
+        if let Some(collection) = collections_by_src.get(&src) {
+            collection_entries.push(CollectionEntry::new(collection.clone(), &dest));
+        }
+
+        if dry_run {
+            dry_run_copies.push(report_dry_run_copy(&src, &dest_path, false).await?);
+            stats.send(Statistic::Copied).await?;
+            continue;
+        }
+
+        // Uploads happen one at a time, each over its own connection.
+        if let Some(target) = sftp_target {
+            let (src_str, dest_str) = (path_str(&src)?, path_str(&dest_path)?);
+            match target.copy(&src, &dest).await {
+                Ok(()) => {
+                    println_copied_book!(&src, "Copied {src_str} to {dest_str}"; dest = dest_str)
+                        .await?;
+                    stats.send(Statistic::Copied).await?;
+                    if let Some(sync_state) = &mut sync_state {
+                        sync_state.record(&src, &dest).await;
+                    }
+                }
+                Err(err) => {
+                    report_failed_copy(&src, &dest_path, false, &err, &stats).await?;
+                    if fail_fast {
+                        first_failure = Some((src, err));
+                    }
+                }
+            }
+            continue;
+        }
+
+        match copier.spawn_copy(&src, &dest_path, CopyKind::New, &stats) {
+            Ok(copy_task) => copy_tasks.push((copy_task, PlannedCopy { src, dest }, false)),
+            Err(err) => report_failed_copy(&src, &dest_path, false, &err, &stats).await?,
+        }
+    }
+
+    for PlannedCopy { src, dest } in updates {
+        if first_failure.is_some() {
+            break;
+        }
+        if has_passed(deadline) {
+            timed_out = true;
+            report_timed_out(&src, &stats).await?;
+            continue;
+        }
+        let dest_path = dest_dir.join(&dest);
+
+        if dry_run {
+            dry_run_updates.push(report_dry_run_copy(&src, &dest_path, true).await?);
+            stats.send(Statistic::Updated).await?;
+            continue;
+        }
+
+        match copier.spawn_copy(&src, &dest_path, CopyKind::Replacement, &stats) {
+            Ok(copy_task) => copy_tasks.push((copy_task, PlannedCopy { src, dest }, true)),
+            Err(err) => report_failed_copy(&src, &dest_path, true, &err, &stats).await?,
+        }
+    }
+
+    // Every copy is waited for, so that those failing or stopped can clean up after themselves.
+    // Books only count as copied once they have been.
+    let any_copied = !copy_tasks.is_empty();
+    let mut completed_copies = 0;
+    for (task, copy, updating) in copy_tasks {
+        let dest_path = dest_dir.join(&copy.dest);
+        match task.await? {
+            Ok(()) => {
+                disconnection.succeeded();
+                completed_copies += 1;
+                let stat = if updating {
+                    Statistic::Updated
+                } else {
+                    Statistic::Copied
+                };
+                stats.send(stat).await?;
+                if let Some(sync_state) = &mut sync_state {
+                    sync_state.record(&copy.src, &copy.dest).await;
+                }
+                if let Some(manifest) = &mut manifest {
+                    manifest.record(&copy.src, &copy.dest).await;
+                }
+                copied.push(copy);
+            }
+            Err(err) => match err.downcast_ref::<CopyingStopped>() {
+                Some(CopyingStopped::TimedOut) => {
+                    timed_out = true;
+                    report_timed_out(&copy.src, &stats).await?;
+                }
+                Some(CopyingStopped::Stopped) => {}
+                None if !updating && is_already_existing(&err) => {
+                    report_already_existing(&copy.src, &dest_path, &stats).await?;
+                }
+                // The copies under way when the destination went fail too, which the error for
+                // its disconnection already explains.
+                None if disconnection.disconnected => {}
+                None => {
+                    // Copies yet to start are stopped, and those under way abandoned, rather than
+                    // each failing against a destination that has gone.
+                    if disconnection.failed(dest_dir, &err).await {
+                        copier.stop();
+                    }
+                    report_failed_copy(&copy.src, &dest_path, updating, &err, &stats).await?;
+                    if fail_fast && first_failure.is_none() {
+                        copier.stop();
+                        first_failure = Some((copy.src, err));
+                    }
+                }
+            },
+        }
+    }
+    if any_copied {
+        let took = copying_started.elapsed();
+        stats.send(Statistic::CopyingTook(took)).await?;
+    }
+    // Books copied before stopping early are remembered too.
+    if let (Some(sync_state), false) = (&sync_state, dry_run) {
+        sync_state.save().await?;
+    }
+    if let (Some(manifest), false) = (&manifest, dry_run) {
+        manifest.save(dest_dir).await?;
+    }
+    if let Some((src, err)) = first_failure {
+        flush_book_messages().await?;
+        let src_str = path_str(&src)?;
+        return Err(anyhow!(
+            "Stopped, as {src_str} could not be copied and --fail-fast was given: {err}"
+        ));
+    }
+    if disconnection.disconnected || timed_out {
+        flush_book_messages().await?;
+        let reason = if timed_out {
+            "the --timeout passed".to_owned()
+        } else {
+            format!("{} appears to have been disconnected", destination_name())
+        };
+        return Err(anyhow!(
+            "Stopped after copying {completed_copies} of {planned_copies} books, as {reason}"
+        ));
+    }
+
+    // Covers are decoded and scaled, which is too much to do for a dry run.
+    if covers && !dry_run {
+        generate_covers(dest_dir, &copied, pdf_cover_renderer.as_deref(), &stats).await?;
+    }
+
+    if collections {
+        add_books_to_collections(dest_dir, collection_entries, dry_run, &stats).await?;
+    }
+
+    if let Some(export_dir) = export_annotations {
+        export_annotations_from_device(dest_dir, export_dir, annotations_format, dry_run, &stats)
+            .await?;
+    }
+
+    // Books only on the Kobo are pulled back before any of them could be pruned.
+    let any_pulled = match pull_orphans {
+        Some(pull_dir) => {
+            pull_orphans_from_device(dest_dir, &synced_names, pull_dir, dry_run, policy, &stats)
+                .await?
+        }
+        None => false,
+    };
+
+    // Books are only got rid of once those replacing them are in place. The trash is emptied
+    // before pruning, so that books pruned in this run can still be recovered afterwards.
+    let mut any_pruned = false;
+    if should_empty_trash {
+        any_pruned = empty_trash(dest_dir, dry_run, &stats).await?;
+    }
+    let quitting = confirmation
+        .as_ref()
+        .is_some_and(|confirmation| confirmation.quitting);
+    let pruned_books = if prune && !quitting {
+        prune_device(
+            dest_dir,
+            &synced_names,
+            sources_complete,
+            prune_mode,
+            dry_run,
+            confirmation.as_mut(),
+            &stats,
+        )
+        .await?
+    } else {
+        vec![]
+    };
+    any_pruned |= !pruned_books.is_empty();
+    if let (Some(manifest), false, true) = (&mut manifest, dry_run, !pruned_books.is_empty()) {
+        for book in &pruned_books {
+            manifest.remove(book.strip_prefix(dest_dir)?);
+        }
+        manifest.save(dest_dir).await?;
+    }
+    flush_book_messages().await?;
+
+    if dry_run {
+        if mirror {
+            print_mirror_plan(&dry_run_copies, &dry_run_updates, &pruned_books).await?;
+        }
+
+        let total_books = dry_run_copies.len() + dry_run_updates.len();
+        let total_size = dry_run_copies
+            .iter()
+            .chain(&dry_run_updates)
+            .map(|copy| copy.size)
+            .sum();
+        println_async!(
+            "Dry-running; would otherwise copy {total_books} books totalling {}.",
+            format_size(total_size)
+        )
+        .await?;
+
+        if json_report {
+            let plan = DryRunReport {
+                version: VERSION,
+                books: dry_run_copies,
+                updated: dry_run_updates,
+                pruned: pruned_books,
+                skipped: vec![],
+                failed: vec![],
+                total_books,
+                total_size,
+                picked: pick,
+            };
+            stats.send(Statistic::PlannedDryRun(Box::new(plan))).await?;
+        }
+        return Ok(any_pulled || any_pruned || 0 < total_books);
+    }
+
+    Ok(any_pulled || any_pruned || any_copied)
+}
+
+/// Lay out what a dry run of `--mirror` would do to the Kobo, grouping the books to be added,
+/// updated, and removed.
+async fn print_mirror_plan(
+    additions: &[DryRunCopy],
+    updates: &[DryRunCopy],
+    removals: &[PathBuf],
+) -> Result<()> {
+    let dest = destination_name();
+    for (heading, copies) in [("Would add to", additions), ("\nWould update on", updates)] {
+        println_async!("{heading} {dest}:").await?;
+        for DryRunCopy { src, dest, .. } in copies {
+            let (src_str, dest_str) = (path_str(src)?, path_str(dest)?);
+            println_async!("  {dest_str} from {src_str}").await?;
+        }
+    }
+
+    println_async!("\nWould remove from {dest}:").await?;
+    for path in removals {
+        let path_str = path_str(path)?;
+        println_async!("  {path_str}").await?;
+    }
+    println_async!("").await?;
+    Ok(())
+}
+
+/// Describe where books are being found, for the statistics.
+fn describe_book_sources(documents_dirs: &[PathBuf], book_list: Option<&Path>) -> Result<String> {
+    if let Some(book_list) = book_list {
+        return Ok(if book_list == Path::new(BOOK_LIST_FROM_STDIN) {
+            "book list from standard input".to_owned()
+        } else {
+            format!("book list at {}", path_str(book_list)?)
+        });
+    }
+
+    let len = documents_dirs.len();
+    let dirs_str: String =
+        documents_dirs
+            .iter()
+            .zip(1..)
+            .try_fold(String::new(), |mut s, (dir, i)| {
+                s.push_str(path_str(dir)?);
+                if i < len {
+                    s.push_str(" and ");
+                }
+                Ok::<String, Error>(s)
+            })?;
+    Ok(format!("documents directory at {dirs_str}"))
+}
+
+/// A feature that does something besides copying books. What each amounts to is accounted for
+/// apart from the books, and its failures are only warned about unless
+/// `--fail-on-auxiliary-errors` names it, as the books are synchronised regardless.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord, ValueEnum)]
+enum AuxiliaryFeature {
+    /// Exporting annotations, with `--export-annotations`.
+    Annotations,
+
+    /// Adding books to collections, with `--collections`.
+    Collections,
+
+    /// Generating covers, with `--covers`.
+    Covers,
+}
+
+impl AuxiliaryFeature {
+    /// The heading its statistics are shown under, and the name of its section in JSON.
+    fn section(self) -> (&'static str, &'static str) {
+        match self {
+            Self::Annotations => ("Annotations exported from the Kobo", "annotations"),
+            Self::Collections => ("Collections on the Kobo", "collections"),
+            Self::Covers => ("Covers generated on the Kobo", "covers"),
+        }
+    }
+
+    /// The key and description of what succeeded, followed by those of what failed.
+    fn statistics(self) -> [(&'static str, &'static str); 2] {
+        match self {
+            Self::Annotations => [
+                ("exported_annotations", "Books with annotations exported"),
+                (
+                    "failed_annotation_exports",
+                    "Failures exporting annotations",
+                ),
+            ],
+            Self::Collections => [
+                ("added_to_collections", "Books added to collections"),
+                (
+                    "failed_collection_updates",
+                    "Failures adding books to collections",
+                ),
+            ],
+            Self::Covers => [
+                ("generated_covers", "Covers generated"),
+                ("failed_covers", "Failures generating covers"),
+            ],
+        }
+    }
+}
+
+/// What a feature besides copying books amounted to in a run.
+#[derive(Clone, Copy, Debug, Default)]
+struct AuxiliaryTally {
+    succeeded: usize,
+    failed: usize,
+}
+
+/// What a run amounted to, as given to the post-hook.
+#[derive(Clone, Copy, Debug, Default)]
+struct SyncTotals {
+    copied: usize,
+    skipped: usize,
+    errors: usize,
+    /// Failures of features besides copying books, which aren't counted among the errors.
+    auxiliary_errors: usize,
+}
+
+impl SyncTotals {
+    fn hook_env(self, dry_run: bool) -> [(&'static str, String); 5] {
+        [
+            ("SYNC_COPIED", self.copied.to_string()),
+            ("SYNC_SKIPPED", self.skipped.to_string()),
+            ("SYNC_ERRORS", self.errors.to_string()),
+            ("SYNC_AUXILIARY_ERRORS", self.auxiliary_errors.to_string()),
+            ("SYNC_DRY_RUN", dry_run.to_string()),
+        ]
+    }
+}
+
+/// Everything a run amounted to, gathered from its statistics, from which the statistics shown,
+/// the exit status, and the post-hook's environment are all derived.
+#[derive(Default)]
+struct Report {
+    /// How many books of each extension were found in each documents directory or book list.
+    found_by_source: BTreeMap<PathBuf, BTreeMap<String, usize>>,
+    nested_documents_directories: usize,
+    invalid_listed_books: usize,
+    ignored_macos_metadata: usize,
+    pruned_dirs: usize,
+    sync_ignored: usize,
+    skipped_for_permissions: usize,
+    filtered_out_by_name: usize,
+    filtered_out_by_regex: usize,
+    skipped_for_size: usize,
+    skipped_empty_files: usize,
+    modified_before_since: usize,
+    duplicate_source_files: usize,
+    duplicate_content: usize,
+    duplicate_metadata: usize,
+    duplicate_isbn: usize,
+    renamed_for_collision: usize,
+    skipped_for_collision: usize,
+    renamed_for_fat32: usize,
+    transliterated: usize,
+    shortened_for_name_length: usize,
+    not_copied: usize,
+    not_copied_for_other_books: usize,
+    unchanged_since_last_sync: usize,
+    not_picked: usize,
+    declined_interactively: usize,
+    missing_on_device: usize,
+    orphaned_on_device: usize,
+    size_mismatches_on_device: usize,
+    changed_on_device: usize,
+    cut_off_by_max_books: usize,
+    deferred_by_max_total_size: usize,
+    deferred_size: u64,
+    not_copied_before_timeout: usize,
+    failed_to_copy: usize,
+    failed_validation: usize,
+    retried_copies: usize,
+    transferred: u64,
+    copying_took: Duration,
+    copied: usize,
+    updated: usize,
+    pulled_from_device: usize,
+    /// What each feature besides copying books amounted to, kept apart from the books.
+    auxiliary: BTreeMap<AuxiliaryFeature, AuxiliaryTally>,
+    trashed_on_device: usize,
+    trashed_size: u64,
+    removed_from_device: usize,
+    failed_to_prune: usize,
+    emptied_from_trash: usize,
+    emptied_size: u64,
+    /// How long the run took, from the books starting to be found to the last being dealt with.
+    took: Duration,
+    /// Why books were skipped, only kept when a JSON report will be written.
+    skipped: Vec<SkippedBook>,
+    failed: Vec<FailedBook>,
+    dry_run_plan: Option<DryRunReport>,
+}
+
+impl Report {
+    fn record(&mut self, stat: Statistic) {
+        use Statistic::*;
+        match stat {
+            SkippedNestedDocumentsDirectory => {
+                self.nested_documents_directories += 1;
+            }
+            FoundSrcDocument { source, extension } => {
+                *self
+                    .found_by_source
+                    .entry(source)
+                    .or_default()
+                    .entry(extension)
+                    .or_default() += 1;
+            }
+            InvalidListedBook => {
+                self.invalid_listed_books += 1;
+            }
+            IgnoredMacOSMetadataFile => {
+                self.ignored_macos_metadata += 1;
+            }
+            PrunedDirectories(count) => {
+                self.pruned_dirs += count;
+            }
+            IgnoredBySyncIgnore(count) => {
+                self.sync_ignored += count;
+            }
+            SkippedForPermissions => {
+                self.skipped_for_permissions += 1;
+            }
+            FilteredOutByName => {
+                self.filtered_out_by_name += 1;
+            }
+            FilteredOutByRegex => {
+                self.filtered_out_by_regex += 1;
+            }
+            SkippedForSize => {
+                self.skipped_for_size += 1;
+            }
+            SkippedEmptyFile => {
+                self.skipped_empty_files += 1;
+            }
+            SkippedAsModifiedBeforeSince => {
+                self.modified_before_since += 1;
+            }
+            SkippedDuplicateSourceFile => {
+                self.duplicate_source_files += 1;
+            }
+            SkippedDuplicateContent => {
+                self.duplicate_content += 1;
+            }
+            SkippedDuplicateMetadata => {
+                self.duplicate_metadata += 1;
+            }
+            SkippedDuplicateIsbn => {
+                self.duplicate_isbn += 1;
+            }
+            RenamedForNameCollision => {
+                self.renamed_for_collision += 1;
+            }
+            SkippedForNameCollision => {
+                self.skipped_for_collision += 1;
+            }
+            RenamedForFat32 => {
+                self.renamed_for_fat32 += 1;
+            }
+            Transliterated => {
+                self.transliterated += 1;
+            }
+            ShortenedForNameLength => {
+                self.shortened_for_name_length += 1;
+            }
+            NotCopiedBecauseAlreadyExistedAtDest => {
+                self.not_copied += 1;
+            }
+            NotCopiedBecauseOtherBookAtDest => {
+                self.not_copied_for_other_books += 1;
+            }
+            UnchangedSinceLastSync => {
+                self.unchanged_since_last_sync += 1;
+            }
+            NotPicked => {
+                self.not_picked += 1;
+            }
+            DeclinedInteractively => {
+                self.declined_interactively += 1;
+            }
+            MissingOnDevice => {
+                self.missing_on_device += 1;
+            }
+            OrphanedOnDevice => {
+                self.orphaned_on_device += 1;
+            }
+            SizeMismatchOnDevice => {
+                self.size_mismatches_on_device += 1;
+            }
+            ChangedOnDevice => {
+                self.changed_on_device += 1;
+            }
+            CutOffByMaxBooks(count) => {
+                self.cut_off_by_max_books += count;
+            }
+            DeferredByMaxTotalSize(count, size) => {
+                self.deferred_by_max_total_size += count;
+                self.deferred_size += size;
+            }
+            NotCopiedBeforeTimeout => {
+                self.not_copied_before_timeout += 1;
+            }
+            FailedToCopy => {
+                self.failed_to_copy += 1;
+            }
+            FailedValidation => {
+                self.failed_validation += 1;
+            }
+            RetriedCopy => {
+                self.retried_copies += 1;
+            }
+            Transferred(size) => {
+                self.transferred += size;
+            }
+            CopyingTook(took) => {
+                self.copying_took += took;
+            }
+            Copied => {
+                self.copied += 1;
+            }
+            Updated => {
+                self.updated += 1;
+            }
+            PulledFromDevice => {
+                self.pulled_from_device += 1;
+            }
+            AuxiliarySucceeded(feature, count) => {
+                self.auxiliary.entry(feature).or_default().succeeded += count;
+            }
+            AuxiliaryFailed(feature) => {
+                self.auxiliary.entry(feature).or_default().failed += 1;
+            }
+            TrashedOnDevice(size) => {
+                self.trashed_on_device += 1;
+                self.trashed_size += size;
+            }
+            RemovedFromDevice => {
+                self.removed_from_device += 1;
+            }
+            FailedToPrune => {
+                self.failed_to_prune += 1;
+            }
+            EmptiedTrash(count, size) => {
+                self.emptied_from_trash += count;
+                self.emptied_size += size;
+            }
+            Skipped(skipped) => {
+                self.skipped.push(skipped);
+            }
+            Failed(failed) => {
+                self.failed.push(failed);
+            }
+            PlannedDryRun(plan) => {
+                self.dry_run_plan = Some(*plan);
+            }
+        }
+    }
+
+    /// Write what a dry run would have done as JSON, along with the books it would have skipped
+    /// and those it couldn't read, if it was asked for.
+    async fn write_dry_run_plan(&mut self) -> Result<()> {
+        if let Some(mut plan) = self.dry_run_plan.take() {
+            plan.skipped = std::mem::take(&mut self.skipped);
+            // The failures are left in place to be summarised at the end.
+            plan.failed = self.failed.clone();
+            let mut json = serde_json::to_string_pretty(&plan)?;
+            json.push('\n');
+            stdout().write_all(json.as_bytes()).await?;
+        }
+        Ok(())
+    }
+
+    /// How many books were found across every source.
+    fn found(&self) -> usize {
+        self.found_by_source
+            .values()
+            .flat_map(BTreeMap::values)
+            .sum()
+    }
+
+    fn totals(&self) -> SyncTotals {
+        SyncTotals {
+            copied: self.copied + self.updated,
+            skipped: self.not_copied
+                + self.not_copied_for_other_books
+                + self.unchanged_since_last_sync
+                + self.not_picked
+                + self.declined_interactively
+                + self.filtered_out_by_name
+                + self.filtered_out_by_regex
+                + self.skipped_for_size
+                + self.skipped_empty_files
+                + self.modified_before_since
+                + self.duplicate_content
+                + self.duplicate_metadata
+                + self.duplicate_isbn
+                + self.skipped_for_collision
+                + self.cut_off_by_max_books
+                + self.deferred_by_max_total_size
+                + self.not_copied_before_timeout,
+            errors: self.failed_to_copy
+                + self.failed_validation
+                + self.invalid_listed_books
+                + self.failed_to_prune,
+            auxiliary_errors: self.auxiliary.values().map(|tally| tally.failed).sum(),
+        }
+    }
+
+    /// How the run ended, given whether changes are pending. Failures of features besides copying
+    /// books only fail the run when they are among `failing_auxiliary_features`.
+    fn outcome(
+        &self,
+        changes_pending: bool,
+        failing_auxiliary_features: &[AuxiliaryFeature],
+    ) -> RunOutcome {
+        let auxiliary_errors: usize = failing_auxiliary_features
+            .iter()
+            .filter_map(|feature| self.auxiliary.get(feature))
+            .map(|tally| tally.failed)
+            .sum();
+        if 0 < self.totals().errors + auxiliary_errors {
+            RunOutcome::PartlyFailed
+        } else if changes_pending {
+            RunOutcome::ChangesPending
+        } else {
+            RunOutcome::Succeeded
+        }
+    }
+}
+
+/// Describe how many books of each format were found, such as `40 EPUBs and 120 PDFs`.
+fn describe_format_counts(by_extension: &BTreeMap<String, usize>) -> String {
+    let counts: Vec<_> = by_extension
+        .iter()
+        .map(|(extension, count)| {
+            let plural = if *count == 1 { "" } else { "s" };
+            format!("{count} {}{plural}", extension.to_uppercase())
+        })
+        .collect();
+    match counts.split_last() {
+        Some((last, [])) => last.clone(),
+        Some((last, rest)) => format!("{} and {last}", rest.join(", ")),
+        None => "none".to_owned(),
+    }
+}
+
+/// Gather the statistics sent until every sender is gone into a report of the run. The reasons
+/// for skipping books are only kept if they'll be reported, as libraries can be large.
+async fn collect_stats(mut stats: Receiver<Statistic>, record_skips: bool) -> Result<Report> {
+    let started = Instant::now();
+    let mut report = Report::default();
+    while let Some(stat) = stats.recv().await {
+        if record_skips || !matches!(stat, Statistic::Skipped(_)) {
+            report.record(stat);
+        }
+    }
+    report.took = started.elapsed();
+    Ok(report)
+}
+
+/// The value of a statistic shown at the end of a run.
+enum StatisticValue {
+    Count(usize),
+    /// How many books, and how large they are in total.
+    CountAndSize(usize, u64),
+    /// How many books of each format were found in a source.
+    ByFormat {
+        source: String,
+        by_extension: BTreeMap<String, usize>,
+    },
+    /// How many bytes were copied, and how long copying took.
+    Rate(u64, Duration),
+    Duration(Duration),
+}
+
+impl StatisticValue {
+    fn is_zero(&self) -> bool {
+        match *self {
+            StatisticValue::Count(count) | StatisticValue::CountAndSize(count, _) => count == 0,
+            StatisticValue::ByFormat {
+                ref by_extension, ..
+            } => by_extension.is_empty(),
+            StatisticValue::Rate(transferred, _) => transferred == 0,
+            StatisticValue::Duration(_) => false,
+        }
+    }
+}
+
+impl StatisticValue {
+    /// The attributes of a statistic's JSON record, with the same keys as other records use, such
+    /// as `bytes` for sizes and `duration` for seconds taken.
+    fn attrs(&self) -> LogAttrs {
+        match *self {
+            StatisticValue::Count(count) => log_attrs!(count = count),
+            StatisticValue::CountAndSize(count, size) => log_attrs!(count = count, bytes = size),
+            StatisticValue::ByFormat {
+                ref source,
+                ref by_extension,
+            } => log_attrs!(source = source, formats = by_extension),
+            StatisticValue::Rate(transferred, took) => {
+                log_attrs!(bytes = transferred, duration = took.as_secs_f64())
+            }
+            StatisticValue::Duration(took) => log_attrs!(duration = took.as_secs_f64()),
+        }
+    }
+}
+
+impl Display for StatisticValue {
+    fn fmt(&self, f: &mut Formatter<'_>) -> fmt::Result {
+        match *self {
+            StatisticValue::Count(count) => write!(f, "{count}"),
+            StatisticValue::CountAndSize(count, size) => {
+                write!(f, "{count} ({})", format_size(size))
+            }
+            StatisticValue::ByFormat {
+                ref by_extension, ..
+            } => write!(f, "{}", describe_format_counts(by_extension)),
+            StatisticValue::Rate(transferred, took) => {
+                let rate = if took.is_zero() {
+                    0
+                } else {
+                    (transferred as f64 / took.as_secs_f64()) as u64
+                };
+                let (rate, transferred) = (format_size(rate), format_size(transferred));
+                write!(f, "{rate}/s ({transferred} in total)")
+            }
+            StatisticValue::Duration(took) => {
+                let took = Duration::from_millis(took.as_millis() as u64);
+                write!(f, "{}", humantime::format_duration(took))
+            }
+        }
+    }
+}
+
+/// A statistic shown at the end of a run, named by `key` in its JSON record.
+struct ShownStatistic {
+    key: &'static str,
+    description: String,
+    value: StatisticValue,
+    /// The heading of the section it's shown under and its name in JSON, for the statistics of
+    /// features besides copying books.
+    section: Option<(&'static str, &'static str)>,
+}
+
+/// The statistics shown at the end of a run, in the order shown.
+#[derive(Default)]
+struct Statistics {
+    shown: Vec<ShownStatistic>,
+    section: Option<(&'static str, &'static str)>,
+}
+
+impl Statistics {
+    /// Show a statistic if anything happened for it, or regardless if `always`.
+    fn show(
+        &mut self,
+        always: bool,
+        key: &'static str,
+        description: impl Into<String>,
+        value: StatisticValue,
+    ) {
+        if always || !value.is_zero() {
+            self.shown.push(ShownStatistic {
+                key,
+                description: description.into(),
+                value,
+                section: self.section,
+            });
+        }
+    }
+
+    /// Show the statistics from here on under a heading of their own.
+    fn start_section(&mut self, section: (&'static str, &'static str)) {
+        self.section = Some(section);
+    }
+
+    /// The statistics as lines of text, each starting with a newline, with those in sections
+    /// indented beneath their headings.
+    fn to_text(&self) -> String {
+        let mut text = String::new();
+        let mut section = None;
+        for statistic in &self.shown {
+            if statistic.section != section {
+                section = statistic.section;
+                if let Some((heading, _)) = section {
+                    text.push_str(&format!("\n\n{heading}:"));
+                }
+            }
+            let indent = if section.is_some() { "  " } else { "" };
+            let ShownStatistic {
+                description, value, ..
+            } = statistic;
+            text.push_str(&format!("\n{indent}{description}: {value}"));
+        }
+        text
+    }
+}
+
+/// Show the statistics of a run, followed by a summary of the books that couldn't be copied. Only
+/// those worth knowing are shown: how many books were found, copied, and couldn't be copied, or
+/// checked under `--check`, and any others that happened at all.
+async fn print_report(report: &Report, sources_str: &str, mode: Mode) -> Result<()> {
+    let dest = destination_name();
+
+    // Under `--quiet`, such as from cron, a line is enough to see that a run happened and how it
+    // went.
+    if verbosity() == Verbosity::Quiet {
+        let SyncTotals {
+            copied,
+            skipped,
+            errors,
+            ..
+        } = report.totals();
+        let msg = format!(
+            "Copied {copied} books to {dest}, skipped {skipped}, and could not copy or read \
+                {errors}."
+        );
+        let attrs = log_attrs!(copied = copied, skipped = skipped, errors = errors);
+        write_record(Verbosity::Quiet, Style::Bold, msg, attrs).await?;
+        summarise_failures(&report.failed).await?;
+        return Ok(());
+    }
+
+    let statistics = gather_statistics(report, sources_str, mode)?;
+    if LOG_AS_JSON.load(Ordering::Relaxed) {
+        // Each statistic gets a record of its own, named by its key and with its values as numbers.
+        for ShownStatistic {
+            key,
+            description,
+            value,
+            section,
+        } in statistics.shown
+        {
+            let mut attrs = log_attrs!(statistic = key);
+            if let Some((_, name)) = section {
+                attrs.extend(log_attrs!(section = name));
+            }
+            attrs.extend(value.attrs());
+            write_record(Verbosity::Normal, Style::Plain, description, attrs).await?;
+        }
+    } else {
+        write_message(Verbosity::Normal, Style::Bold, statistics.to_text()).await?;
+    }
+    summarise_failures(&report.failed).await?;
+    Ok(())
+}
+
+/// The statistics worth showing for a run: how many books were found, copied, and couldn't be
+/// copied, or checked under `--check`, and any others that happened at all.
+fn gather_statistics(report: &Report, sources_str: &str, mode: Mode) -> Result<Statistics> {
+    let dest = destination_name();
+    let Report {
+        ref found_by_source,
+        nested_documents_directories,
+        invalid_listed_books,
+        ignored_macos_metadata,
+        pruned_dirs,
+        sync_ignored,
+        skipped_for_permissions,
+        filtered_out_by_name,
+        filtered_out_by_regex,
+        skipped_for_size,
+        skipped_empty_files,
+        modified_before_since,
+        duplicate_source_files,
+        duplicate_content,
+        duplicate_metadata,
+        duplicate_isbn,
+        renamed_for_collision,
+        skipped_for_collision,
+        renamed_for_fat32,
+        transliterated,
+        shortened_for_name_length,
+        not_copied,
+        not_copied_for_other_books,
+        unchanged_since_last_sync,
+        not_picked,
+        declined_interactively,
+        missing_on_device,
+        orphaned_on_device,
+        size_mismatches_on_device,
+        changed_on_device,
+        cut_off_by_max_books,
+        deferred_by_max_total_size,
+        deferred_size,
+        not_copied_before_timeout,
+        failed_to_copy,
+        failed_validation,
+        retried_copies,
+        transferred,
+        copying_took,
+        copied,
+        updated,
+        pulled_from_device,
+        ref auxiliary,
+        trashed_on_device,
+        trashed_size,
+        removed_from_device,
+        failed_to_prune,
+        emptied_from_trash,
+        emptied_size,
+        took,
+        skipped: _,
+        failed: _,
+        dry_run_plan: _,
+    } = *report;
+
+    let (syncing, checking) = (mode == Mode::Sync, mode == Mode::Check);
+    let mut statistics = Statistics::default();
+    use StatisticValue::*;
+    statistics.show(
+        false,
+        "nested_documents_directories",
+        "Documents directories skipped for being inside others",
+        Count(nested_documents_directories),
+    );
+    statistics.show(
+        true,
+        "found",
+        format!("Found documents in {sources_str}"),
+        Count(report.found()),
+    );
+    // A whole format missing from a source is a sign of the wrong directory being given, so the
+    // books found in each are broken down by format.
+    for (source, by_extension) in found_by_source {
+        let source = path_str(source)?;
+        statistics.show(
+            false,
+            "found_by_format",
+            format!("Found documents by format in {source}"),
+            ByFormat {
+                source: source.to_owned(),
+                by_extension: by_extension.clone(),
+            },
+        );
+    }
+    statistics.show(
+        false,
+        "invalid_listed_books",
+        "Listed books that could not be read",
+        Count(invalid_listed_books),
+    );
+    statistics.show(
+        false,
+        "ignored_macos_metadata",
+        "macOS metadata files ignored",
+        Count(ignored_macos_metadata),
+    );
+    statistics.show(
+        false,
+        "pruned_directories",
+        "Directories pruned by exclusion patterns",
+        Count(pruned_dirs),
+    );
+    statistics.show(
+        false,
+        "sync_ignored",
+        "Files and directories ignored by .syncignore rules",
+        Count(sync_ignored),
+    );
+    statistics.show(
+        false,
+        "skipped_for_permissions",
+        "Paths skipped due to permissions",
+        Count(skipped_for_permissions),
+    );
+    statistics.show(
+        false,
+        "filtered_out_by_name",
+        "Books filtered out by --include and --exclude patterns",
+        Count(filtered_out_by_name),
+    );
+    statistics.show(
+        false,
+        "filtered_out_by_regex",
+        "Books filtered out by --match-regex and --exclude-regex",
+        Count(filtered_out_by_regex),
+    );
+    statistics.show(
+        false,
+        "skipped_for_size",
+        "Books skipped for being larger than the maximum file size",
+        Count(skipped_for_size),
+    );
+    statistics.show(
+        false,
+        "skipped_empty_files",
+        "Zero-byte files skipped",
+        Count(skipped_empty_files),
+    );
+    statistics.show(
+        false,
+        "modified_before_since",
+        "Books skipped for being modified before --since",
+        Count(modified_before_since),
+    );
+    statistics.show(
+        false,
+        "duplicate_source_files",
+        "Duplicate source files skipped",
+        Count(duplicate_source_files),
+    );
+    statistics.show(
+        false,
+        "duplicate_content",
+        "Books skipped for having the same contents as another",
+        Count(duplicate_content),
+    );
+    statistics.show(
+        false,
+        "duplicate_metadata",
+        "Books skipped for having the same title and authors as another",
+        Count(duplicate_metadata),
+    );
+    statistics.show(
+        false,
+        "duplicate_isbn",
+        "Books skipped for having the same ISBN as another",
+        Count(duplicate_isbn),
+    );
+    statistics.show(
+        false,
+        "renamed_for_collision",
+        "Books renamed for having the same name as another",
+        Count(renamed_for_collision),
+    );
+    statistics.show(
+        false,
+        "skipped_for_collision",
+        "Books skipped for having the same name as another",
+        Count(skipped_for_collision),
+    );
+    statistics.show(
+        false,
+        "renamed_for_fat32",
+        "Books renamed for having names that are invalid on FAT32",
+        Count(renamed_for_fat32),
+    );
+    statistics.show(
+        false,
+        "transliterated",
+        "Books renamed by transliterating them to ASCII",
+        Count(transliterated),
+    );
+    statistics.show(
+        false,
+        "shortened_for_name_length",
+        "Books renamed for having names that are too long",
+        Count(shortened_for_name_length),
+    );
+    statistics.show(
+        false,
+        "already_existing",
+        format!("Books not copied because they already exist on {dest}"),
+        Count(not_copied),
+    );
+    statistics.show(
+        false,
+        "other_books_existing",
+        format!(
+            "Books not copied because others not put there by this tool have their names on \
+                {dest}"
+        ),
+        Count(not_copied_for_other_books),
+    );
+    statistics.show(
+        false,
+        "unchanged_since_last_sync",
+        "Books not copied because they are unchanged since last synchronised",
+        Count(unchanged_since_last_sync),
+    );
+    statistics.show(
+        false,
+        "not_picked",
+        "Books left out of the selection picked with --pick",
+        Count(not_picked),
+    );
+    statistics.show(
+        false,
+        "declined_interactively",
+        "Books not copied or pruned because they were declined",
+        Count(declined_interactively),
+    );
+    statistics.show(
+        checking,
+        "missing_on_device",
+        format!("Books missing on {dest}"),
+        Count(missing_on_device),
+    );
+    statistics.show(
+        checking,
+        "orphaned_on_device",
+        format!("Books on {dest} but not found in the sources"),
+        Count(orphaned_on_device),
+    );
+    statistics.show(
+        checking,
+        "size_mismatches_on_device",
+        format!("Books with different sizes on {dest}"),
+        Count(size_mismatches_on_device),
+    );
+    statistics.show(
+        checking,
+        "changed_on_device",
+        format!("Books changed on {dest} since being synchronised"),
+        Count(changed_on_device),
+    );
+    statistics.show(
+        false,
+        "cut_off_by_max_books",
+        "Books not copied because of --max-books",
+        Count(cut_off_by_max_books),
+    );
+    statistics.show(
+        false,
+        "deferred_by_max_total_size",
+        "Books deferred by --max-total-size",
+        CountAndSize(deferred_by_max_total_size, deferred_size),
+    );
+    statistics.show(
+        false,
+        "not_copied_before_timeout",
+        "Books not copied because the --timeout passed first",
+        Count(not_copied_before_timeout),
+    );
+    statistics.show(
+        syncing,
+        "failed_to_copy",
+        "Books that could not be copied",
+        Count(failed_to_copy),
+    );
+    statistics.show(
+        false,
+        "failed_validation",
+        "Books not copied because they failed validation",
+        Count(failed_validation),
+    );
+    statistics.show(
+        false,
+        "retried_copies",
+        "Copies that needed retrying",
+        Count(retried_copies),
+    );
+    statistics.show(
+        false,
+        "transferred",
+        "Copied at",
+        Rate(transferred, copying_took),
+    );
+    statistics.show(syncing, "copied", "Book copied", Count(copied));
+    statistics.show(
+        false,
+        "updated",
+        format!("Books updated on {dest}"),
+        Count(updated),
+    );
+    statistics.show(
+        false,
+        "pulled_from_device",
+        format!("Books pulled back from {dest}"),
+        Count(pulled_from_device),
+    );
+    statistics.show(
+        false,
+        "trashed_on_device",
+        format!("Books moved to the trash on {dest} by --prune"),
+        CountAndSize(trashed_on_device, trashed_size),
+    );
+    statistics.show(
+        false,
+        "removed_from_device",
+        format!("Books removed from {dest} by --prune"),
+        Count(removed_from_device),
+    );
+    statistics.show(
+        false,
+        "failed_to_prune",
+        format!("Books that could not be pruned from {dest}"),
+        Count(failed_to_prune),
+    );
+    statistics.show(
+        false,
+        "emptied_from_trash",
+        format!("Files deleted by emptying the trash on {dest}"),
+        CountAndSize(emptied_from_trash, emptied_size),
+    );
+    statistics.show(true, "took", "Time taken", Duration(took));
+
+    // Features besides copying books get sections of their own, so that what they amounted to
+    // isn't mistaken for what happened to the books.
+    for (&feature, tally) in auxiliary {
+        statistics.start_section(feature.section());
+        let [(succeeded_key, succeeded), (failed_key, failed)] = feature.statistics();
+        statistics.show(true, succeeded_key, succeeded, Count(tally.succeeded));
+        statistics.show(true, failed_key, failed, Count(tally.failed));
+    }
+    Ok(statistics)
+}
+
+#[derive(Debug, Parser)]
+#[command(
+    name = NAME,
+    about,
+    author,
+    version = VERSION,
+    long_about = LONG_ABOUT,
+    args_conflicts_with_subcommands = true
+)]
+struct PartialArgs {
+    #[command(subcommand)]
+    command: Option<Subcommand>,
+
+    // Without a subcommand, it synchronises, and the other subcommands are chosen with flags, as
+    // before there were subcommands.
+    #[command(flatten)]
+    sync: SyncCommand,
+
+    /// Whether to only list the books found, with their sizes and where they were found, without
+    /// copying anything. The Kobo need not be connected.
+    #[arg(long, default_value_t = false)]
+    list: bool,
+
+    /// Whether to audit the Kobo against the books found, without changing anything. It reports
+    /// books missing from the Kobo, books on it that weren't found, and books whose sizes differ,
+    /// exiting with status 2 if there are any differences.
+    #[arg(long, default_value_t = false, conflicts_with = "list")]
+    check: bool,
+
+    #[command(flatten)]
+    inventory: InventoryArgs,
+
+    // Cleared by the `prune` and `pull` subcommands, which only act on what's already on the
+    // destination.
+    #[arg(skip = true)]
+    copy_books: bool,
+}
+
+#[derive(Debug, clap::Subcommand)]
+enum Subcommand {
+    /// Synchronise books to the destination, as when no subcommand is given.
+    Sync(SyncCommand),
+
+    /// List the books found, with their sizes and where they were found, without copying
+    /// anything. The Kobo need not be connected.
+    List(ListCommand),
+
+    /// Audit the destination against the books found without changing anything, exiting with
+    /// status 2 if they differ.
+    Check(CheckCommand),
+
+    /// Remove books from the destination that are no longer found in any of the sources, without
+    /// copying any books to it.
+    Prune(PruneCommand),
+
+    /// Copy books that are only on the destination into a local directory, without copying any
+    /// books to it.
+    Pull(PullCommand),
+
+    /// Print the version, along with the revision and date it was built from.
+    Version,
+
+    /// Print a script completing the subcommands and flags for a shell, such as to source from
+    /// `~/.bashrc` or to put in `~/.config/fish/completions`.
+    Completion(CompletionCommand),
+}
+
+#[derive(Debug, clap::Args)]
+struct SyncCommand {
+    #[command(flatten)]
+    destination: DestinationArgs,
+
+    #[command(flatten)]
+    sources: SourceArgs,
+
+    #[command(flatten)]
+    placement: PlacementArgs,
+
+    #[command(flatten)]
+    copying: CopyingArgs,
+
+    #[command(flatten)]
+    watching: WatchArgs,
+
+    /// Whether to remove books from the Kobo that are no longer found in any of the sources,
+    /// matching them by name. Only EPUBs and PDFs outside of hidden directories are considered, so
+    /// the Kobo's own files are left alone.
+    #[arg(long, default_value_t = false)]
+    prune: bool,
+
+    #[command(flatten)]
+    pruning: PruneArgs,
+
+    /// A local directory into which to copy books that are only on the Kobo, such as those
+    /// sideloaded from elsewhere, so that they aren't lost. Nothing is removed from the Kobo.
+    #[arg(long, value_hint = ValueHint::DirPath)]
+    pull_orphans: Option<PathBuf>,
+
+    #[command(flatten)]
+    hooks: HookArgs,
+
+    #[command(flatten)]
+    confirmation: ConfirmationArgs,
+
+    #[command(flatten)]
+    output: OutputArgs,
+
+    #[command(flatten)]
+    dry_run: DryRunArgs,
+}
+
+#[derive(Debug, clap::Args)]
+struct ListCommand {
+    #[command(flatten)]
+    sources: SourceArgs,
+
+    #[command(flatten)]
+    output: OutputArgs,
+}
+
+#[derive(Debug, clap::Args)]
+struct CheckCommand {
+    #[command(flatten)]
+    destination: DestinationArgs,
+
+    #[command(flatten)]
+    sources: SourceArgs,
+
+    #[command(flatten)]
+    placement: PlacementArgs,
+
+    #[command(flatten)]
+    inventory: InventoryArgs,
+
+    #[command(flatten)]
+    output: OutputArgs,
+}
+
+#[derive(Debug, clap::Args)]
+struct PruneCommand {
+    #[command(flatten)]
+    destination: DestinationArgs,
+
+    #[command(flatten)]
+    sources: SourceArgs,
+
+    #[command(flatten)]
+    placement: PlacementArgs,
+
+    #[command(flatten)]
+    pruning: PruneArgs,
+
+    #[command(flatten)]
+    hooks: HookArgs,
+
+    #[command(flatten)]
+    confirmation: ConfirmationArgs,
+
+    #[command(flatten)]
+    output: OutputArgs,
+
+    #[command(flatten)]
+    dry_run: DryRunArgs,
+}
+
+#[derive(Debug, clap::Args)]
+struct PullCommand {
+    /// The local directory into which to copy the books, such as those sideloaded from elsewhere,
+    /// so that they aren't lost. Nothing is removed from the destination.
+    #[arg(value_hint = ValueHint::DirPath)]
+    dir: PathBuf,
+
+    #[command(flatten)]
+    destination: DestinationArgs,
+
+    #[command(flatten)]
+    sources: SourceArgs,
+
+    #[command(flatten)]
+    placement: PlacementArgs,
+
+    #[command(flatten)]
+    hooks: HookArgs,
+
+    #[command(flatten)]
+    output: OutputArgs,
+
+    #[command(flatten)]
+    dry_run: DryRunArgs,
+}
+
+#[derive(Debug, clap::Args)]
+struct CompletionCommand {
+    /// The shell to complete for.
+    shell: Shell,
+}
+
+impl Subcommand {
+    /// Express the subcommand as the flags it stands for, leaving the flags it doesn't take at
+    /// their defaults.
+    fn into_partial_args(self) -> PartialArgs {
+        let mut args = PartialArgs::parse_from([NAME]);
+        match self {
+            Subcommand::Sync(sync) => args.sync = sync,
+            Subcommand::List(ListCommand { sources, output }) => {
+                args.sync = SyncCommand {
+                    sources,
+                    output,
+                    ..args.sync
+                };
+                args.list = true;
+            }
+            Subcommand::Check(CheckCommand {
+                destination,
+                sources,
+                placement,
+                inventory,
+                output,
+            }) => {
+                args.sync = SyncCommand {
+                    destination,
+                    sources,
+                    placement,
+                    output,
+                    ..args.sync
+                };
+                args.inventory = inventory;
+                args.check = true;
+            }
+            Subcommand::Prune(PruneCommand {
+                destination,
+                sources,
+                placement,
+                pruning,
+                hooks,
+                confirmation,
+                output,
+                dry_run,
+            }) => {
+                args.sync = SyncCommand {
+                    destination,
+                    sources,
+                    placement,
+                    pruning,
+                    prune: true,
+                    hooks,
+                    confirmation,
+                    output,
+                    dry_run,
+                    ..args.sync
+                };
+                args.copy_books = false;
+            }
+            Subcommand::Pull(PullCommand {
+                dir,
+                destination,
+                sources,
+                placement,
+                hooks,
+                output,
+                dry_run,
+            }) => {
+                args.sync = SyncCommand {
+                    destination,
+                    sources,
+                    placement,
+                    pull_orphans: Some(dir),
+                    hooks,
+                    output,
+                    dry_run,
+                    ..args.sync
+                };
+                args.copy_books = false;
+            }
+            Subcommand::Version | Subcommand::Completion(_) => {}
+        }
+        args
+    }
+}
+
+// Where to synchronise to, for the subcommands that touch the destination.
+#[derive(Debug, clap::Args)]
+struct DestinationArgs {
+    /// The directory of the mounted Kobo storage directory to which to synchronise the books and
+    /// documents. Defaults to the only Kobo mounted under `/media/$USER`, `/run/media/$USER`, or
+    /// `/Volumes`.
+    #[arg(long, value_hint = ValueHint::DirPath)]
+    kobo_directory: Option<PathBuf>,
+
+    /// A plain directory to synchronise to instead of a Kobo, such as a staging directory on a
+    /// network share. It isn't checked for being a Kobo, and options that need a Kobo's database
+    /// or image cache can't be used with it.
+    #[arg(long, conflicts_with = "kobo_directory", value_hint = ValueHint::DirPath)]
+    target_directory: Option<PathBuf>,
+
+    /// A directory on an SSH server to synchronise to instead of a Kobo, such as
+    /// `sftp://user@server/srv/books`, using the system's `sftp` and SSH configuration. Only new
+    /// books are copied; options that change or check what's already there can't be used with
+    /// it.
+    #[arg(long, conflicts_with_all = ["kobo_directory", "target_directory"])]
+    sftp_target: Option<String>,
+
+    /// Whether to synchronise to the reader connected over MTP, as mounted by GVfs, treating it as
+    /// with `--target-directory`. This implies `--progress`, as copies over MTP are slow.
+    #[arg(
+        long,
+        default_value_t = false,
+        conflicts_with_all = ["kobo_directory", "target_directory", "sftp_target"]
+    )]
+    mtp: bool,
+
+    /// A directory to synchronise to along with others, as `NAME=DIRECTORY`, or
+    /// `NAME:EXTENSION,...=DIRECTORY` to only copy books with those extensions there, such as
+    /// `kindle:pdf=/media/Kindle/documents`. Can be repeated, searching the sources only once for
+    /// all of them. Each is treated as with `--target-directory`, gets a report of its own, and is
+    /// skipped with a warning if it isn't accessible, such as when it isn't mounted.
+    #[arg(
+        long = "dest",
+        value_name = "NAME[:EXTENSIONS]=DIRECTORY",
+        conflicts_with_all = ["kobo_directory", "target_directory", "sftp_target", "mtp"]
+    )]
+    destinations: Vec<String>,
+
+    /// Whether to synchronise to the Kobo storage directory even if it lacks the `.kobo`
+    /// directory that marks it as a Kobo, such as when it's a plain directory standing in for one.
+    #[arg(long, default_value_t = false)]
+    no_device_check: bool,
+}
+
+// Where to find books, and which of them to consider.
+#[derive(Debug, clap::Args)]
+struct SourceArgs {
+    /// The directory of the documents directories from which to synchronise books and documents.
+    #[arg(long, value_hint = ValueHint::DirPath)]
+    documents_directories: Option<Vec<PathBuf>>,
+
+    /// A file listing the paths of books to synchronise, one per line, instead of searching the
+    /// documents directories. `-` reads the list from standard input.
+    #[arg(long, conflicts_with = "documents_directories", value_hint = ValueHint::FilePath)]
+    from_file: Option<PathBuf>,
+
+    /// A glob pattern of directories to skip while searching the documents directories, matched
+    /// against both directory names and their paths relative to the documents directory. Can be
+    /// repeated. Defaults to excluding hidden directories such as `.git`; specifying any patterns
+    /// replaces that default.
+    #[arg(long = "exclude-dir", default_value = ".*")]
+    exclude_dirs: Vec<String>,
+
+    /// A case-insensitive glob pattern of book file names to synchronise, such as `*stevens*`.
+    /// Can be repeated, in which case books matching any of them are synchronised. Defaults to
+    /// all books.
+    #[arg(long = "include")]
+    includes: Vec<String>,
+
+    /// A case-insensitive glob pattern of book file names not to synchronise. Can be repeated.
+    /// Takes precedence over `--include`.
+    #[arg(long = "exclude")]
+    excludes: Vec<String>,
+
+    /// A regular expression that books' paths, relative to the documents directory in which they
+    /// were found, must match to be synchronised.
+    #[arg(long)]
+    match_regex: Option<String>,
+
+    /// A regular expression that books' paths, relative to the documents directory in which they
+    /// were found, must not match to be synchronised.
+    #[arg(long)]
+    exclude_regex: Option<String>,
+
+    /// How many levels of directories to descend into within each documents directory, where 1
+    /// means only books directly inside it. Defaults to unlimited.
+    #[arg(long)]
+    max_depth: Option<usize>,
+
+    /// The size above which books are not synchronised, such as `500M` or `1.5G`, in binary
+    /// units. Defaults to unlimited.
+    #[arg(long, value_parser = parse_size)]
+    max_file_size: Option<u64>,
+
+    /// Whether to synchronise empty books, which are skipped by default as they are usually left
+    /// by interrupted downloads.
+    #[arg(long, default_value_t = false)]
+    include_empty: bool,
+
+    /// Only synchronise books modified since a time, given either as a duration ago such as `72h`
+    /// or `30d`, or as a local date such as `2024-06-01`.
+    #[arg(long, value_parser = parse_since)]
+    since: Option<SystemTime>,
+
+    /// Whether to search directories behind symlinks within the documents directories.
+    #[arg(long, default_value_t = false)]
+    follow_symlinks: bool,
+
+    /// Whether to fail when part of the documents directories can't be searched for lack of
+    /// permission, rather than skipping it and counting it in the statistics.
+    #[arg(long, default_value_t = false)]
+    strict_permissions: bool,
+
+    /// Whether to fail when any part of the documents directories can't be searched, for whatever
+    /// reason, rather than skipping it. Either way, nothing is pruned when something was skipped,
+    /// as the books there would look removed.
+    #[arg(long, default_value_t = false)]
+    strict_discovery: bool,
+
+    /// Whether to fail when no books at all are found in the sources, rather than just warning, as
+    /// a mistyped documents directory that happens to exist has no books in it.
+    #[arg(long, default_value_t = false)]
+    fail_if_empty: bool,
+}
+
+// Where books go on the destination, and which of several similar books go there at all.
+#[derive(Debug, clap::Args)]
+struct PlacementArgs {
+    /// A directory within the Kobo to which to copy books with a particular extension, such as
+    /// `pdf=PDFs`. Can be repeated for different extensions. By default, all books are copied
+    /// directly into the top-level directory of the Kobo.
+    #[arg(long = "extension-directory", value_name = "EXTENSION=DIRECTORY")]
+    extension_directories: Vec<String>,
+
+    /// Whether to mirror the directory structure of the documents directories on the Kobo, rather
+    /// than copying all books directly into its top-level directory.
+    #[arg(long, default_value_t = false)]
+    preserve_tree: bool,
+
+    /// Whether to name books on the Kobo as `Author - Title.ext` after the metadata embedded in
+    /// EPUBs and PDFs, keeping the original name for books without a title.
+    #[arg(long, default_value_t = false)]
+    rename_from_metadata: bool,
+
+    /// Whether to approximate book names in ASCII on the Kobo, for file browsers that can't
+    /// display other characters.
+    #[arg(long, default_value_t = false)]
+    transliterate: bool,
+
+    /// The maximum length in bytes of book names on the Kobo. Longer names are truncated and
+    /// suffixed with a hash of the original name. Lower it for filesystems whose limits are
+    /// stricter than FAT32's with the characters in use.
+    #[arg(long, default_value_t = 255)]
+    max_name_length: usize,
+
+    /// Whether to skip books with the same contents as another book found earlier, even if their
+    /// names differ. This requires reading every book found.
+    #[arg(long, default_value_t = false)]
+    dedupe_content: bool,
+
+    /// Whether to skip EPUBs with the same title and authors as another EPUB found earlier, even
+    /// if their names or contents differ.
+    #[arg(long, default_value_t = false)]
+    dedupe_metadata: bool,
+
+    /// Whether to copy only one format of books with the same ISBN, going by the ISBNs in their
+    /// names and EPUB metadata.
+    #[arg(long, default_value_t = false)]
+    dedupe_isbn: bool,
+
+    /// The formats to prefer when deduplicating books by ISBN, from most to least preferred.
+    #[arg(
+        long = "prefer-format",
+        value_delimiter = ',',
+        default_value = "epub,pdf"
+    )]
+    preferred_formats: Vec<String>,
+
+    /// What to do with different books that have the same name, and so would be copied to the
+    /// same place on the Kobo. Books with the same name and contents are always deduplicated.
+    #[arg(long, value_enum, default_value_t = CollisionPolicy::Rename)]
+    on_collision: CollisionPolicy,
+}
+
+// How books are copied to the destination, and what else is done to it along the way.
+#[derive(Debug, clap::Args)]
+struct CopyingArgs {
+    /// The maximum number of books to copy, picking the most recently modified of those not yet on
+    /// the Kobo. Defaults to unlimited.
+    #[arg(long)]
+    max_books: Option<usize>,
+
+    /// The maximum total size of books to copy in one run, such as `2G`, leaving the rest for
+    /// later runs. `auto` uses whatever is free on the Kobo. Defaults to unlimited.
+    #[arg(long, value_parser = parse_total_size_limit)]
+    max_total_size: Option<TotalSizeLimit>,
+
+    /// Whether to pick which of the books found to synchronise from a list on the terminal, which
+    /// can be filtered by typing. Books already on the Kobo are marked as such.
+    #[arg(long, default_value_t = false)]
+    pick: bool,
+
+    /// Whether to copy as many books as fit when the Kobo lacks the space for all of them, rather
+    /// than failing before copying any.
+    #[arg(long, default_value_t = false)]
+    best_effort: bool,
+
+    /// How many times to retry copying a book after it fails with an error that might not recur,
+    /// such as an I/O error, waiting longer between each attempt. Errors such as the destination
+    /// being full aren't retried.
+    #[arg(long, default_value_t = 2)]
+    retries: u32,
+
+    /// How long copying a book can take before it's abandoned, such as `5m`, for readers that
+    /// sometimes stall. The next book is copied regardless.
+    #[arg(long, value_parser = humantime::parse_duration)]
+    file_timeout: Option<Duration>,
+
+    /// How much of a book to read at a time before writing it out when copying, such as `4M`.
+    /// Larger buffers mean fewer, larger writes, which are faster over USB.
+    #[arg(long, value_parser = parse_size, default_value = "1M")]
+    buffer_size: u64,
+
+    /// The most that copies can read per second in total, such as `5M`, to leave bandwidth for
+    /// other things when running in the background. Defaults to `0`, which is unlimited.
+    #[arg(long, value_parser = parse_size, default_value = "0")]
+    bwlimit: u64,
+
+    /// Whether to give copies the time they were copied as their modification times, rather than
+    /// the modification times of the books they were copied from.
+    #[arg(long, default_value_t = false)]
+    no_preserve_times: bool,
+
+    /// Whether to check that each EPUB is a readable Zip archive with the `mimetype` of an EPUB
+    /// before copying it, so that corrupt books such as truncated downloads aren't copied.
+    #[arg(long, default_value_t = false)]
+    validate: bool,
+
+    /// How long the whole run can take, such as `1h`. Once it passes, no more books start being
+    /// copied, and those being copied are finished, as when interrupting `--watch` and
+    /// `--watch-sources`. Books that never started are counted as skipped.
+    #[arg(long, value_parser = humantime::parse_duration)]
+    timeout: Option<Duration>,
+
+    /// Whether to stop at the first book that can't be copied, such as when the destination is
+    /// full, rather than trying every other book too. Copies under way are abandoned.
+    #[arg(long, default_value_t = false)]
+    fail_fast: bool,
+
+    /// Whether to report how far along each copy is.
+    #[arg(long, default_value_t = false)]
+    progress: bool,
+
+    /// Whether to refresh books already on the Kobo whose sizes differ from, or that are older
+    /// than, the books found.
+    #[arg(long, default_value_t = false)]
+    update: bool,
+
+    /// Whether to make the Kobo mirror the sources exactly, implying both `--update` and
+    /// `--prune`. Books are copied and updated before any are pruned.
+    #[arg(long, default_value_t = false)]
+    mirror: bool,
+
+    /// A local directory into which to export the highlights and notes made on the Kobo, one file
+    /// per book. Files from previous exports are overwritten.
+    #[arg(long, value_hint = ValueHint::DirPath)]
+    export_annotations: Option<PathBuf>,
+
+    /// The format of the files written by `--export-annotations`.
+    #[arg(long, value_enum, default_value_t = AnnotationsFormat::Markdown)]
+    annotations_format: AnnotationsFormat,
+
+    /// Whether to add the books copied to collections on the Kobo named after the directories
+    /// they were found in, such as `Fiction` for books in `~/Documents/Fiction`. The Kobo's
+    /// database is backed up alongside itself first.
+    #[arg(long, default_value_t = false)]
+    collections: bool,
+
+    /// Whether to write the covers of the books copied to where the Kobo caches them, so that
+    /// they show up without the Kobo having to generate them itself. Covers are taken from EPUBs,
+    /// and from PDFs if `--pdf-cover-renderer` is given.
+    #[arg(long, default_value_t = false)]
+    covers: bool,
+
+    /// A command that renders the first page of the PDF appended to it as an image on its
+    /// standard output, such as `pdftoppm -jpeg -singlefile -f 1`, for `--covers`.
+    #[arg(long, value_hint = ValueHint::CommandString)]
+    pdf_cover_renderer: Option<String>,
+
+    /// The features besides copying books whose failures should fail the run, as books that
+    /// can't be copied do, such as `annotations,covers`. Their failures are otherwise only warned
+    /// about.
+    #[arg(long, value_enum, value_delimiter = ',')]
+    fail_on_auxiliary_errors: Vec<AuxiliaryFeature>,
+
+    /// Whether to remember the books synchronised to each destination, so that later runs can
+    /// skip those unchanged since without looking for them on the destination. Books removed from
+    /// the destination by other means aren't noticed until the state is reset.
+    #[arg(long, default_value_t = false)]
+    state: bool,
+
+    /// Whether to forget the books remembered by `--state` for the destination, starting again.
+    #[arg(long, default_value_t = false)]
+    reset_state: bool,
+
+    /// Whether to start keeping a manifest on the Kobo of the books synchronised to it, so that
+    /// books put there by other means can be told apart, and `--check` can find books that changed
+    /// there since. Once there, the manifest is kept up to date whether or not this is given.
+    #[arg(long, default_value_t = false)]
+    device_manifest: bool,
+}
+
+#[derive(Debug, clap::Args)]
+struct WatchArgs {
+    /// Whether to keep running, synchronising to the Kobo each time it's plugged in. Press Ctrl-C
+    /// to stop.
+    #[arg(long, default_value_t = false)]
+    watch: bool,
+
+    /// Whether to keep running, copying books to the Kobo as they're created or changed in the
+    /// documents directories rather than searching them each time. Press Ctrl-C to stop.
+    #[arg(long, default_value_t = false)]
+    watch_sources: bool,
+
+    /// How often `--watch-sources` searches the documents directories in full anyway, to catch
+    /// changes it missed, such as `15m` or `1h`.
+    #[arg(long, value_parser = humantime::parse_duration, default_value = "15m")]
+    reconcile_interval: Duration,
+}
+
+#[derive(Debug, clap::Args)]
+struct PruneArgs {
+    /// How `--prune` gets rid of books.
+    #[arg(long, value_enum, default_value_t = PruneMode::Trash)]
+    prune_mode: PruneMode,
+
+    /// Whether to permanently delete the books previously moved into the Kobo's trash by
+    /// `--prune`, before pruning any more.
+    #[arg(long, default_value_t = false)]
+    empty_trash: bool,
+}
+
+// What to do around changing the destination.
+#[derive(Debug, clap::Args)]
+struct HookArgs {
+    /// A command to run through the shell before synchronising, such as to mount a share. The
+    /// synchronisation is abandoned if it fails.
+    #[arg(long, value_hint = ValueHint::CommandString)]
+    pre_hook: Option<String>,
+
+    /// A command to run through the shell after synchronising, such as to send a notification.
+    /// It's given the outcome in the `SYNC_COPIED`, `SYNC_SKIPPED`, `SYNC_ERRORS`, and
+    /// `SYNC_DRY_RUN` environment variables.
+    #[arg(long, value_hint = ValueHint::CommandString)]
+    post_hook: Option<String>,
+
+    /// Whether to unmount the Kobo once synchronised, so that it can be unplugged straight away.
+    #[arg(long, default_value_t = false)]
+    eject: bool,
+}
+
+#[derive(Debug, clap::Args)]
+struct InventoryArgs {
+    /// A file to write a snapshot of the books on the Kobo to, with their sizes and modification
+    /// times, such as before lending it to someone. It's written as CSV if the name ends in
+    /// `.csv`, and as JSON otherwise. No documents directories are searched.
+    #[arg(long, value_hint = ValueHint::FilePath)]
+    inventory_out: Option<PathBuf>,
+
+    /// A snapshot written by `--inventory-out` to compare the books on the Kobo with, reporting
+    /// those added, removed, or modified since, and exiting with status 2 if there are any.
+    #[arg(long, value_hint = ValueHint::FilePath)]
+    inventory_diff: Option<PathBuf>,
+
+    /// Whether to hash the books in inventories too, which catches modifications that keep the
+    /// same size and time but takes much longer.
+    #[arg(long, default_value_t = false)]
+    inventory_hash: bool,
+}
+
+#[derive(Debug, clap::Args)]
+struct OutputArgs {
+    /// Whether to write the listing of `--list`, or a report of what a dry run would copy, as JSON
+    /// for other tools to consume. Messages for humans are written to standard error instead.
+    #[arg(long, default_value_t = false)]
+    json: bool,
+
+    /// Whether to say only what went wrong, followed by a line summarising the run, such as when
+    /// running from cron. Listings and reports asked for are still written in full.
+    #[arg(short, long, default_value_t = false)]
+    quiet: bool,
+
+    /// Whether to explain why each skipped book won't be copied, including those excluded by
+    /// filters that are otherwise only counted.
+    #[arg(short, long, default_value_t = false, conflicts_with = "quiet")]
+    verbose: bool,
+
+    /// Whether to write messages about each book as soon as they happen, rather than sorted by
+    /// book at the end so that the output of different runs can be compared.
+    #[arg(long, default_value_t = false)]
+    stream: bool,
+
+    /// A file to append every message to as well, at the same verbosity, such as to keep a record
+    /// of what `--watch` copied and when. Each run starts with a line saying when it started and
+    /// what it synchronises.
+    #[arg(long, value_hint = ValueHint::FilePath)]
+    log_file: Option<PathBuf>,
+
+    /// When to write messages in colour, with errors in red, books copied in green, and books
+    /// skipped dimmed.
+    #[arg(long = "color", value_enum, default_value_t = ColourChoice::Auto)]
+    colour: ColourChoice,
+
+    /// Whether to never write messages in colour, as with `--color never`.
+    #[arg(long = "no-color", default_value_t = false, conflicts_with = "colour")]
+    no_colour: bool,
+
+    /// How to write messages: as text, or as a JSON object per message with the book it's about
+    /// and any other details under consistent keys, such as for journald.
+    #[arg(long, value_enum, default_value_t = LogFormat::Text)]
+    log_format: LogFormat,
+}
+
+// Whether to ask before changing the destination.
+#[derive(Debug, clap::Args)]
+struct ConfirmationArgs {
+    /// Whether to ask before copying or pruning each book, answering `y` or `n` for it, `a` for it
+    /// and every other, or `q` to stop there. Every book to copy is asked about before any are
+    /// copied, so that the questions don't interleave with the copies. Standard input must be a
+    /// terminal.
+    #[arg(short, long, default_value_t = false)]
+    interactive: bool,
+}
+
+#[derive(Debug, clap::Args)]
+struct DryRunArgs {
+    /// Whether to dry run, documenting what would happen rather than doing it. Exits with status 0
+    /// if nothing would change, 2 if books would be copied or removed, 3 if some books couldn't be
+    /// read, and 1 on errors.
+    #[arg(long, default_value_t = false)]
+    dry_run: bool,
+}
+
+struct Args {
+    kobo_directory: PathBuf,
+    /// The destinations given with `--dest`, synchronised to instead of `kobo_directory`.
+    destinations: Vec<Destination>,
+    plain_target: bool,
+    progress: bool,
+    watch: Option<WatchedDevice>,
+    /// How often to search the documents directories in full under `--watch-sources`.
+    watch_sources: Option<Duration>,
+    sources: BookSources,
+    mode: Mode,
+    stream: bool,
+    verbosity: Verbosity,
+    log_format: LogFormat,
+    log_file: Option<PathBuf>,
+    colour: ColourChoice,
+    inventory: Option<InventoryOptions>,
+    sync_options: SyncOptions,
+}
+
+/// Where to find books, and which to consider.
+struct BookSources {
+    documents_directories: Vec<PathBuf>,
+    book_list: Option<PathBuf>,
+    nested_documents_directories: usize,
+    filters: Arc<SearchFilters>,
+    fail_if_empty: bool,
+}
+
+/// Drop documents directories inside other documents directories, which would otherwise have their
+/// books found twice. Yields the remaining directories and how many were dropped. Symlinks are
+/// resolved when comparing them, but the directories are otherwise left as given.
+async fn drop_nested_documents_directories(dirs: Vec<PathBuf>) -> Result<(Vec<PathBuf>, usize)> {
+    let mut real_dirs = Vec::with_capacity(dirs.len());
+    for dir in &dirs {
+        let real_dir = fs::canonicalize(dir).await?;
+        if real_dirs.contains(&real_dir) {
+            let duplicate = path_str(dir)?;
+            return Err(anyhow!(
+                "The documents directory at {duplicate} was specified more than once"
+            ));
+        }
+        real_dirs.push(real_dir);
+    }
+
+    let mut remaining = vec![];
+    let mut dropped = 0;
+
+    for (dir, real_dir) in dirs.iter().zip(&real_dirs) {
+        let outer = dirs
+            .iter()
+            .zip(&real_dirs)
+            .find(|(_, other)| real_dir != *other && real_dir.starts_with(other));
+
+        if let Some((outer, _)) = outer {
+            let (dir_str, outer_str) = (path_str(dir)?, path_str(outer)?);
+            println_async!(
+                "Documents directory {dir_str} is inside documents directory {outer_str}; will \
+                    only search the latter."
+            )
+            .await?;
+            dropped += 1;
+        } else {
+            remaining.push(dir.clone());
+        }
+    }
+
+    Ok((remaining, dropped))
+}
+
+async fn parse_args(mut partial: PartialArgs) -> Result<Args> {
+    match partial.command.take() {
+        Some(Subcommand::Version) => {
+            let mut out = stdout();
+            out.write_all(format!("{NAME} {VERSION}\n").as_bytes())
+                .await?;
+            out.flush().await?;
+            exit(0);
+        }
+        // The script is generated from the flags themselves, so that it never falls behind them.
+        Some(Subcommand::Completion(CompletionCommand { shell })) => {
+            let mut script = vec![];
+            clap_complete::generate(shell, &mut PartialArgs::command(), NAME, &mut script);
+            let mut out = stdout();
+            out.write_all(&script).await?;
+            out.flush().await?;
+            exit(0);
+        }
+        Some(command) => partial = command.into_partial_args(),
+        None => {}
+    }
+    let PartialArgs {
+        sync:
+            SyncCommand {
+                destination,
+                sources,
+                placement,
+                copying,
+                watching,
+                prune,
+                pruning,
+                pull_orphans,
+                hooks,
+                confirmation,
+                output,
+                dry_run: DryRunArgs { dry_run },
+            },
+        list,
+        check,
+        inventory: inventory_args,
+        copy_books,
+        ..
+    } = partial;
+    let PlacementArgs {
+        preserve_tree,
+        rename_from_metadata,
+        transliterate,
+        max_name_length,
+        dedupe_content,
+        dedupe_metadata,
+        dedupe_isbn,
+        on_collision,
+        ..
+    } = placement;
+    let CopyingArgs {
+        max_books,
+        max_total_size,
+        best_effort,
+        ..
+    } = copying;
+
+    // Books listed explicitly are synchronised instead of searching any documents directories, and
+    // inventories are only of the destination.
+    let taking_inventory =
+        inventory_args.inventory_out.is_some() || inventory_args.inventory_diff.is_some();
+    let documents_directories = if sources.from_file.is_some() || taking_inventory {
+        vec![]
+    } else {
+        sources.documents_directories.unwrap_or_else(|| {
+            lookup_default_documents_directories().expect(
+                "failed to lookup the default documents directory while yielding a default \
+                    value for that missing argument",
+            )
+        })
+    };
+
+    if output.json && !(list || dry_run) {
+        return Err(anyhow!(
+            "JSON output is only available with --list or --dry-run"
+        ));
+    }
+
+    for (asking, flag) in [
+        (copying.pick, "--pick"),
+        (confirmation.interactive, "--interactive"),
+    ] {
+        if !asking {
+            continue;
+        }
+        if !(std::io::stdin().is_terminal() && std::io::stderr().is_terminal()) {
+            return Err(anyhow!(
+                "{flag} needs standard input and standard error to be a terminal to ask on"
+            ));
+        }
+        for (unaskable, unaskable_flag) in [
+            (list || check, "--list and --check"),
+            (
+                watching.watch || watching.watch_sources,
+                "--watch and --watch-sources",
+            ),
+            (
+                sources.from_file.as_deref() == Some(Path::new(BOOK_LIST_FROM_STDIN)),
+                "reading books from standard input",
+            ),
+        ] {
+            if unaskable {
+                return Err(anyhow!("{unaskable_flag} can't be used with {flag}"));
+            }
+        }
+    }
+
+    if copying.pdf_cover_renderer.is_some() && !copying.covers {
+        return Err(anyhow!("A PDF cover renderer is only used with --covers"));
+    }
+
+    for feature in &copying.fail_on_auxiliary_errors {
+        let (used, flag) = match feature {
+            AuxiliaryFeature::Annotations => {
+                (copying.export_annotations.is_some(), "--export-annotations")
+            }
+            AuxiliaryFeature::Collections => (copying.collections, "--collections"),
+            AuxiliaryFeature::Covers => (copying.covers, "--covers"),
+        };
+        if !used {
+            let (_, name) = feature.section();
+            return Err(anyhow!(
+                "--fail-on-auxiliary-errors {name} is only used with {flag}"
+            ));
+        }
+    }
+
+    for (hooked, flag) in [
+        (hooks.pre_hook.is_some(), "--pre-hook"),
+        (hooks.post_hook.is_some(), "--post-hook"),
+    ] {
+        if hooked && (list || check) {
+            return Err(anyhow!("{flag} can't be used with --list or --check"));
+        }
+    }
+
+    if hooks.eject && (list || check) {
+        return Err(anyhow!("--eject can't be used with --list or --check"));
+    }
+
+    if taking_inventory {
+        for (incompatible, flag) in [
+            (list || check, "--list and --check"),
+            (
+                watching.watch || watching.watch_sources,
+                "--watch and --watch-sources",
+            ),
+            (destination.sftp_target.is_some(), "--sftp-target"),
+        ] {
+            if incompatible {
+                return Err(anyhow!(
+                    "{flag} can't be used with --inventory-out or --inventory-diff"
+                ));
+            }
+        }
+    } else if inventory_args.inventory_hash {
+        return Err(anyhow!(
+            "Hashing inventories is only done with --inventory-out or --inventory-diff"
+        ));
+    }
+
+    let mode = match (list, output.json, check) {
+        (true, false, _) => Mode::List(ListingFormat::Text),
+        (true, true, _) => Mode::List(ListingFormat::Json),
+        (false, _, true) => Mode::Check,
+        (false, _, false) => Mode::Sync,
+    };
+
+    let sftp_target = destination
+        .sftp_target
+        .as_deref()
+        .map(SftpTarget::parse)
+        .transpose()
+        .map_err(|err| anyhow!("Invalid SFTP target: {err}"))?;
+    let destinations = destination
+        .destinations
+        .iter()
+        .map(|spec| parse_destination(spec))
+        .collect::<Result<Vec<_>>>()
+        .map_err(|err| anyhow!("could not parse the destinations: {err}"))?;
+    let plain_target = destination.target_directory.is_some()
+        || sftp_target.is_some()
+        || destination.mtp
+        || !destinations.is_empty();
+    for (needs_kobo, flag) in [
+        (copying.collections, "--collections"),
+        (copying.covers, "--covers"),
+        (copying.export_annotations.is_some(), "--export-annotations"),
+        (hooks.eject, "--eject"),
+    ] {
+        if plain_target && needs_kobo {
+            return Err(anyhow!(
+                "{flag} needs a Kobo, so can't be used with --target-directory, --dest, \
+                    --sftp-target, or --mtp"
+            ));
+        }
+    }
+    for (needs_local_dest, flag) in [
+        (check, "--check"),
+        (copying.update || copying.mirror, "--update and --mirror"),
+        (prune || pruning.empty_trash, "--prune and --empty-trash"),
+        (pull_orphans.is_some(), "--pull-orphans"),
+        (copying.device_manifest, "--device-manifest"),
+        (
+            matches!(max_total_size, Some(TotalSizeLimit::Auto)),
+            "--max-total-size=auto",
+        ),
+    ] {
+        if sftp_target.is_some() && needs_local_dest {
+            return Err(anyhow!("{flag} can't be used with --sftp-target"));
+        }
+    }
+
+    if !destinations.is_empty() {
+        for (incompatible, flag) in [
+            (mode != Mode::Sync, "--list and --check"),
+            (taking_inventory, "--inventory-out and --inventory-diff"),
+            (
+                watching.watch || watching.watch_sources,
+                "--watch and --watch-sources",
+            ),
+            (
+                hooks.pre_hook.is_some() || hooks.post_hook.is_some(),
+                "--pre-hook and --post-hook",
+            ),
+            (output.json, "--json"),
+        ] {
+            if incompatible {
+                return Err(anyhow!("{flag} can't be used with --dest"));
+            }
+        }
+        let mut names = HashSet::new();
+        if let Some(repeated) = destinations.iter().find(|dest| !names.insert(&dest.name)) {
+            return Err(anyhow!(
+                "The destination {} was given more than once",
+                repeated.name
+            ));
+        }
+    }
+
+    if watching.watch {
+        for (unwatchable, flag) in [
+            (mode != Mode::Sync, "--list and --check"),
+            (output.json, "--json"),
+            (
+                sftp_target.is_some() || destination.mtp,
+                "--sftp-target and --mtp",
+            ),
+            (
+                sources.from_file.as_deref() == Some(Path::new(BOOK_LIST_FROM_STDIN)),
+                "reading books from standard input",
+            ),
+        ] {
+            if unwatchable {
+                return Err(anyhow!("{flag} can't be used with --watch"));
+            }
+        }
+    }
+
+    // Books left out by filters are indistinguishable from those removed from the sources, so
+    // pruning would get rid of them from the Kobo.
+    if prune || copying.mirror {
+        for (filtering, flag) in [
+            (sources.from_file.is_some(), "--from-file"),
+            (sources.exclude_dirs != [".*"], "--exclude-dir"),
+            (
+                !sources.includes.is_empty() || !sources.excludes.is_empty(),
+                "--include and --exclude",
+            ),
+            (
+                sources.match_regex.is_some() || sources.exclude_regex.is_some(),
+                "--match-regex and --exclude-regex",
+            ),
+            (sources.max_depth.is_some(), "--max-depth"),
+            (sources.max_file_size.is_some(), "--max-file-size"),
+            (sources.since.is_some(), "--since"),
+        ] {
+            if filtering {
+                return Err(anyhow!(
+                    "{flag} can't be used with --prune or --mirror, as the books left out would \
+                        look removed from the sources"
+                ));
+            }
+        }
+    }
+
+    if watching.watch_sources {
+        for (unwatchable, flag) in [
+            (watching.watch, "--watch"),
+            (mode != Mode::Sync, "--list and --check"),
+            (output.json, "--json"),
+            (sources.from_file.is_some(), "--from-file"),
+            (
+                prune || copying.mirror || pruning.empty_trash,
+                "--prune, --mirror, and --empty-trash",
+            ),
+            (pull_orphans.is_some(), "--pull-orphans"),
+            (hooks.eject, "--eject"),
+        ] {
+            if unwatchable {
+                return Err(anyhow!("{flag} can't be used with --watch-sources"));
+            }
+        }
+    }
+
+    // Watching waits for the Kobo to be plugged in, so it can't be looked for or checked yet.
+    let watch = watching.watch.then(|| {
+        match destination
+            .target_directory
+            .clone()
+            .or(destination.kobo_directory.clone())
+        {
+            Some(dir) => WatchedDevice::At {
+                dir,
+                check_device: !plain_target && !destination.no_device_check,
+            },
+            None => WatchedDevice::Detected,
+        }
+    });
+
+    let kobo_directory = match (
+        &sftp_target,
+        destination.target_directory,
+        destination.kobo_directory,
+    ) {
+        // Destinations on the server are described by their URLs.
+        (Some(target), _, _) => PathBuf::from(target.to_string()),
+        (None, Some(dir), _) | (None, None, Some(dir)) => dir,
+        // Each of the destinations is synchronised to instead.
+        (None, None, None) if !destinations.is_empty() => PathBuf::new(),
+        // Listing books never touches the Kobo, so there is no need to find one.
+        (None, None, None) if matches!(mode, Mode::List(_)) || watch.is_some() => {
+            lookup_default_kobo_storage_directory()
+        }
+        (None, None, None) if destination.mtp => detect_mtp_storage_directory().await?,
+        (None, None, None) => detect_kobo_storage_directory().await?,
+    };
+
+    if let Some(target) = &sftp_target {
+        if !matches!(mode, Mode::List(_)) {
+            target
+                .check_connection()
+                .await
+                .map_err(|err| anyhow!("The SFTP target is not accessible: {err}"))?;
+        }
+    }
+
+    // Listing books never touches the Kobo, and destinations given with `--dest` are skipped when
+    // they aren't accessible.
+    if !matches!(mode, Mode::List(_))
+        && watch.is_none()
+        && sftp_target.is_none()
+        && destinations.is_empty()
+        && !is_accessible_dir(&kobo_directory).await
+    {
+        let inaccessible = kobo_directory.to_str().ok_or_else(|| {
+            anyhow!("could not decode Kobo directory path as UTF-8 while reporting its absense")
+        })?;
+        let described = if plain_target {
+            "target directory"
+        } else {
+            "Kobo storage directory"
+        };
+        return Err(anyhow!(
+            "The {described} at {inaccessible} is not accessible"
+        ));
+    }
+
+    // Guard against spraying books across the wrong directory, such as the one Kobos are mounted
+    // inside rather than the Kobo itself.
+    let marker = kobo_directory.join(KOBO_STATE_DIR);
+    if !matches!(mode, Mode::List(_))
+        && watch.is_none()
+        && !plain_target
+        && !destination.no_device_check
+        && !is_accessible_dir(&marker).await
+    {
+        let (kobo_directory_str, marker_str) = (path_str(&kobo_directory)?, path_str(&marker)?);
+        return Err(anyhow!(
+            "The Kobo storage directory at {kobo_directory_str} does not look like a Kobo, as \
+                there is no {KOBO_STATE_DIR} directory at {marker_str}; pass --no-device-check \
+                to synchronise to it anyway"
+        ));
+    }
+    for dir in &documents_directories {
+        if !is_accessible_dir(dir).await {
+            let inaccessible = dir.to_str().ok_or_else(|| {
+                anyhow!(
+                    "could not a decode documents directory path as UTF-8 while reporting its \
+                        absence",
+                )
+            })?;
+            return Err(anyhow!(
+                "The documents directory at {inaccessible} is not accessible"
+            ));
+        }
+    }
+    let (documents_directories, nested_documents_directories) =
+        drop_nested_documents_directories(documents_directories).await?;
+
+    let excluded_dirs = build_glob_set(&sources.exclude_dirs, false)
+        .map_err(|err| anyhow!("could not parse the directory exclusions: {err}"))?;
+    let included_names = build_glob_set(&sources.includes, true)
+        .map_err(|err| anyhow!("could not parse the inclusions: {err}"))?;
+    let excluded_names = build_glob_set(&sources.excludes, true)
+        .map_err(|err| anyhow!("could not parse the exclusions: {err}"))?;
+    let matching_regex = sources
+        .match_regex
+        .as_deref()
+        .map(Regex::new)
+        .transpose()
+        .map_err(|err| anyhow!("could not parse the regular expression to match: {err}"))?;
+    let excluding_regex = sources
+        .exclude_regex
+        .as_deref()
+        .map(Regex::new)
+        .transpose()
+        .map_err(|err| anyhow!("could not parse the regular expression to exclude: {err}"))?;
+
+    let extension_dirs = placement
+        .extension_directories
+        .iter()
+        .map(|mapping| parse_extension_directory(mapping))
+        .collect::<Result<HashMap<_, _>>>()
+        .map_err(|err| anyhow!("could not parse the extension directories: {err}"))?;
+
+    let preferred_formats = placement
+        .preferred_formats
+        .iter()
+        .map(|format| format.trim().trim_start_matches('.').to_lowercase())
+        .collect();
+
+    if sources.max_depth == Some(0) {
+        return Err(anyhow!(
+            "The maximum depth must be at least 1, which searches only the top level of each \
+                documents directory"
+        ));
+    }
+
+    let buffer_size = usize::try_from(copying.buffer_size)
+        .ok()
+        .filter(|&size| 0 < size)
+        .ok_or_else(|| anyhow!("The buffer size must be more than zero bytes"))?;
+
+    if max_name_length < MIN_MAX_NAME_LENGTH {
+        return Err(anyhow!(
+            "The maximum name length must be at least {MIN_MAX_NAME_LENGTH} bytes, to leave room \
+                for the hash and extension of truncated names"
+        ));
+    }
+
+    let inventory = match (inventory_args.inventory_out, inventory_args.inventory_diff) {
+        (None, None) => None,
+        (out, diff) => Some(InventoryOptions {
+            out,
+            diff,
+            hash: inventory_args.inventory_hash,
+        }),
+    };
+
+    Ok(Args {
+        kobo_directory,
+        destinations,
+        plain_target,
+        progress: copying.progress || destination.mtp,
+        watch,
+        watch_sources: watching
+            .watch_sources
+            .then_some(watching.reconcile_interval),
+        sources: BookSources {
+            documents_directories,
+            book_list: sources.from_file,
+            nested_documents_directories,
+            filters: Arc::new(SearchFilters {
+                excluded_dirs,
+                included_names,
+                excluded_names,
+                matching_regex,
+                excluding_regex,
+                max_depth: sources.max_depth,
+                follow_symlinks: sources.follow_symlinks,
+                max_file_size: sources.max_file_size,
+                include_empty: sources.include_empty,
+                modified_since: sources.since,
+                strict_permissions: sources.strict_permissions,
+                strict_discovery: sources.strict_discovery,
+            }),
+            fail_if_empty: sources.fail_if_empty,
+        },
+        mode,
+        stream: output.stream,
+        log_format: output.log_format,
+        log_file: output.log_file,
+        colour: if output.no_colour {
+            ColourChoice::Never
+        } else {
+            output.colour
+        },
+        verbosity: match (output.quiet, output.verbose) {
+            (true, _) => Verbosity::Quiet,
+            (false, false) => Verbosity::Normal,
+            (false, true) => Verbosity::Verbose,
+        },
+        inventory,
+        sync_options: SyncOptions {
+            dry_run,
+            extension_dirs,
+            preserve_tree,
+            rename_from_metadata,
+            transliterate,
+            max_name_length,
+            dedupe_content,
+            dedupe_metadata,
+            dedupe_isbn,
+            preferred_formats,
+            on_collision,
+            max_books,
+            max_total_size,
+            best_effort,
+            retries: copying.retries,
+            file_timeout: copying.file_timeout,
+            buffer_size,
+            bandwidth_limit: (0 < copying.bwlimit).then_some(copying.bwlimit),
+            preserve_times: !copying.no_preserve_times,
+            validate: copying.validate,
+            deadline: copying.timeout.map(|timeout| Instant::now() + timeout),
+            fail_fast: copying.fail_fast,
+            update: copying.update || copying.mirror,
+            pull_orphans,
+            export_annotations: copying.export_annotations,
+            annotations_format: copying.annotations_format,
+            collections: copying.collections,
+            covers: copying.covers,
+            pdf_cover_renderer: copying.pdf_cover_renderer,
+            fail_on_auxiliary_errors: copying.fail_on_auxiliary_errors,
+            prune: prune || copying.mirror,
+            prune_mode: pruning.prune_mode,
+            empty_trash: pruning.empty_trash,
+            mirror: copying.mirror,
+            json_report: dry_run && output.json,
+            sftp_target,
+            pre_hook: hooks.pre_hook,
+            post_hook: hooks.post_hook,
+            eject: hooks.eject,
+            state: copying.state || copying.reset_state,
+            reset_state: copying.reset_state,
+            device_manifest: copying.device_manifest,
+            copy_books,
+            pick: copying.pick,
+            interactive: confirmation.interactive,
+        },
+    })
+}
+
+/// How a run that wasn't stopped by an error ended. Outcomes are ordered by precedence, so that the
+/// outcome of several runs is the greatest of theirs.
+#[derive(Clone, Copy, Debug, PartialEq, Eq, PartialOrd, Ord)]
+enum RunOutcome {
+    Succeeded,
+    ChangesPending,
+    /// Some books couldn't be copied or read, or features named by `--fail-on-auxiliary-errors`
+    /// failed, which takes precedence over changes pending.
+    PartlyFailed,
+}
+
+/// Find books and act on them once. Given the books that changed in the documents directories,
+/// only those are considered.
+async fn run(
+    kobo_directory: &Path,
+    mode: Mode,
+    sources: &BookSources,
+    sync_options: &SyncOptions,
+    changed_books: Option<Vec<PathBuf>>,
+) -> Result<RunOutcome> {
+    let sources_str =
+        describe_book_sources(&sources.documents_directories, sources.book_list.as_deref())?;
+    let searching_everything = changed_books.is_none();
+
+    if let Some(pre_hook) = &sync_options.pre_hook {
+        run_hook("pre-hook", pre_hook, &[])
+            .await
+            .map_err(|err| anyhow!("Not synchronising, as {err}"))?;
+    }
+
+    let lock = if mode == Mode::Sync && !sync_options.dry_run && sync_options.sftp_target.is_none()
+    {
+        check_writable(kobo_directory).await?;
+        Some(DestinationLock::acquire(kobo_directory).await?)
+    } else {
+        None
+    };
+
+    let (report, changes_pending) =
+        find_and_act(kobo_directory, mode, sources, sync_options, changed_books).await?;
+    print_report(&report, &sources_str, mode).await?;
+    let totals = report.totals();
+    let changes_pending = changes_pending?;
+    // The lock is on the destination, so it must be gone before ejecting it.
+    drop(lock);
+
+    // Only some books are looked at under `--watch-sources`, which can rightly find none.
+    if searching_everything && report.found() == 0 {
+        report_none_found(sources, &sources_str).await?;
+    }
+
+    if let Some(post_hook) = &sync_options.post_hook {
+        run_hook(
+            "post-hook",
+            post_hook,
+            &totals.hook_env(sync_options.dry_run),
+        )
+        .await?;
+    }
+    if sync_options.eject {
+        eject(kobo_directory).await?;
+    }
+
+    Ok(report.outcome(changes_pending, &sync_options.fail_on_auxiliary_errors))
+}
+
+/// Warn that no books were found, which is easy to miss when copying nothing otherwise succeeds, or
+/// fail under `--fail-if-empty`.
+async fn report_none_found(sources: &BookSources, sources_str: &str) -> Result<()> {
+    let extensions_str = EXTENSIONS_TO_SYNCHRONISE
+        .map(|extension| format!(".{extension}"))
+        .join(" or ");
+    let problem = format!(
+        "no books were found in the {sources_str} when looking for {extensions_str} files; check \
+            --documents-directories and --from-file"
+    );
+    if sources.fail_if_empty {
+        return Err(anyhow!("Failing with --fail-if-empty, as {problem}"));
+    }
+    println_error!("Warning: {problem}.").await?;
+    Ok(())
+}
+
+/// Synchronise to each of several destinations, searching the sources only once. Each gets the
+/// books with the extensions it takes and a report of its own. Those that aren't accessible are
+/// skipped with a warning, and those that fail don't stop the rest, although the run then fails.
+async fn sync_to_destinations(
+    destinations: &[Destination],
+    sources: &BookSources,
+    sync_options: &SyncOptions,
+) -> Result<RunOutcome> {
+    let sources_str =
+        describe_book_sources(&sources.documents_directories, sources.book_list.as_deref())?;
+
+    // The statistics of finding the books, including those that couldn't be read or were skipped,
+    // are kept to go into every destination's report.
+    let (book_path_tx, mut book_path_rx) = channel::<FoundBook>(FOUND_BOOKS_CHANNEL_BOUND);
+    let (stats_tx, mut stats_rx) = channel::<Statistic>(STATISTICS_CHANNEL_BOUND);
+    let stats_collection = spawn(async move {
+        let mut stats = vec![];
+        while let Some(stat) = stats_rx.recv().await {
+            stats.push(stat);
+        }
+        stats
+    });
+    let book_finding = start_finding_books(sources, None, book_path_tx, stats_tx).await?;
+    let mut books = vec![];
+    while let Some(book) = book_path_rx.recv().await {
+        books.push(book);
+    }
+    let sources_complete = book_finding.await??;
+    let finding_stats = stats_collection.await?;
+    flush_book_messages().await?;
+    if books.is_empty() {
+        report_none_found(sources, &sources_str).await?;
+    }
+
+    let mut outcome = RunOutcome::Succeeded;
+    let mut failed = vec![];
+    for destination in destinations {
+        let Destination { name, dir, .. } = destination;
+        let dir_str = path_str(dir)?;
+        if !is_accessible_dir(dir).await {
+            println_error!("Warning: skipping {name}, as {dir_str} is not accessible.").await?;
+            continue;
+        }
+        let heading = format!("Synchronising to {name} at {dir_str}:");
+        write_message(Verbosity::Quiet, Style::Bold, heading).await?;
+
+        // Reports are shown even for destinations that failed, as they say how far each got.
+        let fail_on = &sync_options.fail_on_auxiliary_errors;
+        let taken = books.iter().filter(|book| destination.takes(book)).cloned();
+        let synchronised = match sync_to_destination(
+            destination,
+            taken.collect(),
+            sources_complete,
+            &finding_stats,
+            sync_options,
+        )
+        .await
+        {
+            Ok((report, changes_pending)) => {
+                print_report(&report, &sources_str, Mode::Sync).await?;
+                changes_pending.map(|changes_pending| report.outcome(changes_pending, fail_on))
+            }
+            Err(err) => Err(err),
+        };
+        match synchronised {
+            Ok(synchronised) => outcome = outcome.max(synchronised),
+            Err(err) => {
+                println_error!("Error: could not synchronise to {name}: {err}").await?;
+                failed.push(name.as_str());
+            }
+        }
+    }
+
+    if !failed.is_empty() {
+        return Err(anyhow!("Could not synchronise to {}", failed.join(", ")));
+    }
+    Ok(outcome)
+}
+
+/// Synchronise books already found to one of several destinations, yielding its report along
+/// with whether changes are pending, as `find_and_act` does. Only the books it takes count as
+/// found in its report.
+async fn sync_to_destination(
+    destination: &Destination,
+    books: Vec<FoundBook>,
+    sources_complete: bool,
+    finding_stats: &[Statistic],
+    sync_options: &SyncOptions,
+) -> Result<(Report, Result<bool>)> {
+    let lock = if sync_options.dry_run {
+        None
+    } else {
+        check_writable(&destination.dir).await?;
+        Some(DestinationLock::acquire(&destination.dir).await?)
+    };
+
+    let (book_path_tx, book_path_rx) = channel::<FoundBook>(FOUND_BOOKS_CHANNEL_BOUND);
+    let (stats_tx, stats_rx) = channel::<Statistic>(STATISTICS_CHANNEL_BOUND);
+    let stats_collection = spawn(collect_stats(stats_rx, sync_options.json_report));
+
+    for stat in finding_stats {
+        let not_taken = matches!(
+            stat,
+            Statistic::FoundSrcDocument { extension, .. }
+                if !destination.extensions.contains(extension)
+        );
+        if !not_taken {
+            stats_tx.send(stat.clone()).await?;
+        }
+    }
+    // The books are passed on as though being found again, so that they're synchronised as
+    // usual.
+    let book_finding = spawn(async move {
+        for book in books {
+            book_path_tx.send(book).await?;
+        }
+        Ok(sources_complete)
+    });
+
+    let changes_pending = sync_books(
+        &destination.dir,
+        sync_options,
+        book_path_rx,
+        book_finding,
+        stats_tx,
+    )
+    .await
+    .map(|any_changed| sync_options.dry_run && any_changed);
+
+    flush_book_messages().await?;
+    let mut report = stats_collection.await??;
+    report.write_dry_run_plan().await?;
+    drop(lock);
+    Ok((report, changes_pending))
+}
+
+/// Find the books in the sources and act on them according to the mode, yielding a report of the
+/// run along with whether changes are pending, or why acting on them failed. The report is yielded
+/// even then, as the statistics gathered before an error are still worth seeing.
+async fn find_and_act(
+    kobo_directory: &Path,
+    mode: Mode,
+    sources: &BookSources,
+    sync_options: &SyncOptions,
+    changed_books: Option<Vec<PathBuf>>,
+) -> Result<(Report, Result<bool>)> {
+    let (book_path_tx, book_path_rx) = channel::<FoundBook>(FOUND_BOOKS_CHANNEL_BOUND);
+    let (stats_tx, stats_rx) = channel::<Statistic>(STATISTICS_CHANNEL_BOUND);
+    let stats_collection = spawn(collect_stats(stats_rx, sync_options.json_report));
+    let book_finding =
+        start_finding_books(sources, changed_books, book_path_tx, stats_tx.clone()).await?;
+
+    // Each mode waits for the books to be found without errors before acting on them, so that
+    // it doesn't act on an incomplete set.
+    let changes_pending = match mode {
+        Mode::Sync => sync_books(
+            kobo_directory,
+            sync_options,
+            book_path_rx,
+            book_finding,
+            stats_tx,
+        )
+        .await
+        .map(|any_changed| sync_options.dry_run && any_changed),
+        Mode::List(format) => {
+            drop(stats_tx);
+            list_books(format, book_path_rx, book_finding)
+                .await
+                .map(|()| false)
+        }
+        Mode::Check => {
+            check_device(
+                kobo_directory,
+                sync_options,
+                book_path_rx,
+                book_finding,
+                stats_tx,
+            )
+            .await
+        }
+    };
+
+    // Messages and statistics held back before an error are still worth seeing.
+    flush_book_messages().await?;
+    let mut report = stats_collection.await??;
+    report.write_dry_run_plan().await?;
+    Ok((report, changes_pending))
+}
+
+/// Start finding the books in the sources, or only those that changed if given, sending them and
+/// the statistics of finding them on. The task yields whether every book in the sources was found.
+async fn start_finding_books(
+    sources: &BookSources,
+    changed_books: Option<Vec<PathBuf>>,
+    book_path_tx: Sender<FoundBook>,
+    stats_tx: Sender<Statistic>,
+) -> Result<JoinHandle<Result<bool>>> {
+    let extensions: HashSet<&OsStr> = EXTENSIONS_TO_SYNCHRONISE.iter().map(OsStr::new).collect();
+
+    let BookSources {
+        ref documents_directories,
+        ref book_list,
+        nested_documents_directories,
+        ref filters,
+        ..
+    } = *sources;
+
+    for _ in 0..nested_documents_directories {
+        stats_tx
+            .send(Statistic::SkippedNestedDocumentsDirectory)
+            .await?;
+    }
+
+    let (documents_directories, book_list, filters) = (
+        documents_directories.clone(),
+        book_list.clone(),
+        filters.clone(),
+    );
+    Ok(spawn(async move {
+        match (book_list, changed_books) {
+            (Some(book_list), _) => {
+                read_book_list(&book_list, &extensions, book_path_tx, stats_tx).await
+            }
+            (None, Some(changed_books)) => {
+                find_changed_books(
+                    &documents_directories,
+                    &changed_books,
+                    &extensions,
+                    filters,
+                    book_path_tx,
+                    stats_tx,
+                )
+                .await
+            }
+            (None, None) => {
+                find_books(
+                    &documents_directories,
+                    &extensions,
+                    filters,
+                    book_path_tx,
+                    stats_tx,
+                )
+                .await
+            }
+        }
+    }))
+}
+
+/// Check that the destination can be written to before searching for books, as a destination with
+/// a damaged filesystem is remounted read-only by Linux and would otherwise fail every copy.
+async fn check_writable(dest_dir: &Path) -> Result<()> {
+    let probe = dest_dir.join(WRITE_PROBE_NAME);
+    let written = fs::OpenOptions::new()
+        .write(true)
+        .create(true)
+        .truncate(true)
+        .open(&probe)
+        .await;
+    if let Err(err) = written {
+        let dest_str = path_str(dest_dir)?;
+        return Err(anyhow!(
+            "{dest_str} appears to be read-only, as nothing can be written to it: {err}. Readers \
+                are remounted read-only when errors are found in their filesystems; check it, \
+                such as with fsck or Disk Utility, and plug it in again"
+        ));
+    }
+    fs::remove_file(&probe).await?;
+    Ok(())
+}
+
+/// A lock on the destination, held while synchronising to it and released when dropped.
+struct DestinationLock {
+    path: PathBuf,
+}
+
+impl DestinationLock {
+    /// Take the lock on the destination, breaking it if it was left by a run that crashed. The
+    /// lock records the process holding it and the workstation it's on.
+    async fn acquire(dest_dir: &Path) -> Result<Self> {
+        let path = dest_dir.join(LOCK_FILE_NAME);
+        let lock_str = path_str(&path)?;
+        let host = whoami::fallible::hostname().unwrap_or_default();
+        let holder = format!("{}\n{host}\n", std::process::id());
+
+        loop {
+            match create_new(&path).await {
+                Ok(mut file) => {
+                    file.write_all(holder.as_bytes()).await?;
+                    return Ok(Self { path });
+                }
+                Err(err) if err.kind() == io::ErrorKind::AlreadyExists => {}
+                Err(err) => return Err(anyhow!("could not create the lock at {lock_str}: {err}")),
+            }
+
+            let contents = fs::read_to_string(&path).await.unwrap_or_default();
+            let mut lines = contents.lines();
+            let pid = lines.next().and_then(|pid| pid.parse::<u32>().ok());
+            let holder_host = lines.next().unwrap_or_default();
+            let age = fs::metadata(&path)
+                .await
+                .and_then(|metadata| metadata.modified())
+                .ok()
+                .and_then(|modified| modified.elapsed().ok())
+                .unwrap_or_default();
+
+            let is_running = match pid {
+                Some(pid) if holder_host == host => is_process_running(pid),
+                _ => None,
+            };
+            let holder_str = match pid {
+                Some(pid) => format!("process {pid} on {holder_host}"),
+                None => "an unknown process".to_owned(),
+            };
+            if !is_running.unwrap_or(age < STALE_LOCK_AGE) {
+                println_async!("Breaking the stale lock at {lock_str}, left by {holder_str}.")
+                    .await?;
+                fs::remove_file(&path).await?;
+                continue;
+            }
+
+            return Err(anyhow!(
+                "Another synchronisation is already running against {}, as {holder_str}; wait \
+                    for it to finish, or remove {lock_str} if it isn't running",
+                destination_name()
+            ));
+        }
+    }
+}
+
+impl Drop for DestinationLock {
+    fn drop(&mut self) {
+        let _ = std::fs::remove_file(&self.path);
+    }
+}
+
+/// Whether a process is running on this workstation, if that can be determined on this OS.
+#[cfg(unix)]
+fn is_process_running(pid: u32) -> Option<bool> {
+    use nix::{errno::Errno, sys::signal::kill, unistd::Pid};
+
+    // Sending no signal only checks whether the process exists.
+    let pid = Pid::from_raw(i32::try_from(pid).ok()?);
+    Some(kill(pid, None) != Err(Errno::ESRCH))
+}
+
+#[cfg(not(unix))]
+fn is_process_running(_pid: u32) -> Option<bool> {
+    None
+}
+
+/// Unmount the Kobo, which writes out whatever the OS still has cached for it.
+async fn eject(device_dir: &Path) -> Result<()> {
+    let device_str = path_str(device_dir)?;
+    let mut command = if cfg!(target_os = "macos") {
+        let mut command = Command::new("diskutil");
+        command.arg("eject").arg(device_dir);
+        command
+    } else if let Some(block_device) = find_block_device(device_dir).await {
+        // Volumes automounted by udisks2 can be unmounted by the user that they were mounted
+        // for, unlike with `umount`.
+        let mut command = Command::new("udisksctl");
+        command
+            .args(["unmount", "--block-device"])
+            .arg(block_device);
+        command
+    } else {
+        let mut command = Command::new("umount");
+        command.arg(device_dir);
+        command
+    };
+
+    let output = command
+        .stdin(Stdio::null())
+        .output()
+        .await
+        .map_err(|err| anyhow!("Could not eject {device_str}: {err}"))?;
+    if !output.status.success() {
+        let stderr = String::from_utf8_lossy(&output.stderr);
+        let reason = stderr
+            .lines()
+            .find(|line| !line.trim().is_empty())
+            .unwrap_or("unmounting failed");
+        return Err(anyhow!("Could not eject {device_str}: {}", reason.trim()));
+    }
+
+    println_async!("Ejected {device_str}; it is now safe to unplug.").await?;
+    Ok(())
+}
+
+/// Find the block device mounted at a directory, from the mount table.
+async fn find_block_device(mount_point: &Path) -> Option<PathBuf> {
+    let mounts = fs::read_to_string("/proc/self/mounts").await.ok()?;
+    mounts.lines().find_map(|line| {
+        let mut fields = line.split(' ');
+        let (device, mounted_at) = (fields.next()?, fields.next()?);
+        // Spaces in mount points, common in volume labels, are escaped in octal.
+        let mounted_at = mounted_at.replace("\\040", " ");
+        (device.starts_with("/dev/") && Path::new(&mounted_at) == mount_point)
+            .then(|| PathBuf::from(device))
+    })
+}
+
+/// Run a hook command through the shell, passing its output through with its name before each
+/// line so that it can be told apart from the synchronisation's own.
+async fn run_hook(name: &str, command: &str, env: &[(&str, String)]) -> Result<()> {
+    let (shell, flag) = if cfg!(windows) {
+        ("cmd", "/C")
+    } else {
+        ("sh", "-c")
+    };
+    let mut child = Command::new(shell)
+        .args([flag, command])
+        .envs(env.iter().map(|(key, value)| (key, value)))
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|err| anyhow!("the {name} could not be run: {err}"))?;
+
+    let (child_stdout, child_stderr) = (child.stdout.take(), child.stderr.take());
+    let passing_stdout = async {
+        if let Some(child_stdout) = child_stdout {
+            let mut lines = BufReader::new(child_stdout).lines();
+            while let Some(line) = lines.next_line().await? {
+                println_async!("[{name}] {line}").await?;
+            }
+        }
+        io::Result::Ok(())
+    };
+    let passing_stderr = async {
+        if let Some(child_stderr) = child_stderr {
+            let mut lines = BufReader::new(child_stderr).lines();
+            while let Some(line) = lines.next_line().await? {
+                stderr()
+                    .write_all(format!("[{name}] {line}\n").as_bytes())
+                    .await?;
+            }
+        }
+        io::Result::Ok(())
+    };
+    let (status, passed_stdout, passed_stderr) =
+        tokio::join!(child.wait(), passing_stdout, passing_stderr);
+    passed_stdout?;
+    passed_stderr?;
+
+    let status = status?;
+    if !status.success() {
+        return Err(anyhow!("the {name} failed with {status}"));
+    }
+    Ok(())
+}
+
+#[tokio::main]
+async fn main() -> Result<(), Error> {
+    let result = run_from_args().await;
+    // Errors that stop it are otherwise only written to the terminal.
+    if let Err(err) = &result {
+        let line = format_message(Verbosity::Quiet, None, format!("Error: {err}"), vec![]);
+        append_to_log_file(&(line + "\n")).await?;
+    }
+    result
+}
+
+async fn run_from_args() -> Result<()> {
+    let Args {
+        kobo_directory,
+        destinations,
+        plain_target,
+        progress,
+        watch,
+        watch_sources,
+        sources,
+        mode,
+        stream,
+        verbosity,
+        log_format,
+        log_file,
+        colour,
+        inventory,
+        sync_options,
+    } = parse_args(PartialArgs::parse()).await?;
+
+    if mode == Mode::List(ListingFormat::Json) || sync_options.json_report {
+        MESSAGES_TO_STDERR.store(true, Ordering::Relaxed);
+    }
+    STREAM_MESSAGES.store(stream, Ordering::Relaxed);
+    PLAIN_TARGET.store(plain_target, Ordering::Relaxed);
+    let mut observers: Vec<Box<dyn Observer>> = vec![];
+    if progress {
+        observers.push(Box::<ProgressReporter>::default());
+    }
+    if verbosity == Verbosity::Verbose {
+        observers.push(Box::new(VerboseLogger));
+    }
+    // Only set once, as it's only set here.
+    let _ = OBSERVERS.set(observers);
+    VERBOSITY.store(verbosity as u8, Ordering::Relaxed);
+    LOG_AS_JSON.store(log_format == LogFormat::Json, Ordering::Relaxed);
+    let to_terminal = if MESSAGES_TO_STDERR.load(Ordering::Relaxed) {
+        std::io::stderr().is_terminal()
+    } else {
+        std::io::stdout().is_terminal()
+    };
+    let no_colour_set = std::env::var_os("NO_COLOR").is_some_and(|var| !var.is_empty());
+    let colour = match colour {
+        ColourChoice::Always => true,
+        ColourChoice::Never => false,
+        ColourChoice::Auto => to_terminal && !no_colour_set,
+    };
+    // Colour codes would only get in the way of tools reading JSON.
+    COLOUR.store(colour && log_format == LogFormat::Text, Ordering::Relaxed);
+
+    // Several runs can append to the same file, so each starts by saying what it's about.
+    if let Some(log_file) = log_file {
+        open_log_file(&log_file).await?;
+        let now = Local::now().to_rfc3339();
+        let dest_str = if destinations.is_empty() {
+            path_str(&kobo_directory)?.to_owned()
+        } else {
+            let dirs = destinations.iter().map(|dest| path_str(&dest.dir));
+            dirs.collect::<Result<Vec<_>>>()?.join(", ")
+        };
+        let sources_str =
+            describe_book_sources(&sources.documents_directories, sources.book_list.as_deref())?;
+        let msg = format!("Started at {now}, synchronising to {dest_str} from {sources_str}.");
+        let attrs = log_attrs!(dest = dest_str, sources = sources_str);
+        let header = format_message(Verbosity::Quiet, None, msg, attrs);
+        append_to_log_file(&(header + "\n")).await?;
+    }
+
+    if verbosity == Verbosity::Verbose {
+        println_async!("{NAME} {VERSION}").await?;
+    }
+
+    if let Some(inventory) = inventory {
+        if take_inventory(&kobo_directory, &inventory).await? {
+            stdout().flush().await?;
+            exit(CHANGES_PENDING_EXIT_CODE);
+        }
+        return Ok(());
+    }
+
+    if let Some(watched) = watch {
+        return watch_device(&watched, &sources, &sync_options).await;
+    }
+
+    if let Some(reconcile_interval) = watch_sources {
+        return watch_sources_for_changes(
+            &kobo_directory,
+            &sources,
+            &sync_options,
+            reconcile_interval,
+        )
+        .await;
+    }
+
+    let outcome = if destinations.is_empty() {
+        run(&kobo_directory, mode, &sources, &sync_options, None).await?
+    } else {
+        sync_to_destinations(&destinations, &sources, &sync_options).await?
+    };
+    let exit_code = match outcome {
+        RunOutcome::Succeeded => return Ok(()),
+        RunOutcome::ChangesPending => CHANGES_PENDING_EXIT_CODE,
+        RunOutcome::PartlyFailed => PARTLY_FAILED_EXIT_CODE,
+    };
+    stdout().flush().await?;
+    exit(exit_code);
+}
+
+#[cfg(test)]
+mod tests {
+    use {super::*, std::ffi::OsString, tempfile::TempDir};
+
+    // Runs and argument parsing share process-wide state, such as the books that couldn't be
+    // copied and the options parsed into statics, so every test touching either takes turns.
+    static RUNNING: tokio::sync::Mutex<()> = tokio::sync::Mutex::const_new(());
+
+    /// Write each file under `root`, creating the directories it's in.
+    fn write_files(root: &Path, files: &[(&str, &str)]) {
+        for (path, contents) in files {
+            let path = root.join(path);
+            std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+            std::fs::write(path, contents).unwrap();
+        }
+    }
+
+    /// The contents of every file under `root`, by their paths relative to it.
+    fn read_files(root: &Path) -> BTreeMap<String, String> {
+        let mut files = BTreeMap::new();
+        let mut dirs = vec![root.to_path_buf()];
+        while let Some(dir) = dirs.pop() {
+            for entry in std::fs::read_dir(dir).unwrap() {
+                let path = entry.unwrap().path();
+                if path.is_dir() {
+                    dirs.push(path);
+                } else {
+                    let relative = path.strip_prefix(root).unwrap().to_string_lossy().into();
+                    files.insert(relative, std::fs::read_to_string(&path).unwrap());
+                }
+            }
+        }
+        files
+    }
+
+    fn files(files: &[(&str, &str)]) -> BTreeMap<String, String> {
+        files
+            .iter()
+            .map(|(path, contents)| (path.to_string(), contents.to_string()))
+            .collect()
+    }
+
+    /// Parse the arguments to synchronise from `src` to `dest` with `flags`, as the command line
+    /// would. `dest_flag` says what `dest` is, such as `--kobo-directory`.
+    async fn parse(src: &Path, dest_flag: &str, dest: &Path, flags: &[&str]) -> Result<Args> {
+        let mut args: Vec<OsString> = vec![
+            NAME.into(),
+            dest_flag.into(),
+            dest.into(),
+            "--documents-directories".into(),
+            src.into(),
+        ];
+        args.extend(flags.iter().map(OsString::from));
+        parse_args(PartialArgs::try_parse_from(args)?).await
+    }
+
+    /// Synchronise from `src` to `dest` with `flags`, yielding the report of the run and whether
+    /// changes are pending.
+    async fn synchronise(src: &Path, dest: &Path, flags: &[&str]) -> (Report, Result<bool>) {
+        synchronise_to(src, "--target-directory", dest, flags).await
+    }
+
+    /// Synchronise to a Kobo at `kobo` instead, whose database is missing unless the test puts
+    /// one there.
+    async fn synchronise_to_kobo(
+        src: &Path,
+        kobo: &Path,
+        flags: &[&str],
+    ) -> (Report, Result<bool>) {
+        std::fs::create_dir_all(kobo.join(".kobo")).unwrap();
+        synchronise_to(src, "--kobo-directory", kobo, flags).await
+    }
+
+    async fn synchronise_to(
+        src: &Path,
+        dest_flag: &str,
+        dest: &Path,
+        flags: &[&str],
+    ) -> (Report, Result<bool>) {
+        let args = parse(src, dest_flag, dest, flags).await.unwrap();
+        VERBOSITY.store(Verbosity::Quiet as u8, Ordering::Relaxed);
+        find_and_act(
+            &args.kobo_directory,
+            args.mode,
+            &args.sources,
+            &args.sync_options,
+            None,
+        )
+        .await
+        .unwrap()
+    }
+
+    struct SyncCase {
+        name: &'static str,
+        flags: &'static [&'static str],
+        sources: &'static [(&'static str, &'static str)],
+        dest_before: &'static [(&'static str, &'static str)],
+        dest_after: &'static [(&'static str, &'static str)],
+        check_report: fn(&Report),
+    }
+
+    const SYNC_CASES: &[SyncCase] = &[
+        SyncCase {
+            name: "copies new books, leaving their directories behind",
+            flags: &[],
+            sources: &[("a.epub", "A"), ("fiction/b.pdf", "B")],
+            dest_before: &[],
+            dest_after: &[("a.epub", "A"), ("b.pdf", "B")],
+            check_report: |report| {
+                assert_eq!(report.found(), 2);
+                assert_eq!(report.copied, 2);
+                assert_eq!(report.transferred, 2);
+            },
+        },
+        SyncCase {
+            name: "ignores files that aren't books",
+            flags: &[],
+            sources: &[("a.epub", "A"), ("notes.txt", "N"), ("._a.epub", "M")],
+            dest_before: &[],
+            dest_after: &[("a.epub", "A")],
+            check_report: |report| {
+                assert_eq!(report.found(), 1);
+                assert_eq!(report.ignored_macos_metadata, 1);
+            },
+        },
+        SyncCase {
+            name: "skips books already there",
+            flags: &[],
+            sources: &[("a.epub", "new"), ("b.epub", "B")],
+            dest_before: &[("a.epub", "old")],
+            dest_after: &[("a.epub", "old"), ("b.epub", "B")],
+            check_report: |report| {
+                assert_eq!(report.not_copied, 1);
+                assert_eq!(report.copied, 1);
+            },
+        },
+        SyncCase {
+            name: "skips books already there whatever their case",
+            flags: &[],
+            sources: &[("A.epub", "new")],
+            dest_before: &[("a.epub", "old")],
+            dest_after: &[("a.epub", "old")],
+            check_report: |report| assert_eq!(report.not_copied, 1),
+        },
+        SyncCase {
+            name: "replaces books that differ under --update",
+            flags: &["--update"],
+            sources: &[("a.epub", "newer"), ("b.epub", "B")],
+            dest_before: &[("a.epub", "old"), ("b.epub", "B")],
+            dest_after: &[("a.epub", "newer"), ("b.epub", "B")],
+            check_report: |report| {
+                assert_eq!(report.updated, 1);
+                assert_eq!(report.not_copied, 1);
+                assert_eq!(report.copied, 0);
+            },
+        },
+        SyncCase {
+            name: "copies books with the same name and contents once",
+            flags: &[],
+            sources: &[("x/a.epub", "A"), ("y/a.epub", "A")],
+            dest_before: &[],
+            dest_after: &[("a.epub", "A")],
+            check_report: |report| {
+                assert_eq!(report.duplicate_content, 1);
+                assert_eq!(report.copied, 1);
+            },
+        },
+        SyncCase {
+            name: "moves books no longer in the sources to the trash under --prune",
+            flags: &["--prune"],
+            sources: &[("a.epub", "A")],
+            dest_before: &[("a.epub", "A"), ("gone.epub", "G"), ("notes.txt", "N")],
+            dest_after: &[
+                ("a.epub", "A"),
+                (".sync-trash/gone.epub", "G"),
+                ("notes.txt", "N"),
+            ],
+            check_report: |report| assert_eq!(report.trashed_on_device, 1),
+        },
+        SyncCase {
+            name: "removes books no longer in the sources under --prune-mode delete",
+            flags: &["--prune", "--prune-mode", "delete"],
+            sources: &[("a.epub", "A")],
+            dest_before: &[("a.epub", "A"), ("gone.pdf", "G")],
+            dest_after: &[("a.epub", "A")],
+            check_report: |report| assert_eq!(report.removed_from_device, 1),
+        },
+        SyncCase {
+            name: "counts books without copying or pruning them when dry-running",
+            flags: &["--dry-run", "--prune"],
+            sources: &[("a.epub", "A"), ("b.epub", "B")],
+            dest_before: &[("b.epub", "B"), ("gone.epub", "G")],
+            dest_after: &[("b.epub", "B"), ("gone.epub", "G")],
+            check_report: |report| {
+                assert_eq!(report.copied, 1);
+                assert_eq!(report.not_copied, 1);
+                assert_eq!(report.trashed_on_device, 1);
+                assert_eq!(report.transferred, 0);
+            },
+        },
+        SyncCase {
+            name: "filters out books by name",
+            flags: &["--include", "a*"],
+            sources: &[("a.epub", "A"), ("b.epub", "B")],
+            dest_before: &[],
+            dest_after: &[("a.epub", "A")],
+            check_report: |report| assert_eq!(report.filtered_out_by_name, 1),
+        },
+        SyncCase {
+            name: "reports books that fail validation as errors",
+            flags: &["--validate"],
+            sources: &[("a.epub", "not a Zip archive"), ("b.pdf", "B")],
+            dest_before: &[],
+            dest_after: &[("b.pdf", "B")],
+            check_report: |report| {
+                assert_eq!(report.failed_validation, 1);
+                assert_eq!(report.failed.len(), 1);
+                assert_eq!(report.failed[0].category, FailureCategory::FailedValidation);
+                assert_eq!(report.totals().errors, 1);
+            },
+        },
+    ];
+
+    #[tokio::test]
+    async fn synchronises_books() {
+        let _running = RUNNING.lock().await;
+        for case in SYNC_CASES {
+            let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+            write_files(src.path(), case.sources);
+            write_files(dest.path(), case.dest_before);
+
+            let (report, changes_pending) = synchronise(src.path(), dest.path(), case.flags).await;
+            if let Err(err) = changes_pending {
+                panic!("{}: failed with {err}", case.name);
+            }
+            assert_eq!(
+                read_files(dest.path()),
+                files(case.dest_after),
+                "{}",
+                case.name
+            );
+            (case.check_report)(&report);
+        }
+    }
+
+    #[tokio::test]
+    async fn renames_books_with_the_same_name_after_their_directories() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("x/a.epub", "X"), ("y/a.epub", "Y")]);
+
+        let (report, _) = synchronise(src.path(), dest.path(), &[]).await;
+        assert_eq!(report.renamed_for_collision, 1);
+        assert_eq!(report.copied, 2);
+        // Whichever is found first keeps its name, which depends on the order of the directories.
+        let copied = read_files(dest.path());
+        assert!(
+            copied == files(&[("a.epub", "X"), ("a (y).epub", "Y")])
+                || copied == files(&[("a.epub", "Y"), ("a (x).epub", "X")]),
+            "{copied:?}"
+        );
+    }
+
+    #[tokio::test]
+    async fn skips_books_with_the_same_name_under_skip_collision_policy() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("x/a.epub", "X"), ("y/a.epub", "Y")]);
+
+        let (report, _) = synchronise(src.path(), dest.path(), &["--on-collision", "skip"]).await;
+        assert_eq!(report.skipped_for_collision, 1);
+        assert_eq!(report.copied, 1);
+        let copied = read_files(dest.path());
+        assert!(
+            copied == files(&[("a.epub", "X")]) || copied == files(&[("a.epub", "Y")]),
+            "{copied:?}"
+        );
+    }
+
+    // PDFs were once never found, as their extension was listed with a dot that `Path::extension`
+    // never yields.
+    #[tokio::test]
+    async fn copies_pdfs() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("a.pdf", "A"), ("fiction/b.pdf", "B")]);
+
+        let (report, changes_pending) = synchronise(src.path(), dest.path(), &[]).await;
+        changes_pending.unwrap();
+        assert_eq!(report.found_by_source[src.path()]["pdf"], 2);
+        assert_eq!(report.copied, 2);
+        assert_eq!(
+            read_files(dest.path()),
+            files(&[("a.pdf", "A"), ("b.pdf", "B")])
+        );
+    }
+
+    #[tokio::test]
+    async fn totals_books_across_sources() {
+        let _running = RUNNING.lock().await;
+        let (src, other_src) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        let dest = TempDir::new().unwrap();
+        write_files(src.path(), &[("a.epub", "AA"), ("b.pdf", "BBB")]);
+        write_files(other_src.path(), &[("c.epub", "CCCC")]);
+
+        let other_src_str = other_src.path().to_str().unwrap();
+        let flags = ["--documents-directories", other_src_str];
+        let (report, changes_pending) = synchronise(src.path(), dest.path(), &flags).await;
+        changes_pending.unwrap();
+        assert_eq!(
+            report.found_by_source[src.path()].values().sum::<usize>(),
+            2
+        );
+        assert_eq!(report.found_by_source[other_src.path()]["epub"], 1);
+        assert_eq!(report.found(), 3);
+        assert_eq!(report.copied, 3);
+        assert_eq!(report.transferred, 9);
+
+        let statistics = gather_statistics(&report, "both", Mode::Sync).unwrap();
+        let value = |key| {
+            let shown = statistics.shown.iter().find(|shown| shown.key == key);
+            &shown.unwrap_or_else(|| panic!("{key} wasn't shown")).value
+        };
+        assert!(matches!(value("found"), StatisticValue::Count(3)));
+        assert!(matches!(value("transferred"), StatisticValue::Rate(9, _)));
+        let text = statistics.to_text();
+        assert!(text.contains("Found documents in both: 3"), "{text}");
+        assert!(text.contains("(9 B in total)"), "{text}");
+    }
+
+    #[tokio::test]
+    async fn checks_books_by_the_names_they_are_synchronised_under() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("Café.epub", "A"), ("b.epub", "B")]);
+
+        let (_, changes_pending) = synchronise(src.path(), dest.path(), &["--transliterate"]).await;
+        changes_pending.unwrap();
+        assert_eq!(
+            read_files(dest.path()),
+            files(&[("Cafe.epub", "A"), ("b.epub", "B")])
+        );
+
+        let flags = ["--check", "--transliterate"];
+        let (report, differences) = synchronise(src.path(), dest.path(), &flags).await;
+        assert!(!differences.unwrap());
+        assert_eq!(report.missing_on_device, 0);
+        assert_eq!(report.orphaned_on_device, 0);
+
+        // Without the option, the book looks missing and its transliterated copy orphaned.
+        let (report, differences) = synchronise(src.path(), dest.path(), &["--check"]).await;
+        assert!(differences.unwrap());
+        assert_eq!(report.missing_on_device, 1);
+        assert_eq!(report.orphaned_on_device, 1);
+    }
+
+    #[tokio::test]
+    async fn synchronises_to_several_destinations() {
+        let _running = RUNNING.lock().await;
+        let (src, kobo, kindle) = (
+            TempDir::new().unwrap(),
+            TempDir::new().unwrap(),
+            TempDir::new().unwrap(),
+        );
+        write_files(src.path(), &[("a.epub", "A"), ("b.pdf", "B")]);
+        let dest = |spec: &str, dir: &Path| format!("{spec}={}", dir.to_str().unwrap());
+        let missing = src.path().join("missing");
+        let args = [
+            NAME.to_owned(),
+            "--documents-directories".to_owned(),
+            src.path().to_str().unwrap().to_owned(),
+            "--dest".to_owned(),
+            dest("kobo", kobo.path()),
+            "--dest".to_owned(),
+            dest("kindle:pdf", kindle.path()),
+            "--dest".to_owned(),
+            dest("unplugged", &missing),
+        ];
+        let args = parse_args(PartialArgs::try_parse_from(args).unwrap())
+            .await
+            .unwrap();
+        VERBOSITY.store(Verbosity::Quiet as u8, Ordering::Relaxed);
+
+        // Unplugged destinations are skipped without failing the rest.
+        let outcome = sync_to_destinations(&args.destinations, &args.sources, &args.sync_options)
+            .await
+            .unwrap();
+        assert_eq!(outcome, RunOutcome::Succeeded);
+        assert_eq!(
+            read_files(kobo.path()),
+            files(&[("a.epub", "A"), ("b.pdf", "B")])
+        );
+        assert_eq!(read_files(kindle.path()), files(&[("b.pdf", "B")]));
+        assert!(!missing.exists());
+
+        // Each destination's report only counts the books it takes as found.
+        let kindle_dest = &args.destinations[1];
+        let books = vec![FoundBook {
+            path: src.path().join("b.pdf"),
+            relative_path: PathBuf::from("b.pdf"),
+        }];
+        let finding_stats = ["epub", "pdf"].map(|extension| Statistic::FoundSrcDocument {
+            source: src.path().to_path_buf(),
+            extension: extension.to_owned(),
+        });
+        let (report, changes_pending) =
+            sync_to_destination(kindle_dest, books, true, &finding_stats, &args.sync_options)
+                .await
+                .unwrap();
+        assert!(!changes_pending.unwrap());
+        assert_eq!(report.found(), 1);
+        assert_eq!(report.not_copied, 1);
+    }
+
+    #[tokio::test]
+    async fn dry_runs_have_changes_pending_only_when_something_would_change() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("a.epub", "A")]);
+
+        let (_, changes_pending) = synchronise(src.path(), dest.path(), &["--dry-run"]).await;
+        assert!(changes_pending.unwrap());
+
+        write_files(dest.path(), &[("a.epub", "A")]);
+        let (_, changes_pending) = synchronise(src.path(), dest.path(), &["--dry-run"]).await;
+        assert!(!changes_pending.unwrap());
+    }
+
+    #[tokio::test]
+    async fn refuses_to_prune_books_left_out_of_the_search() {
+        let _running = RUNNING.lock().await;
+        for (sources, flags) in [
+            (
+                &[
+                    ("a.epub", "A"),
+                    ("drafts/b.epub", "B"),
+                    (".syncignore", "drafts/"),
+                ][..],
+                &["--prune"][..],
+            ),
+            (&[("a.epub", "A"), ("b.epub", "")], &["--prune"]),
+            (
+                &[("a.epub", "A"), ("b.epub", "B"), (".syncignore", "b.epub")],
+                &["--prune", "--prune-mode", "delete"],
+            ),
+        ] {
+            let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+            write_files(src.path(), sources);
+            write_files(dest.path(), &[("a.epub", "A"), ("b.epub", "B")]);
+
+            let (_, pruned) = synchronise(src.path(), dest.path(), flags).await;
+            let Err(err) = pruned else {
+                panic!("pruned despite books being left out of {sources:?}");
+            };
+            assert!(err.to_string().contains("refusing to prune"), "{err}");
+            assert_eq!(
+                read_files(dest.path()),
+                files(&[("a.epub", "A"), ("b.epub", "B")]),
+                "{sources:?}"
+            );
+        }
+
+        // Empty books can be included instead, in which case they're not pruned either.
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("a.epub", "A"), ("b.epub", "")]);
+        write_files(
+            dest.path(),
+            &[("a.epub", "A"), ("b.epub", "B"), ("c.epub", "C")],
+        );
+        let (report, pruned) =
+            synchronise(src.path(), dest.path(), &["--prune", "--include-empty"]).await;
+        pruned.unwrap();
+        assert_eq!(report.trashed_on_device, 1);
+        assert!(read_files(dest.path()).contains_key("b.epub"));
+    }
+
+    #[tokio::test]
+    async fn refuses_to_prune_when_no_books_are_found() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(dest.path(), &[("a.epub", "A")]);
+
+        let (_, pruned) = synchronise(src.path(), dest.path(), &["--prune"]).await;
+        assert!(pruned.is_err());
+        assert_eq!(read_files(dest.path()), files(&[("a.epub", "A")]));
+    }
+
+    #[tokio::test]
+    async fn fails_fast_without_leaving_partial_copies() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(
+            src.path(),
+            &[
+                ("a.epub", "not a Zip archive"),
+                ("b.pdf", "B"),
+                ("c.pdf", "C"),
+            ],
+        );
+
+        let (report, stopped) =
+            synchronise(src.path(), dest.path(), &["--validate", "--fail-fast"]).await;
+        assert!(stopped.is_err());
+        assert_eq!(report.failed_validation, 1);
+        // Copies already under way are finished or removed, but none are left half-written.
+        for (name, contents) in read_files(dest.path()) {
+            assert_eq!(contents, name.trim_end_matches(".pdf").to_uppercase());
+        }
+    }
+
+    #[tokio::test]
+    async fn skips_books_not_started_before_the_timeout() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_files(src.path(), &[("a.epub", "A"), ("b.epub", "B")]);
+
+        let (report, stopped) = synchronise(src.path(), dest.path(), &["--timeout", "0s"]).await;
+        assert!(stopped.is_err());
+        assert_eq!(report.not_copied_before_timeout, 2);
+        assert_eq!(report.totals().skipped, 2);
+        assert!(read_files(dest.path()).is_empty());
+    }
+
+    #[tokio::test]
+    async fn auxiliary_failures_are_kept_apart_from_the_books() {
+        let _running = RUNNING.lock().await;
+        let export_dir = TempDir::new().unwrap();
+        let export_dir = export_dir.path().to_str().unwrap();
+        // The Kobo has no database for the annotations and collections, and `false` renders no
+        // PDF covers.
+        for (feature, flags) in [
+            (
+                AuxiliaryFeature::Annotations,
+                vec!["--export-annotations", export_dir],
+            ),
+            (AuxiliaryFeature::Collections, vec!["--collections"]),
+            (
+                AuxiliaryFeature::Covers,
+                vec!["--covers", "--pdf-cover-renderer", "false"],
+            ),
+        ] {
+            let (src, kobo) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+            write_files(src.path(), &[("fiction/a.pdf", "A")]);
+
+            let (report, changes_pending) =
+                synchronise_to_kobo(src.path(), kobo.path(), &flags).await;
+            let changes_pending = changes_pending.unwrap();
+            assert_eq!(report.copied, 1, "{feature:?}");
+            assert!(report.failed.is_empty(), "{feature:?}");
+
+            let totals = report.totals();
+            assert_eq!(totals.errors, 0, "{feature:?}");
+            assert_eq!(totals.auxiliary_errors, 1, "{feature:?}");
+            assert_eq!(report.auxiliary[&feature].failed, 1, "{feature:?}");
+            assert_eq!(report.auxiliary.len(), 1, "{feature:?}");
+
+            assert_eq!(
+                report.outcome(changes_pending, &[]),
+                RunOutcome::Succeeded,
+                "{feature:?}"
+            );
+            let others: Vec<_> = [
+                AuxiliaryFeature::Annotations,
+                AuxiliaryFeature::Collections,
+                AuxiliaryFeature::Covers,
+            ]
+            .into_iter()
+            .filter(|other| *other != feature)
+            .collect();
+            assert_eq!(
+                report.outcome(changes_pending, &others),
+                RunOutcome::Succeeded,
+                "{feature:?}"
+            );
+            assert_eq!(
+                report.outcome(changes_pending, &[feature]),
+                RunOutcome::PartlyFailed,
+                "{feature:?}"
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn auxiliary_failures_only_fail_the_run_for_features_in_use() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        std::fs::create_dir(dest.path().join(".kobo")).unwrap();
+        let args = parse(
+            src.path(),
+            "--kobo-directory",
+            dest.path(),
+            &[
+                "--covers",
+                "--fail-on-auxiliary-errors",
+                "covers,collections",
+            ],
+        )
+        .await;
+        let Err(err) = args else {
+            panic!("--fail-on-auxiliary-errors named a feature not in use");
+        };
+        let err = err.to_string();
+        assert!(
+            err.contains("--fail-on-auxiliary-errors collections"),
+            "{err}"
+        );
+
+        let args = parse(
+            src.path(),
+            "--kobo-directory",
+            dest.path(),
+            &[
+                "--covers",
+                "--collections",
+                "--fail-on-auxiliary-errors",
+                "covers,collections",
+            ],
+        )
+        .await
+        .unwrap();
+        assert_eq!(
+            args.sync_options.fail_on_auxiliary_errors,
+            [AuxiliaryFeature::Covers, AuxiliaryFeature::Collections]
+        );
+    }
+
+    /// Write `count` books across `dirs` directories, of varying sizes and with a few taking
+    /// several reads to copy, yielding their contents by their names.
+    fn write_many_books(root: &Path, dirs: usize, count: usize) -> BTreeMap<String, Vec<u8>> {
+        let mut books = BTreeMap::new();
+        for i in 0..count {
+            let name = format!("book {i}.{}", ["epub", "pdf"][i % 2]);
+            let path = root.join(format!("dir {}", i % dirs)).join(&name);
+            let size = if i % 50 == 0 {
+                (2 << 20) + i
+            } else {
+                1 + i * 131
+            };
+            let contents: Vec<u8> = (0..size).map(|b| (b + i) as u8).collect();
+            std::fs::create_dir_all(path.parent().unwrap()).unwrap();
+            std::fs::write(path, &contents).unwrap();
+            books.insert(name, contents);
+        }
+        books
+    }
+
+    fn read_binary_files(root: &Path) -> BTreeMap<String, Vec<u8>> {
+        std::fs::read_dir(root)
+            .unwrap()
+            .map(|entry| {
+                let path = entry.unwrap().path();
+                let name = path.file_name().unwrap().to_string_lossy().into();
+                (name, std::fs::read(path).unwrap())
+            })
+            .collect()
+    }
+
+    // Every book is found before any is copied, but the copies then run at once across several
+    // threads.
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn copies_many_books_at_once() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        let books = write_many_books(src.path(), 20, 400);
+        let size: usize = books.values().map(Vec::len).sum();
+
+        let (report, changes_pending) = synchronise(src.path(), dest.path(), &[]).await;
+        changes_pending.unwrap();
+        assert_eq!(report.found(), 400);
+        assert_eq!(report.copied, 400);
+        assert_eq!(report.transferred, size as u64);
+        assert!(report.failed.is_empty());
+        assert_eq!(read_binary_files(dest.path()), books);
+
+        let (report, _) = synchronise(src.path(), dest.path(), &[]).await;
+        assert_eq!(report.not_copied, 400);
+        assert_eq!(report.copied, 0);
+        assert_eq!(read_binary_files(dest.path()), books);
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn dry_runs_count_as_real_runs_do() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        write_many_books(src.path(), 10, 200);
+        write_files(
+            dest.path(),
+            &[("book 0.epub", "stale"), ("book 1.pdf", "stale")],
+        );
+
+        let (dry_run, changes_pending) =
+            synchronise(src.path(), dest.path(), &["--dry-run", "--update"]).await;
+        assert!(changes_pending.unwrap());
+        assert_eq!(read_binary_files(dest.path()).len(), 2);
+
+        let (real_run, _) = synchronise(src.path(), dest.path(), &["--update"]).await;
+        assert_eq!(
+            (dry_run.found(), dry_run.copied, dry_run.updated),
+            (real_run.found(), real_run.copied, real_run.updated)
+        );
+        assert_eq!((real_run.copied, real_run.updated), (198, 2));
+        assert_eq!(read_binary_files(dest.path()).len(), 200);
+    }
+
+    // More books fail than can be copied at once, so failures are recorded from several copies at
+    // the same time.
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn counts_failures_from_concurrent_copies() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        let mut sources = vec![];
+        for i in 0..100 {
+            let (name, contents) = if i % 2 == 0 {
+                (format!("bad {i}.epub"), "not a Zip archive")
+            } else {
+                (format!("good {i}.pdf"), "PDF")
+            };
+            sources.push((name, contents));
+        }
+        let sources: Vec<_> = sources
+            .iter()
+            .map(|(name, contents)| (name.as_str(), *contents))
+            .collect();
+        write_files(src.path(), &sources);
+
+        let (report, changes_pending) = synchronise(src.path(), dest.path(), &["--validate"]).await;
+        changes_pending.unwrap();
+        assert_eq!(report.copied, 50);
+        assert_eq!(report.failed_validation, 50);
+        assert_eq!(report.failed.len(), 50);
+        assert_eq!(report.totals().errors, 50);
+        assert!(read_files(dest.path())
+            .keys()
+            .all(|name| name.starts_with("good ")));
+    }
+
+    struct ParseCase {
+        name: &'static str,
+        /// The arguments after the program's name, in which `{src}`, `{dest}`, and `{missing}`
+        /// are replaced with a documents directory, a destination, and a path that doesn't exist.
+        args: &'static [&'static str],
+        /// What the error says, or nothing if the arguments are fine.
+        error: Option<&'static str>,
+    }
+
+    const PARSE_CASES: &[ParseCase] = &[
+        ParseCase {
+            name: "synchronises to several destinations, even ones that aren't there",
+            args: &[
+                "--dest",
+                "kobo=/nonexistent/KOBOeReader",
+                "--dest",
+                "kindle:pdf=/nonexistent/Kindle",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: None,
+        },
+        ParseCase {
+            name: "refuses destinations without directories",
+            args: &["--dest", "kobo", "--documents-directories", "{src}"],
+            error: Some("kobo is not in the form NAME=DIRECTORY"),
+        },
+        ParseCase {
+            name: "refuses destinations taking books that aren't synchronised",
+            args: &[
+                "--dest",
+                "kindle:mobi=/nonexistent/Kindle",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("takes mobi books"),
+        },
+        ParseCase {
+            name: "refuses repeated destinations",
+            args: &[
+                "--dest",
+                "kobo=/nonexistent/a",
+                "--dest",
+                "kobo=/nonexistent/b",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("The destination kobo was given more than once"),
+        },
+        ParseCase {
+            name: "refuses checking several destinations",
+            args: &[
+                "--dest",
+                "kobo=/nonexistent/KOBOeReader",
+                "--check",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("--list and --check can't be used with --dest"),
+        },
+        ParseCase {
+            name: "synchronises to a target directory",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: None,
+        },
+        ParseCase {
+            name: "synchronises to a Kobo",
+            args: &[
+                "--kobo-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: None,
+        },
+        ParseCase {
+            name: "refuses a missing target directory",
+            args: &[
+                "--target-directory",
+                "{missing}",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("The target directory at"),
+        },
+        ParseCase {
+            name: "refuses a missing Kobo",
+            args: &[
+                "--kobo-directory",
+                "{missing}",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("The Kobo storage directory at"),
+        },
+        ParseCase {
+            name: "refuses a Kobo without its state directory",
+            args: &[
+                "--kobo-directory",
+                "{src}",
+                "--documents-directories",
+                "{dest}",
+            ],
+            error: Some("does not look like a Kobo"),
+        },
+        ParseCase {
+            name: "accepts a Kobo without its state directory under --no-device-check",
+            args: &[
+                "--kobo-directory",
+                "{src}",
+                "--no-device-check",
+                "--documents-directories",
+                "{dest}",
+            ],
+            error: None,
+        },
+        ParseCase {
+            name: "refuses a missing documents directory",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{missing}",
+            ],
+            error: Some("The documents directory at"),
+        },
+        ParseCase {
+            name: "refuses a missing documents directory after one that exists",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--documents-directories",
+                "{missing}",
+            ],
+            error: Some("The documents directory at"),
+        },
+        ParseCase {
+            name: "refuses both a Kobo and a target directory",
+            args: &[
+                "--kobo-directory",
+                "{dest}",
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+            ],
+            error: Some("cannot be used with"),
+        },
+        ParseCase {
+            name: "refuses JSON output when synchronising",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--json",
+            ],
+            error: Some("JSON output is only available"),
+        },
+        ParseCase {
+            name: "refuses options needing a Kobo with a target directory",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--covers",
+            ],
+            error: Some("--covers needs a Kobo"),
+        },
+        ParseCase {
+            name: "refuses pruning books left out by filters",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--prune",
+                "--since",
+                "7d",
+            ],
+            error: Some("--since can't be used with --prune or --mirror"),
+        },
+        ParseCase {
+            name: "refuses mirroring with books left out by filters",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--mirror",
+                "--exclude-dir",
+                "Archive",
+            ],
+            error: Some("--exclude-dir can't be used with --prune or --mirror"),
+        },
+        ParseCase {
+            name: "refuses searching no depth at all",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--max-depth",
+                "0",
+            ],
+            error: Some("The maximum depth must be at least 1"),
+        },
+        ParseCase {
+            name: "refuses empty copy buffers",
+            args: &[
+                "--target-directory",
+                "{dest}",
+                "--documents-directories",
+                "{src}",
+                "--buffer-size",
+                "0",
+            ],
+            error: Some("The buffer size must be more than zero bytes"),
+        },
+    ];
+
+    #[tokio::test]
+    async fn parses_args() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        std::fs::create_dir(dest.path().join(KOBO_STATE_DIR)).unwrap();
+        let missing = src.path().join("missing");
+        let placeholders = [
+            ("{src}", src.path()),
+            ("{dest}", dest.path()),
+            ("{missing}", &missing),
+        ];
+
+        for case in PARSE_CASES {
+            let args = case.args.iter().map(|arg| {
+                placeholders
+                    .iter()
+                    .find(|(placeholder, _)| arg == placeholder)
+                    .map_or_else(|| OsString::from(arg), |(_, path)| path.into())
+            });
+            let parsed =
+                match PartialArgs::try_parse_from([OsString::from(NAME)].into_iter().chain(args)) {
+                    Ok(partial) => parse_args(partial).await,
+                    Err(err) => Err(err.into()),
+                };
+            match (parsed, case.error) {
+                (Ok(args), None) => {
+                    assert!(args.mode == Mode::Sync, "{}", case.name);
+                    assert_eq!(args.sources.documents_directories.len(), 1, "{}", case.name);
+                }
+                (Err(err), Some(error)) => {
+                    let err = err.to_string();
+                    assert!(err.contains(error), "{}: {err}", case.name);
+                }
+                (Ok(_), Some(error)) => panic!("{}: expected an error with {error}", case.name),
+                (Err(err), None) => panic!("{}: failed with {err}", case.name),
+            }
+        }
+    }
+
+    #[tokio::test]
+    async fn drops_nested_documents_directories() {
+        let _running = RUNNING.lock().await;
+        let (src, dest) = (TempDir::new().unwrap(), TempDir::new().unwrap());
+        let nested = src.path().join("nested");
+        std::fs::create_dir(&nested).unwrap();
+
+        let args = parse(
+            src.path(),
+            "--target-directory",
+            dest.path(),
+            &["--documents-directories", nested.to_str().unwrap()],
+        )
+        .await
+        .unwrap();
+        assert_eq!(args.sources.documents_directories, [src.path()]);
+        assert_eq!(args.sources.nested_documents_directories, 1);
+    }
+
+    // A benchmark rather than a test, as timings depend on the machine; run it with
+    // `cargo test --release -- --ignored --nocapture compare_copy_buffer_sizes`.
+    #[tokio::test]
+    #[ignore = "a benchmark, whose timings depend on the machine"]
+    async fn compare_copy_buffer_sizes() {
+        const BOOK_SIZES: [usize; 3] = [256 << 10, 8 << 20, 64 << 20];
+        const BUFFER_SIZES: [usize; 3] = [32 << 10, 1 << 20, 4 << 20];
+        const ATTEMPTS: usize = 5;
+
+        let _running = RUNNING.lock().await;
+        let dir = TempDir::new().unwrap();
+        let (src_path, dest_path) = (dir.path().join("book.pdf"), dir.path().join("copy.pdf"));
+        let src_str = path_str(&src_path).unwrap().to_owned();
+        let copier = Copier::new(CopyPolicy {
+            retries: 0,
+            file_timeout: None,
+            buffer_size: 64 << 10,
+            bandwidth_limit: None,
+            preserve_times: false,
+            validate: false,
+            deadline: None,
+        });
+
+        for book_size in BOOK_SIZES {
+            let contents: Vec<u8> = (0..book_size).map(|b| b as u8).collect();
+            std::fs::write(&src_path, &contents).unwrap();
+
+            // The fastest of several attempts, to leave out the noise of other work. The first is
+            // copying as before `--buffer-size`, with a 64 KiB buffer allocated for each copy.
+            let mut fastest = [Duration::MAX; BUFFER_SIZES.len() + 1];
+            for _ in 0..ATTEMPTS {
+                let mut src = File::open(&src_path).await.unwrap();
+                let mut dest = File::create(&dest_path).await.unwrap();
+                let started = Instant::now();
+                let mut buf = vec![0; 64 << 10];
+                copier
+                    .copy_reporting_progress(&mut src, &mut dest, &src_str, &mut buf)
+                    .await
+                    .unwrap();
+                fastest[0] = fastest[0].min(started.elapsed());
+
+                for (i, buffer_size) in BUFFER_SIZES.into_iter().enumerate() {
+                    let mut src = File::open(&src_path).await.unwrap();
+                    let mut dest = File::create(&dest_path).await.unwrap();
+                    let mut buffer = copier.take_buffer(buffer_size).await.unwrap();
+                    let started = Instant::now();
+                    copier
+                        .copy_reporting_progress(&mut src, &mut dest, &src_str, &mut buffer.buf)
+                        .await
+                        .unwrap();
+                    fastest[i + 1] = fastest[i + 1].min(started.elapsed());
+                    assert_eq!(std::fs::read(&dest_path).unwrap(), contents);
+                }
+            }
+
+            let names = BUFFER_SIZES
+                .map(|buffer_size| format!("--buffer-size {}", format_size(buffer_size as u64)));
+            println!("Copying {}:", format_size(book_size as u64));
+            for (name, took) in ["unpooled 64.0 KiB".to_owned()]
+                .into_iter()
+                .chain(names)
+                .zip(fastest)
+            {
+                let rate = (book_size as f64 / took.as_secs_f64()) as u64;
+                println!("  {name}: {}/s", format_size(rate));
+            }
+        }
+    }
+}
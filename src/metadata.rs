@@ -0,0 +1,115 @@
+mod epub;
+mod pdf;
+
+use {
+    anyhow::{anyhow, Result},
+    std::path::{Path, PathBuf},
+    tokio::task::spawn_blocking,
+};
+
+/// The bibliographic details embedded in a book, where it has any.
+#[derive(Debug, Default)]
+pub struct BookMetadata {
+    pub title: Option<String>,
+    pub authors: Vec<String>,
+    /// Identifiers such as `urn:isbn:9781492077213`, in whatever scheme the book uses.
+    pub identifiers: Vec<String>,
+}
+
+impl BookMetadata {
+    /// The first author, which is all that fits into a filename.
+    pub fn lead_author(&self) -> Option<&str> {
+        self.authors.first().map(String::as_str)
+    }
+
+    /// A human-readable description such as `'Learning Go', Jon Bodner`, yielding nothing without
+    /// a title.
+    pub fn describe(&self) -> Option<String> {
+        let title = self.title.as_deref()?;
+        Some(match self.lead_author() {
+            Some(author) => format!("'{title}', {author}"),
+            None => format!("'{title}'"),
+        })
+    }
+
+    /// A key identifying the work regardless of how its metadata is cased, punctuated, or orders
+    /// its authors, yielding nothing without a title.
+    pub fn identity(&self) -> Option<(String, Vec<String>)> {
+        let title = normalise_for_comparison(self.title.as_deref()?);
+        let mut authors: Vec<_> = self
+            .authors
+            .iter()
+            .map(|author| normalise_for_comparison(author))
+            .collect();
+        authors.sort();
+        Some((title, authors))
+    }
+}
+
+/// Read the metadata embedded in an EPUB or PDF. Other formats yield no metadata.
+pub async fn read_book_metadata(path: &Path) -> Result<BookMetadata> {
+    let ext = path
+        .extension()
+        .map(|ext| ext.to_string_lossy().to_lowercase())
+        .unwrap_or_default();
+    let path = PathBuf::from(path);
+
+    // Both formats are parsed with blocking libraries, so keep them off the async workers.
+    spawn_blocking(move || match ext.as_str() {
+        "epub" => epub::read_metadata(&path),
+        "pdf" => pdf::read_metadata(&path),
+        _ => Ok(BookMetadata::default()),
+    })
+    .await
+    .map_err(|err| anyhow!("could not read metadata: {err}"))?
+}
+
+/// Check that a book is well-formed enough to be worth copying. Only EPUBs are checked; other
+/// formats always pass.
+pub async fn validate_book(path: &Path) -> Result<()> {
+    let is_epub = path
+        .extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("epub"));
+    if !is_epub {
+        return Ok(());
+    }
+    let path = PathBuf::from(path);
+
+    spawn_blocking(move || epub::validate(&path))
+        .await
+        .map_err(|err| anyhow!("could not validate: {err}"))?
+}
+
+/// Read the cover image embedded in an EPUB, in whatever format it was embedded. Other formats,
+/// and EPUBs without covers, yield nothing.
+pub async fn read_book_cover(path: &Path) -> Result<Option<Vec<u8>>> {
+    let is_epub = path
+        .extension()
+        .is_some_and(|ext| ext.eq_ignore_ascii_case("epub"));
+    if !is_epub {
+        return Ok(None);
+    }
+    let path = PathBuf::from(path);
+
+    spawn_blocking(move || epub::read_cover(&path))
+        .await
+        .map_err(|err| anyhow!("could not read cover: {err}"))?
+}
+
+/// Collapse the runs of whitespace that metadata is often padded or wrapped with, discarding it
+/// entirely if nothing is left.
+fn normalise_field(field: &str) -> Option<String> {
+    let normalised = field.split_whitespace().collect::<Vec<_>>().join(" ");
+    (!normalised.is_empty()).then_some(normalised)
+}
+
+fn normalise_for_comparison(field: &str) -> String {
+    field
+        .chars()
+        .filter(|c| c.is_alphanumeric() || c.is_whitespace())
+        .flat_map(char::to_lowercase)
+        .collect::<String>()
+        .split_whitespace()
+        .collect::<Vec<_>>()
+        .join(" ")
+}
@@ -0,0 +1,200 @@
+use {
+    super::{normalise_field, BookMetadata},
+    anyhow::{anyhow, Result},
+    quick_xml::{events::Event, Reader},
+    std::{fs::File, io::Read, path::Path},
+    zip::ZipArchive,
+};
+
+const CONTAINER_PATH: &str = "META-INF/container.xml";
+const MIMETYPE_PATH: &str = "mimetype";
+const MIMETYPE: &str = "application/epub+zip";
+
+/// Read the title, authors, and identifiers from the OPF package document that an EPUB's container points to.
+pub fn read_metadata(path: &Path) -> Result<BookMetadata> {
+    let file = File::open(path)?;
+    let mut archive = ZipArchive::new(file).map_err(|err| anyhow!("not a valid EPUB: {err}"))?;
+
+    let container = read_entry(&mut archive, CONTAINER_PATH)?;
+    let opf_path = find_opf_path(&container)?;
+    let opf = read_entry(&mut archive, &opf_path)?;
+    parse_opf(&opf)
+}
+
+/// Check that an EPUB is a readable Zip archive declaring itself to be an EPUB, as truncated
+/// downloads and other corrupt files otherwise show up in the Kobo's library but fail to open.
+pub fn validate(path: &Path) -> Result<()> {
+    let file = File::open(path)?;
+    let mut archive = ZipArchive::new(file)
+        .map_err(|err| anyhow!("its central directory is unreadable: {err}"))?;
+
+    let mimetype = read_entry(&mut archive, MIMETYPE_PATH)?;
+    if mimetype.trim() != MIMETYPE {
+        return Err(anyhow!(
+            "its {MIMETYPE_PATH} is {mimetype:?} rather than {MIMETYPE:?}"
+        ));
+    }
+
+    // Each entry's header is read too, as the central directory can be intact while the entries it
+    // points to are damaged.
+    for index in 0..archive.len() {
+        archive
+            .by_index(index)
+            .map_err(|err| anyhow!("entry {index} is unreadable: {err}"))?;
+    }
+    Ok(())
+}
+
+/// Read the cover image of an EPUB, which is the manifest item with the `cover-image` property in
+/// EPUB 3, or the item named by the `cover` metadata in EPUB 2. EPUBs without one yield nothing.
+pub fn read_cover(path: &Path) -> Result<Option<Vec<u8>>> {
+    let file = File::open(path)?;
+    let mut archive = ZipArchive::new(file).map_err(|err| anyhow!("not a valid EPUB: {err}"))?;
+
+    let container = read_entry(&mut archive, CONTAINER_PATH)?;
+    let opf_path = find_opf_path(&container)?;
+    let opf = read_entry(&mut archive, &opf_path)?;
+    let Some(href) = find_cover_href(&opf)? else {
+        return Ok(None);
+    };
+
+    // Manifest items are relative to the package document.
+    let cover_path = match opf_path.rsplit_once('/') {
+        Some((opf_dir, _)) => format!("{opf_dir}/{href}"),
+        None => href,
+    };
+    let mut entry = archive
+        .by_name(&cover_path)
+        .map_err(|err| anyhow!("could not find {cover_path}: {err}"))?;
+    let mut cover = vec![];
+    entry
+        .read_to_end(&mut cover)
+        .map_err(|err| anyhow!("could not read {cover_path}: {err}"))?;
+    Ok(Some(cover))
+}
+
+fn find_cover_href(opf: &str) -> Result<Option<String>> {
+    let mut reader = Reader::from_str(opf);
+    let mut cover_id = None;
+    let mut hrefs_by_id = vec![];
+
+    loop {
+        match reader.read_event()? {
+            Event::Start(element) | Event::Empty(element) => match element.local_name().as_ref() {
+                b"meta" => {
+                    let name = element.try_get_attribute("name")?;
+                    if name.is_some_and(|name| name.value.as_ref() == b"cover") {
+                        if let Some(content) = element.try_get_attribute("content")? {
+                            cover_id = Some(content.unescape_value()?.into_owned());
+                        }
+                    }
+                }
+                b"item" => {
+                    let (Some(id), Some(href)) = (
+                        element.try_get_attribute("id")?,
+                        element.try_get_attribute("href")?,
+                    ) else {
+                        continue;
+                    };
+                    let href = href.unescape_value()?.into_owned();
+                    let is_cover_image =
+                        element
+                            .try_get_attribute("properties")?
+                            .is_some_and(|properties| {
+                                properties
+                                    .value
+                                    .split(|b| b.is_ascii_whitespace())
+                                    .any(|property| property == b"cover-image")
+                            });
+                    if is_cover_image {
+                        return Ok(Some(href));
+                    }
+                    hrefs_by_id.push((id.unescape_value()?.into_owned(), href));
+                }
+                _ => {}
+            },
+            Event::Eof => break,
+            _ => {}
+        }
+    }
+
+    Ok(cover_id.and_then(|cover_id| {
+        hrefs_by_id
+            .into_iter()
+            .find(|(id, _)| *id == cover_id)
+            .map(|(_, href)| href)
+    }))
+}
+
+fn read_entry(archive: &mut ZipArchive<File>, name: &str) -> Result<String> {
+    let mut entry = archive
+        .by_name(name)
+        .map_err(|err| anyhow!("could not find {name}: {err}"))?;
+    let mut contents = String::new();
+    entry
+        .read_to_string(&mut contents)
+        .map_err(|err| anyhow!("could not read {name}: {err}"))?;
+    Ok(contents)
+}
+
+fn find_opf_path(container: &str) -> Result<String> {
+    let mut reader = Reader::from_str(container);
+
+    loop {
+        match reader.read_event()? {
+            Event::Start(element) | Event::Empty(element)
+                if element.local_name().as_ref() == b"rootfile" =>
+            {
+                if let Some(full_path) = element.try_get_attribute("full-path")? {
+                    return Ok(full_path.unescape_value()?.into_owned());
+                }
+            }
+            Event::Eof => return Err(anyhow!("{CONTAINER_PATH} does not name a package document")),
+            _ => {}
+        }
+    }
+}
+
+fn parse_opf(opf: &str) -> Result<BookMetadata> {
+    let mut reader = Reader::from_str(opf);
+    let mut metadata = BookMetadata::default();
+
+    // Dublin Core elements are matched by local name, as the prefix they are bound to varies.
+    let mut current_field: Option<Vec<u8>> = None;
+    let mut text = String::new();
+
+    loop {
+        match reader.read_event()? {
+            Event::Start(element) => {
+                let name = element.local_name().as_ref().to_vec();
+                if [&b"title"[..], b"creator", b"identifier"].contains(&name.as_slice()) {
+                    current_field = Some(name);
+                    text.clear();
+                }
+            }
+            Event::Text(contents) if current_field.is_some() => {
+                text.push_str(&contents.unescape()?);
+            }
+            Event::CData(contents) if current_field.is_some() => {
+                text.push_str(&String::from_utf8_lossy(&contents));
+            }
+            Event::End(element)
+                if current_field.as_deref() == Some(element.local_name().as_ref()) =>
+            {
+                let field = normalise_field(&text);
+                match current_field.take().as_deref() {
+                    Some(b"title") if metadata.title.is_none() => metadata.title = field,
+                    Some(b"creator") => metadata.authors.extend(field),
+                    Some(b"identifier") => metadata.identifiers.extend(field),
+                    _ => {}
+                }
+            }
+            // Only the package metadata is of interest, not the manifest or spine.
+            Event::End(element) if element.local_name().as_ref() == b"metadata" => break,
+            Event::Eof => break,
+            _ => {}
+        }
+    }
+
+    Ok(metadata)
+}
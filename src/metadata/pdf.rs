@@ -0,0 +1,318 @@
+use {
+    super::{normalise_field, BookMetadata},
+    anyhow::Result,
+    std::{
+        fs::File,
+        io::{BufRead, BufReader, Read, Seek, SeekFrom},
+        path::Path,
+    },
+};
+
+// The trailer that references the Info dictionary sits at the end of the file, so only its tail is
+// read rather than the whole of what could be a very large scanned book.
+const TAIL_SIZE: u64 = 64 * 1024;
+const XREF_ENTRY_SIZE: u64 = 20;
+const MAX_DICTIONARY_SIZE: usize = 16 * 1024;
+
+/// Read the title and author from a PDF's Info dictionary. Only the tail of the file and, if the
+/// dictionary isn't there, the cross-reference table entry pointing to it are read. Info
+/// dictionaries that are missing or packed into compressed object streams yield no metadata.
+pub fn read_metadata(path: &Path) -> Result<BookMetadata> {
+    let mut file = File::open(path)?;
+    let len = file.metadata()?.len();
+
+    let tail_start = len.saturating_sub(TAIL_SIZE);
+    file.seek(SeekFrom::Start(tail_start))?;
+    let mut tail = vec![];
+    file.read_to_end(&mut tail)?;
+
+    let dictionary = match find_info_reference(&tail) {
+        Some(InfoReference::Inline(start)) => extract_dictionary(&tail[start..]),
+        Some(InfoReference::Object { number, header }) => match find_subslice(&tail, &header) {
+            Some(start) => extract_dictionary(&tail[start..]),
+            None => read_object_via_xref(&mut file, &tail, number, &header)?,
+        },
+        None => None,
+    };
+
+    Ok(dictionary
+        .map(|dictionary| BookMetadata {
+            title: read_string_entry(&dictionary, b"/Title"),
+            authors: read_string_entry(&dictionary, b"/Author")
+                .into_iter()
+                .collect(),
+            ..BookMetadata::default()
+        })
+        .unwrap_or_default())
+}
+
+enum InfoReference {
+    /// The offset of a dictionary written directly after `/Info`.
+    Inline(usize),
+    /// The indirect object holding the dictionary, along with its header such as `12 0 obj`.
+    Object { number: u64, header: Vec<u8> },
+}
+
+fn find_info_reference(tail: &[u8]) -> Option<InfoReference> {
+    // Incremental updates append trailers, so the last one is the most current.
+    let start = rfind_subslice(tail, b"/Info")? + b"/Info".len();
+    let rest = &tail[start..];
+    let skipped = rest.iter().take_while(|b| b.is_ascii_whitespace()).count();
+    if rest[skipped..].starts_with(b"<<") {
+        return Some(InfoReference::Inline(start + skipped));
+    }
+
+    let mut parts = rest
+        .split(|b| b.is_ascii_whitespace())
+        .filter(|part| !part.is_empty());
+    let number = parts.next().and_then(parse_integer)?;
+    let generation = parts.next().and_then(parse_integer)?;
+    if !parts.next()?.starts_with(b"R") {
+        return None;
+    }
+
+    let header = format!("{number} {generation} obj").into_bytes();
+    Some(InfoReference::Object { number, header })
+}
+
+fn parse_integer(bytes: &[u8]) -> Option<u64> {
+    std::str::from_utf8(bytes).ok()?.parse().ok()
+}
+
+/// Look an object up in the cross-reference table that the tail's `startxref` points to, reading
+/// only the table's subsection headers and the object's own entry. Cross-reference streams aren't
+/// supported.
+fn read_object_via_xref(
+    file: &mut File,
+    tail: &[u8],
+    number: u64,
+    header: &[u8],
+) -> Result<Option<Vec<u8>>> {
+    let Some(startxref) = rfind_subslice(tail, b"startxref") else {
+        return Ok(None);
+    };
+    let Some(xref_offset) = tail[startxref + b"startxref".len()..]
+        .split(|b| b.is_ascii_whitespace())
+        .find(|part| !part.is_empty())
+        .and_then(parse_integer)
+    else {
+        return Ok(None);
+    };
+
+    file.seek(SeekFrom::Start(xref_offset))?;
+    let mut reader = BufReader::new(file);
+    let mut line = String::new();
+    reader.read_line(&mut line)?;
+    if line.trim() != "xref" {
+        return Ok(None);
+    }
+
+    let object_offset = loop {
+        line.clear();
+        if reader.read_line(&mut line)? == 0 {
+            return Ok(None);
+        }
+        let mut subsection = line.split_whitespace().map(str::parse::<u64>);
+        let (Some(Ok(first)), Some(Ok(count))) = (subsection.next(), subsection.next()) else {
+            // Anything else, such as the `trailer` keyword, ends the table.
+            return Ok(None);
+        };
+
+        // Each entry is exactly 20 bytes, such as `0000012345 00000 n\r\n`.
+        if (first..first + count).contains(&number) {
+            reader.seek_relative(((number - first) * XREF_ENTRY_SIZE) as i64)?;
+            let mut entry = [0; XREF_ENTRY_SIZE as usize];
+            reader.read_exact(&mut entry)?;
+            match (parse_integer(&entry[..10]), entry[17]) {
+                (Some(offset), b'n') => break offset,
+                _ => return Ok(None),
+            }
+        }
+        reader.seek_relative((count * XREF_ENTRY_SIZE) as i64)?;
+    };
+
+    let file = reader.into_inner();
+    file.seek(SeekFrom::Start(object_offset))?;
+    let mut object = vec![];
+    file.take(MAX_DICTIONARY_SIZE as u64)
+        .read_to_end(&mut object)?;
+    if find_subslice(&object, header) != Some(0) {
+        return Ok(None);
+    }
+    Ok(extract_dictionary(&object))
+}
+
+/// Find the first occurrence of a needle that isn't merely the end of a longer number, so that
+/// `2 0 obj` doesn't match within `12 0 obj`.
+fn find_subslice(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack
+        .windows(needle.len())
+        .enumerate()
+        .find(|&(i, window)| window == needle && (i == 0 || !haystack[i - 1].is_ascii_digit()))
+        .map(|(i, _)| i)
+}
+
+fn rfind_subslice(haystack: &[u8], needle: &[u8]) -> Option<usize> {
+    haystack
+        .windows(needle.len())
+        .rposition(|window| window == needle)
+}
+
+/// Extract the first balanced `<<...>>` dictionary, skipping over strings that might contain
+/// unbalanced brackets.
+fn extract_dictionary(bytes: &[u8]) -> Option<Vec<u8>> {
+    let start = find_subslice(bytes, b"<<")?;
+    let bytes = &bytes[start..bytes.len().min(start + MAX_DICTIONARY_SIZE)];
+
+    let mut depth = 0;
+    let mut i = 0;
+    while i < bytes.len() {
+        match bytes[i] {
+            b'(' => {
+                let (_, end) = parse_literal_string(&bytes[i..])?;
+                i += end;
+                continue;
+            }
+            b'<' if bytes.get(i + 1) == Some(&b'<') => {
+                depth += 1;
+                i += 2;
+                continue;
+            }
+            b'>' if bytes.get(i + 1) == Some(&b'>') => {
+                depth -= 1;
+                i += 2;
+                if depth == 0 {
+                    return Some(bytes[..i].to_vec());
+                }
+                continue;
+            }
+            _ => {}
+        }
+        i += 1;
+    }
+    None
+}
+
+fn read_string_entry(dictionary: &[u8], key: &[u8]) -> Option<String> {
+    let mut search_from = 0;
+    let value_start = loop {
+        let found = search_from + find_subslice(&dictionary[search_from..], key)?;
+        let after = found + key.len();
+        // Ensure `/Title` doesn't match a longer key such as `/Titles`.
+        match dictionary.get(after) {
+            Some(b) if b.is_ascii_alphanumeric() => search_from = after,
+            _ => break after,
+        }
+    };
+
+    let value = &dictionary[value_start..];
+    let skipped = value.iter().take_while(|b| b.is_ascii_whitespace()).count();
+    let value = &value[skipped..];
+
+    let bytes = match value.first()? {
+        b'(' => parse_literal_string(value)?.0,
+        b'<' => parse_hex_string(value)?,
+        _ => return None,
+    };
+    normalise_field(&decode_text_string(&bytes))
+}
+
+/// Parse a literal string such as `(Structure \(and\) Interpretation)`, returning its bytes and
+/// the length consumed.
+fn parse_literal_string(bytes: &[u8]) -> Option<(Vec<u8>, usize)> {
+    let mut parsed = vec![];
+    let mut depth = 0;
+    let mut i = 0;
+
+    while i < bytes.len() {
+        let b = bytes[i];
+        i += 1;
+        match b {
+            b'(' => {
+                depth += 1;
+                if depth > 1 {
+                    parsed.push(b);
+                }
+            }
+            b')' => {
+                depth -= 1;
+                if depth == 0 {
+                    return Some((parsed, i));
+                }
+                parsed.push(b);
+            }
+            b'\\' => {
+                let escaped = *bytes.get(i)?;
+                i += 1;
+                match escaped {
+                    b'n' => parsed.push(b'\n'),
+                    b'r' => parsed.push(b'\r'),
+                    b't' => parsed.push(b'\t'),
+                    b'b' => parsed.push(0x08),
+                    b'f' => parsed.push(0x0c),
+                    b'0'..=b'7' => {
+                        let mut value = u32::from(escaped - b'0');
+                        for _ in 0..2 {
+                            match bytes.get(i) {
+                                Some(&digit @ b'0'..=b'7') => {
+                                    value = value * 8 + u32::from(digit - b'0');
+                                    i += 1;
+                                }
+                                _ => break,
+                            }
+                        }
+                        parsed.push(value as u8);
+                    }
+                    // A backslash before a line break continues the string onto the next line.
+                    b'\r' => {
+                        if bytes.get(i) == Some(&b'\n') {
+                            i += 1;
+                        }
+                    }
+                    b'\n' => {}
+                    other => parsed.push(other),
+                }
+            }
+            _ => parsed.push(b),
+        }
+    }
+    None
+}
+
+fn parse_hex_string(bytes: &[u8]) -> Option<Vec<u8>> {
+    let end = bytes.iter().position(|&b| b == b'>')?;
+    let mut digits: Vec<u8> = bytes[1..end]
+        .iter()
+        .filter(|b| !b.is_ascii_whitespace())
+        .map(|&b| (b as char).to_digit(16).map(|digit| digit as u8))
+        .collect::<Option<_>>()?;
+    // A missing final digit is taken to be zero.
+    if digits.len() % 2 == 1 {
+        digits.push(0);
+    }
+    Some(
+        digits
+            .chunks(2)
+            .map(|pair| pair[0] << 4 | pair[1])
+            .collect(),
+    )
+}
+
+/// Decode a PDF text string, which is either UTF-16BE or UTF-8 with a byte order mark, or
+/// PDFDocEncoding. The latter is close enough to Latin-1 for the characters likely to appear in
+/// titles.
+fn decode_text_string(bytes: &[u8]) -> String {
+    if let Some(utf8) = bytes.strip_prefix(&[0xef, 0xbb, 0xbf]) {
+        return String::from_utf8_lossy(utf8).into_owned();
+    }
+    match bytes.strip_prefix(&[0xfe, 0xff]) {
+        Some(utf16) => {
+            let units: Vec<u16> = utf16
+                .chunks_exact(2)
+                .map(|pair| u16::from_be_bytes([pair[0], pair[1]]))
+                .collect();
+            String::from_utf16_lossy(&units)
+        }
+        None => bytes.iter().map(|&b| char::from(b)).collect(),
+    }
+}
@@ -0,0 +1,44 @@
+use {
+    anyhow::{Error, Result},
+    std::{future::Future, path::Path, pin::Pin},
+};
+
+/// What an [`Observer`] does about an event, which is finished before the synchronisation carries
+/// on.
+pub type Observing<'a> = Pin<Box<dyn Future<Output = Result<()>> + Send + 'a>>;
+
+/// Observing nothing, for the events an observer doesn't care about.
+pub fn ignore<'a>() -> Observing<'a> {
+    Box::pin(async { Ok(()) })
+}
+
+/// Told what happens to each book as it happens, such as to show progress in a GUI rather than
+/// parsing messages. Books are found and copied concurrently, so events for different books arrive
+/// from different tasks at once and in no particular order, whereas those for the same book arrive
+/// in order. Copies wait on their events, so observers should be quick about them.
+pub trait Observer: Send + Sync {
+    /// A book was found in the sources, along with its size if it could be read.
+    fn book_discovered(&self, _path: &Path, _size: Option<u64>) -> Observing<'_> {
+        ignore()
+    }
+
+    /// A book started being copied to the destination, or being copied again after failing.
+    fn copy_started(&self, _src: &Path, _dest: &Path) -> Observing<'_> {
+        ignore()
+    }
+
+    /// Some more of a book was copied, out of its total size.
+    fn copy_progress(&self, _src: &Path, _copied: u64, _total: u64) -> Observing<'_> {
+        ignore()
+    }
+
+    /// A book finished being copied, yielding how many bytes were copied, or why it failed.
+    fn copy_finished(&self, _src: &Path, _result: Result<u64, &Error>) -> Observing<'_> {
+        ignore()
+    }
+
+    /// A book found won't be copied, for the given reason.
+    fn skipped(&self, _src: &Path, _reason: &str) -> Observing<'_> {
+        ignore()
+    }
+}
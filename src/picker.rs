@@ -0,0 +1,193 @@
+use {
+    crossterm::{
+        cursor,
+        event::{self, Event, KeyCode, KeyEvent, KeyEventKind, KeyModifiers},
+        execute, queue,
+        style::{Attribute, Print, SetAttribute},
+        terminal::{self, Clear, ClearType, EnterAlternateScreen, LeaveAlternateScreen},
+    },
+    std::io::{self, Write},
+};
+
+/// The lines above the list, for the filter and the help.
+const HEADER_LINES: u16 = 2;
+
+/// A book that can be picked, along with what's worth knowing to pick it, such as its size.
+pub struct Candidate {
+    pub name: String,
+    pub details: String,
+}
+
+/// Let the books to synchronise be picked from a list drawn on the terminal, yielding whether each
+/// candidate was picked, or `None` if picking was cancelled. The list is drawn on standard error so
+/// that standard output is left for reports.
+pub fn pick(candidates: &[Candidate]) -> io::Result<Option<Vec<bool>>> {
+    let mut terminal = io::stderr();
+    terminal::enable_raw_mode()?;
+    let picked = execute!(terminal, EnterAlternateScreen, cursor::Hide)
+        .and_then(|()| Picker::new(candidates).run(&mut terminal));
+
+    // The terminal is restored even if picking failed, so that it isn't left unusable.
+    let restored = execute!(terminal, cursor::Show, LeaveAlternateScreen);
+    terminal::disable_raw_mode()?;
+    restored?;
+    picked
+}
+
+struct Picker<'a> {
+    candidates: &'a [Candidate],
+    picked: Vec<bool>,
+    /// Only candidates with names containing this, ignoring case, are shown.
+    filter: String,
+    /// The indices of the candidates shown.
+    shown: Vec<usize>,
+    /// The position of the highlighted candidate in those shown.
+    cursor: usize,
+    /// The position of the first candidate on screen in those shown.
+    scroll: usize,
+}
+
+impl<'a> Picker<'a> {
+    fn new(candidates: &'a [Candidate]) -> Self {
+        Self {
+            candidates,
+            picked: vec![false; candidates.len()],
+            filter: String::new(),
+            shown: (0..candidates.len()).collect(),
+            cursor: 0,
+            scroll: 0,
+        }
+    }
+
+    fn run(mut self, terminal: &mut impl Write) -> io::Result<Option<Vec<bool>>> {
+        loop {
+            let page_len = page_len()?;
+            self.draw(terminal, page_len)?;
+
+            let Event::Key(KeyEvent {
+                code,
+                modifiers,
+                kind,
+                ..
+            }) = event::read()?
+            else {
+                continue;
+            };
+            if kind == KeyEventKind::Release {
+                continue;
+            }
+            let last = self.shown.len().saturating_sub(1);
+            let control = modifiers.contains(KeyModifiers::CONTROL);
+            match code {
+                KeyCode::Enter => return Ok(Some(self.picked)),
+                KeyCode::Esc => return Ok(None),
+                KeyCode::Char('c') if control => return Ok(None),
+                KeyCode::Char('a') if control => self.toggle_all_shown(),
+                KeyCode::Char(' ') => self.toggle(),
+                KeyCode::Up => self.cursor = self.cursor.saturating_sub(1),
+                KeyCode::Down => self.cursor = (self.cursor + 1).min(last),
+                KeyCode::PageUp => self.cursor = self.cursor.saturating_sub(page_len),
+                KeyCode::PageDown => self.cursor = (self.cursor + page_len).min(last),
+                KeyCode::Home => self.cursor = 0,
+                KeyCode::End => self.cursor = last,
+                KeyCode::Backspace => {
+                    self.filter.pop();
+                    self.refilter();
+                }
+                KeyCode::Char(c) if !control => {
+                    self.filter.push(c);
+                    self.refilter();
+                }
+                _ => {}
+            }
+        }
+    }
+
+    fn refilter(&mut self) {
+        let filter = self.filter.to_lowercase();
+        self.shown = (0..self.candidates.len())
+            .filter(|&index| self.candidates[index].name.to_lowercase().contains(&filter))
+            .collect();
+        self.cursor = 0;
+        self.scroll = 0;
+    }
+
+    fn toggle(&mut self) {
+        if let Some(&index) = self.shown.get(self.cursor) {
+            self.picked[index] = !self.picked[index];
+        }
+    }
+
+    /// Pick every candidate shown, or unpick them all if they're all picked already.
+    fn toggle_all_shown(&mut self) {
+        let pick = !self.shown.iter().all(|&index| self.picked[index]);
+        for &index in &self.shown {
+            self.picked[index] = pick;
+        }
+    }
+
+    fn draw(&mut self, terminal: &mut impl Write, page_len: usize) -> io::Result<()> {
+        // Scroll just enough to keep the highlighted candidate on screen.
+        if self.cursor < self.scroll {
+            self.scroll = self.cursor;
+        } else if self.scroll + page_len <= self.cursor {
+            self.scroll = self.cursor + 1 - page_len;
+        }
+
+        let (width, _) = terminal::size()?;
+        let picked = self.picked.iter().filter(|&&picked| picked).count();
+        queue!(
+            terminal,
+            Clear(ClearType::All),
+            cursor::MoveTo(0, 0),
+            Print(fit(&format!("Filter: {}", self.filter), width)),
+            cursor::MoveTo(0, 1),
+            Print(fit(
+                &format!(
+                    "{picked} of {} picked. Type to filter, space picks, ctrl-a picks all shown, \
+                        enter synchronises those picked, and escape cancels.",
+                    self.candidates.len()
+                ),
+                width
+            )),
+        )?;
+
+        let on_screen = self
+            .shown
+            .iter()
+            .enumerate()
+            .skip(self.scroll)
+            .take(page_len);
+        for (row, (position, &index)) in (HEADER_LINES..).zip(on_screen) {
+            let candidate = &self.candidates[index];
+            let mark = if self.picked[index] { "[x]" } else { "[ ]" };
+            let line = fit(
+                &format!("{mark} {} ({})", candidate.name, candidate.details),
+                width,
+            );
+            queue!(terminal, cursor::MoveTo(0, row))?;
+            if position == self.cursor {
+                queue!(
+                    terminal,
+                    SetAttribute(Attribute::Reverse),
+                    Print(line),
+                    SetAttribute(Attribute::Reset)
+                )?;
+            } else {
+                queue!(terminal, Print(line))?;
+            }
+        }
+        terminal.flush()
+    }
+}
+
+/// How many candidates fit on the terminal at once.
+fn page_len() -> io::Result<usize> {
+    let (_, height) = terminal::size()?;
+    Ok(usize::from(height.saturating_sub(HEADER_LINES)).max(1))
+}
+
+/// Cut a line down to the width of the terminal, so that it doesn't wrap onto the next.
+fn fit(line: &str, width: u16) -> String {
+    line.chars().take(usize::from(width)).collect()
+}
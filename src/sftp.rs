@@ -0,0 +1,178 @@
+use {
+    crate::{fold_case, path_str},
+    anyhow::{anyhow, Result},
+    std::{
+        collections::HashSet,
+        fmt::{self, Display, Formatter},
+        path::Path,
+        process::Stdio,
+    },
+    tokio::{io::AsyncWriteExt, process::Command},
+};
+
+const URL_SCHEME: &str = "sftp://";
+
+/// A directory on an SSH server to synchronise to, reached with the system's `sftp` so that hosts,
+/// keys, and agents are taken from the user's SSH configuration as for any other connection.
+#[derive(Debug)]
+pub struct SftpTarget {
+    /// The host as given, which can include a user and be an alias from the SSH configuration.
+    host: String,
+    port: Option<u16>,
+    dir: String,
+}
+
+impl SftpTarget {
+    /// Parse a URL such as `sftp://user@server:2222/srv/books`, where the path is absolute.
+    pub fn parse(url: &str) -> Result<Self> {
+        let rest = url
+            .strip_prefix(URL_SCHEME)
+            .ok_or_else(|| anyhow!("{url} does not start with {URL_SCHEME}"))?;
+        let (authority, dir) = match rest.find('/') {
+            Some(slash) => rest.split_at(slash),
+            None => (rest, "."),
+        };
+        let (host, port) = match authority.rsplit_once(':') {
+            Some((host, port)) => {
+                let port = port
+                    .parse()
+                    .map_err(|err| anyhow!("{url} has an invalid port: {err}"))?;
+                (host, Some(port))
+            }
+            None => (authority, None),
+        };
+        if host.is_empty() {
+            return Err(anyhow!("{url} has no host"));
+        }
+
+        Ok(SftpTarget {
+            host: host.to_owned(),
+            port,
+            dir: match dir.trim_end_matches('/') {
+                "" => "/".to_owned(),
+                dir => dir.to_owned(),
+            },
+        })
+    }
+
+    /// Check that the server can be reached and the directory exists, so that a failure to
+    /// connect is reported once rather than for every book.
+    pub async fn check_connection(&self) -> Result<()> {
+        self.run(&format!("cd {}\n", quote(&self.dir)))
+            .await
+            .map(|_| ())
+            .map_err(|err| anyhow!("could not open {self}: {err}"))
+    }
+
+    /// List what already exists in the directories that books will be copied into, relative to
+    /// the target and with their case folded. Directories that can't be entered are taken to not
+    /// exist yet, as the connection was already checked.
+    pub async fn list_existing(&self, dirs: HashSet<&Path>) -> Result<HashSet<String>> {
+        let mut existing = HashSet::new();
+        for dir in dirs {
+            let Ok(listing) = self
+                .run(&format!("cd {}\nls -1a\n", quote(&self.remote_path(dir)?)))
+                .await
+            else {
+                continue;
+            };
+            for name in listing.lines().filter(|line| !line.starts_with("sftp>")) {
+                existing.insert(fold_case(&dir.join(name)));
+            }
+        }
+        Ok(existing)
+    }
+
+    /// Copy a book to `dest`, relative to the target, creating its directories. It's uploaded
+    /// under a hidden name first and then renamed without overwriting anything, so that neither
+    /// an interrupted upload nor a book that appeared since listing are clobbered.
+    pub async fn copy(&self, src: &Path, dest: &Path) -> Result<()> {
+        let name = dest.file_name().unwrap_or_default().to_string_lossy();
+        let partial = dest.with_file_name(format!(".{name}.sync-partial"));
+        let (remote_dest, remote_partial) = (self.remote_path(dest)?, self.remote_path(&partial)?);
+
+        // Creating directories that already exist fails, which the `-` prefix tolerates.
+        let mut script = String::new();
+        for dir in dest
+            .ancestors()
+            .skip(1)
+            .collect::<Vec<_>>()
+            .into_iter()
+            .rev()
+        {
+            if !dir.as_os_str().is_empty() {
+                script += &format!("-mkdir {}\n", quote(&self.remote_path(dir)?));
+            }
+        }
+        script += &format!("put {} {}\n", quote(path_str(src)?), quote(&remote_partial));
+        // The legacy rename refuses to replace an existing file, unlike the POSIX one.
+        script += &format!(
+            "rename -l {} {}\n",
+            quote(&remote_partial),
+            quote(&remote_dest)
+        );
+
+        if let Err(err) = self.run(&script).await {
+            let _ = self.run(&format!("-rm {}\n", quote(&remote_partial))).await;
+            return Err(err);
+        }
+        Ok(())
+    }
+
+    fn remote_path(&self, relative: &Path) -> Result<String> {
+        let relative = path_str(relative)?.replace('\\', "/");
+        Ok(format!("{}/{relative}", self.dir))
+    }
+
+    /// Run a batch of `sftp` commands, yielding what they wrote. `sftp` stops at the first command
+    /// that fails.
+    async fn run(&self, script: &str) -> Result<String> {
+        let mut command = Command::new("sftp");
+        command.args(["-b", "-"]);
+        if let Some(port) = self.port {
+            command.args(["-P", &port.to_string()]);
+        }
+        let mut child = command
+            .arg(&self.host)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .spawn()
+            .map_err(|err| anyhow!("could not run sftp: {err}"))?;
+
+        if let Some(mut stdin) = child.stdin.take() {
+            stdin.write_all(script.as_bytes()).await?;
+        }
+        let output = child.wait_with_output().await?;
+        if !output.status.success() {
+            let stderr = String::from_utf8_lossy(&output.stderr);
+            // The first line has the cause, such as SSH failing to connect, rather than the
+            // consequences that follow it.
+            let reason = stderr
+                .lines()
+                .find(|line| !line.trim().is_empty())
+                .unwrap_or("sftp failed");
+            return Err(anyhow!("{}", reason.trim()));
+        }
+        Ok(String::from_utf8_lossy(&output.stdout).into_owned())
+    }
+}
+
+impl Display for SftpTarget {
+    fn fmt(&self, f: &mut Formatter<'_>) -> fmt::Result {
+        write!(f, "{URL_SCHEME}{}", self.host)?;
+        if let Some(port) = self.port {
+            write!(f, ":{port}")?;
+        }
+        // Without a path, `sftp` starts in the user's home directory.
+        match self.dir.as_str() {
+            "." => Ok(()),
+            dir => write!(f, "{dir}"),
+        }
+    }
+}
+
+/// Quote an argument for an `sftp` batch, which also keeps glob characters in it literal.
+fn quote(arg: &str) -> String {
+    format!("\"{}\"", arg.replace('\\', "\\\\").replace('"', "\\\""))
+}
@@ -0,0 +1,149 @@
+use {
+    crate::{path_str, KOBO_STATE_DIR, NAME},
+    anyhow::{anyhow, Result},
+    directories::ProjectDirs,
+    serde::{Deserialize, Serialize},
+    std::{
+        collections::BTreeMap,
+        io::ErrorKind,
+        path::{Path, PathBuf},
+        time::SystemTime,
+    },
+    tokio::fs,
+};
+
+const STATE_FILE_NAME: &str = "state.json";
+
+/// A book as it was when it was last synchronised, and where it was copied to.
+#[derive(Deserialize, PartialEq, Serialize)]
+struct SyncedBook {
+    size: u64,
+    modified: SystemTime,
+    dest: PathBuf,
+}
+
+#[derive(Default, Deserialize, Serialize)]
+struct StateFile {
+    /// The books synchronised to each destination, keyed by their paths.
+    destinations: BTreeMap<String, BTreeMap<PathBuf, SyncedBook>>,
+}
+
+/// The books synchronised to a destination in earlier runs, so that those unchanged since can be
+/// skipped without looking for them on the destination, which is slow over USB. The state of
+/// every destination is kept in the same file, keyed by the Kobo's serial number or otherwise by
+/// the destination's path, so that different Kobos mounted at the same path aren't confused.
+pub struct SyncState {
+    path: PathBuf,
+    destination: String,
+    file: StateFile,
+}
+
+impl SyncState {
+    /// Load the state for the destination at `dest_dir`, starting afresh for it if `reset`.
+    pub async fn load(dest_dir: &Path, reset: bool) -> Result<Self> {
+        let dirs = ProjectDirs::from("", "", NAME)
+            .ok_or_else(|| anyhow!("could not find where to keep the synchronisation state"))?;
+        let path = dirs
+            .state_dir()
+            .unwrap_or_else(|| dirs.data_local_dir())
+            .join(STATE_FILE_NAME);
+        let path_str = path_str(&path)?;
+
+        let mut file: StateFile = match fs::read_to_string(&path).await {
+            Ok(contents) => match serde_json::from_str(&contents) {
+                Ok(file) => file,
+                // State that can't be understood can't be kept for the other destinations either.
+                Err(_) if reset => StateFile::default(),
+                Err(err) => {
+                    return Err(anyhow!(
+                        "invalid state in {path_str}: {err}; pass --reset-state to start again"
+                    ))
+                }
+            },
+            Err(err) if err.kind() == ErrorKind::NotFound => StateFile::default(),
+            Err(err) => return Err(anyhow!("could not read the state at {path_str}: {err}")),
+        };
+
+        let destination = destination_key(dest_dir).await?;
+        if reset {
+            file.destinations.remove(&destination);
+        }
+        Ok(Self {
+            path,
+            destination,
+            file,
+        })
+    }
+
+    /// Whether a book is the same size and was last modified at the same time as when it was last
+    /// copied to `dest`. Books that can't be read are never taken to be unchanged.
+    pub async fn is_unchanged(&self, src: &Path, dest: &Path) -> bool {
+        let Some(synced) = self
+            .file
+            .destinations
+            .get(&self.destination)
+            .and_then(|books| books.get(src))
+        else {
+            return false;
+        };
+        match synced_book(src, dest).await {
+            Some(book) => book == *synced,
+            None => false,
+        }
+    }
+
+    /// Record a book as synchronised to `dest`, as it is now.
+    pub async fn record(&mut self, src: &Path, dest: &Path) {
+        let books = self
+            .file
+            .destinations
+            .entry(self.destination.clone())
+            .or_default();
+        match synced_book(src, dest).await {
+            Some(book) => books.insert(src.to_path_buf(), book),
+            None => books.remove(src),
+        };
+    }
+
+    /// Save the state, replacing the old state in one go so that an interrupted save doesn't lose
+    /// it.
+    pub async fn save(&self) -> Result<()> {
+        let path_str = path_str(&self.path)?;
+        if let Some(dir) = self.path.parent() {
+            fs::create_dir_all(dir)
+                .await
+                .map_err(|err| anyhow!("could not save the state to {path_str}: {err}"))?;
+        }
+
+        let saving = self.path.with_extension("json.saving");
+        let contents = serde_json::to_string(&self.file)?;
+        fs::write(&saving, contents)
+            .await
+            .map_err(|err| anyhow!("could not save the state to {path_str}: {err}"))?;
+        fs::rename(&saving, &self.path)
+            .await
+            .map_err(|err| anyhow!("could not save the state to {path_str}: {err}"))?;
+        Ok(())
+    }
+}
+
+async fn synced_book(src: &Path, dest: &Path) -> Option<SyncedBook> {
+    let metadata = fs::metadata(src).await.ok()?;
+    Some(SyncedBook {
+        size: metadata.len(),
+        modified: metadata.modified().ok()?,
+        dest: dest.to_path_buf(),
+    })
+}
+
+/// Kobos start their version files with their serial numbers, which identify them wherever they
+/// happen to be mounted. Other destinations can only be told apart by their paths.
+async fn destination_key(dest_dir: &Path) -> Result<String> {
+    let version_file = dest_dir.join(KOBO_STATE_DIR).join("version");
+    if let Ok(version) = fs::read_to_string(&version_file).await {
+        if let Some(serial) = version.split(',').next().filter(|s| !s.trim().is_empty()) {
+            return Ok(format!("kobo:{}", serial.trim()));
+        }
+    }
+    Ok(path_str(dest_dir)?.to_owned())
+}
@@ -0,0 +1,96 @@
+use {
+    crate::path_str,
+    anyhow::{anyhow, Result},
+    globset::{GlobBuilder, GlobMatcher},
+    std::{io::ErrorKind, path::Path},
+    tokio::fs,
+};
+
+pub const SYNC_IGNORE_FILE_NAME: &str = ".syncignore";
+
+struct Rule {
+    matcher: GlobMatcher,
+    negated: bool,
+    dir_only: bool,
+}
+
+/// The rules of a `.syncignore` file at the root of a documents directory, using a subset of the
+/// gitignore syntax: `#` comments, `!` negations, and patterns ending in `/` that only match
+/// directories. Patterns without a slash match names at any depth, whereas patterns with one are
+/// anchored to the documents directory. Later rules override earlier ones.
+#[derive(Default)]
+pub struct SyncIgnore {
+    rules: Vec<Rule>,
+}
+
+impl SyncIgnore {
+    /// Load the rules for a documents directory, yielding no rules if it has no `.syncignore`.
+    pub async fn load(root: &Path) -> Result<Self> {
+        let path = root.join(SYNC_IGNORE_FILE_NAME);
+        let path_str = path_str(&path)?;
+
+        match fs::read_to_string(&path).await {
+            Ok(contents) => {
+                Self::parse(&contents).map_err(|err| anyhow!("invalid rules in {path_str}: {err}"))
+            }
+            Err(err) if err.kind() == ErrorKind::NotFound => Ok(Self::default()),
+            Err(err) => Err(anyhow!("could not read {path_str}: {err}")),
+        }
+    }
+
+    fn parse(contents: &str) -> Result<Self> {
+        let mut rules = vec![];
+
+        for (line, number) in contents.lines().zip(1..) {
+            let line = line.trim_end();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+
+            let (negated, pattern) = match line.strip_prefix('!') {
+                Some(pattern) => (true, pattern),
+                None => (false, line.strip_prefix('\\').unwrap_or(line)),
+            };
+            let (dir_only, pattern) = match pattern.strip_suffix('/') {
+                Some(pattern) => (true, pattern),
+                None => (false, pattern),
+            };
+
+            let anchored = pattern.contains('/');
+            let pattern = pattern.trim_start_matches('/');
+            if pattern.is_empty() {
+                return Err(anyhow!("line {number} has an empty pattern"));
+            }
+
+            let glob = if anchored {
+                pattern.to_owned()
+            } else {
+                format!("**/{pattern}")
+            };
+            let matcher = GlobBuilder::new(&glob)
+                .literal_separator(true)
+                .build()
+                .map_err(|err| anyhow!("line {number} has an invalid pattern: {err}"))?
+                .compile_matcher();
+
+            rules.push(Rule {
+                matcher,
+                negated,
+                dir_only,
+            });
+        }
+
+        Ok(Self { rules })
+    }
+
+    /// Whether a path, relative to the documents directory containing the `.syncignore`, is
+    /// ignored.
+    pub fn is_ignored(&self, relative: &Path, is_dir: bool) -> bool {
+        self.rules
+            .iter()
+            .rev()
+            .find(|rule| (is_dir || !rule.dir_only) && rule.matcher.is_match(relative))
+            .map(|rule| !rule.negated)
+            .unwrap_or(false)
+    }
+}